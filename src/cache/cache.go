@@ -85,6 +85,12 @@ func NewDirInfo(ino uint64) *DirInfo {
 	}
 }
 
+// Continue with a new transaction, after the previous one has been
+// committed.
+func (self *Cache) SetTx(tx *sql.Tx) {
+	self.tx = tx
+}
+
 // Write out the cache information for a given directory.
 func (self *Cache) UpdateDir(di *DirInfo) (err error) {
 	// First, figure out the associated directory.
@@ -25,7 +25,7 @@ func Run(args []string) (err error) {
 			return
 		}
 		var pl pool.Pool
-		pl, err = pool.OpenPool(args[0])
+		pl, err = pool.OpenPoolMode(args[0], pool.LockWriter)
 		if err != nil {
 			return
 		}
@@ -44,7 +44,7 @@ func Run(args []string) (err error) {
 			return
 		}
 		var pl pool.Pool
-		pl, err = pool.OpenPool(args[0])
+		pl, err = pool.OpenPoolMode(args[0], pool.LockWriter)
 		if err != nil {
 			return
 		}
@@ -0,0 +1,45 @@
+// Writing a file from a backup to stdout.
+
+package cat
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"pool"
+	"store"
+)
+
+// Copy the contents of the regular file 'name' within the backup
+// 'id' to stdout.
+func Run(pl pool.Pool, id *pool.OID, name string) (err error) {
+	root, err := store.BackupRoot(pl, id)
+	if err != nil {
+		return
+	}
+	_, props, err := store.Lookup(pl, root, name)
+	if err != nil {
+		return
+	}
+	if props.Kind != "REG" {
+		err = fmt.Errorf("Not a regular file in backup: %s", name)
+		return
+	}
+
+	data, err := pool.ParseOID(props.Props["data"])
+	if err != nil {
+		return
+	}
+	size, err := props.GetUint64("size")
+	if err != nil {
+		return
+	}
+	file, err := store.NewFileReader(pl, data, int64(size))
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(os.Stdout, file)
+	return
+}
@@ -19,6 +19,9 @@ type Default struct {
 type Host struct {
 	Mirror *string
 	Fs     []*FileSystem
+
+	// The default retention policy for this host's filesystems.
+	Keep *Retention
 }
 
 type FileSystem struct {
@@ -27,6 +30,33 @@ type FileSystem struct {
 	Base   string
 	Clean  *string
 	Style  string
+
+	// Retention policy, overriding the host's.
+	Keep *Retention
+
+	// How to split file data into chunks, see store.NewChunker.
+	Chunker *string
+}
+
+// How many backups to keep.  Each count keeps the newest backup from
+// that many of the most recent periods (days, weeks, ...) that have
+// backups.  'Last' simply keeps that many of the newest backups.  A
+// backup is kept if any of the rules keep it.
+type Retention struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+// Return the retention policy for the given filesystem on this host,
+// or nil if there isn't one.
+func (h *Host) Policy(fs *FileSystem) *Retention {
+	if fs.Keep != nil {
+		return fs.Keep
+	}
+	return h.Keep
 }
 
 func LoadConfig(path string) (config *Config, err error) {
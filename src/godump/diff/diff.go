@@ -0,0 +1,90 @@
+// Comparing two backups.
+
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"pool"
+	"store"
+)
+
+// The JSON form of a change, written one per line.
+type jsonChange struct {
+	Change string   `json:"change"`
+	Path   string   `json:"path"`
+	Kind   string   `json:"kind"`
+	Props  []string `json:"props,omitempty"`
+}
+
+var changeLetters = map[store.ChangeKind]string{
+	store.Added:           "A",
+	store.Removed:         "D",
+	store.Modified:        "M",
+	store.MetadataChanged: "m",
+}
+
+// Print the differences between 'name' in the backups 'a' and 'b'.
+// Each change is a line starting with A (added), D (removed), M
+// (modified contents) or m (metadata only, followed by the changed
+// properties), or with 'asJSON', a JSON object per line.
+func Run(pl pool.Pool, a, b *pool.OID, name string, asJSON bool) (err error) {
+	oldOID, err := lookup(pl, a, name)
+	if err != nil {
+		return
+	}
+	newOID, err := lookup(pl, b, name)
+	if err != nil {
+		return
+	}
+
+	prefix := strings.Trim(name, "/")
+	enc := json.NewEncoder(os.Stdout)
+	return store.Diff(pl, oldOID, newOID, func(change *store.Change) (err error) {
+		path := change.Path
+		if prefix != "" {
+			path = prefix + "/" + path
+		}
+		path = strings.TrimSuffix(path, "/")
+		if path == "" {
+			path = "."
+		}
+
+		props := change.New
+		if props == nil {
+			props = change.Old
+		}
+
+		if asJSON {
+			return enc.Encode(&jsonChange{
+				Change: change.Kind.String(),
+				Path:   path,
+				Kind:   props.Kind,
+				Props:  change.Props,
+			})
+		}
+
+		if props.Kind == "DIR" && change.Kind != store.MetadataChanged {
+			path += "/"
+		}
+		line := changeLetters[change.Kind] + " " + path
+		if change.Kind == store.MetadataChanged {
+			line += " (" + strings.Join(change.Props, ", ") + ")"
+		}
+		_, err = fmt.Println(line)
+		return
+	})
+}
+
+// Find the node at 'name' within a backup.
+func lookup(pl pool.Pool, id *pool.OID, name string) (oid *pool.OID, err error) {
+	root, err := store.BackupRoot(pl, id)
+	if err != nil {
+		return
+	}
+	oid, _, err = store.Lookup(pl, root, name)
+	return
+}
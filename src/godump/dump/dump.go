@@ -8,12 +8,14 @@ import (
 	"log"
 	"os"
 	"path"
+	"runtime"
 	"strconv"
 	"syscall"
 	"time"
 
 	"cache"
 	"fsid"
+	"linuxdir"
 	"meter"
 	"pool"
 	"store"
@@ -29,6 +31,13 @@ type backupState struct {
 	fsUUID string
 	cache  *cache.Cache
 
+	// The kind of chunker used to split file data.
+	chunker string
+
+	// The counts of the wrapped pool at the last checkpoint.
+	savedChunks int64
+	savedBytes  int64
+
 	// For the progress meter.
 	lastPath  string
 	fileCount int64
@@ -36,6 +45,16 @@ type backupState struct {
 	skipped   int64
 }
 
+// The number of goroutines used to hash and compress file data.
+var Workers = runtime.NumCPU()
+
+// A dump commits what it has written after about this many chunks or
+// bytes, giving other writers to the pool a turn.
+var (
+	CheckpointChunks int64 = 4096
+	CheckpointBytes  int64 = 256 * 1024 * 1024
+)
+
 func Run(pl pool.Pool, path string, props map[string]string) (err error) {
 	log.Printf("Backing up %q", path)
 
@@ -61,6 +80,18 @@ func Run(pl pool.Pool, path string, props map[string]string) (err error) {
 func (self *backupState) Backup(path string, props map[string]string) (err error) {
 	now := time.Now()
 
+	// The chunker can be chosen with the 'chunker' property, and
+	// is recorded in the backup.  Files whose data comes from the
+	// cache keep the chunking they were first written with.
+	self.chunker = store.DefaultChunker
+	if name, ok := props["chunker"]; ok {
+		self.chunker = name
+	}
+	err = store.CheckChunker(self.chunker)
+	if err != nil {
+		return
+	}
+
 	rootFi, err := os.Lstat(path)
 	if err != nil {
 		return
@@ -74,6 +105,11 @@ func (self *backupState) Backup(path string, props map[string]string) (err error
 		return
 	}
 
+	// The cache is written along with the backup.
+	err = pool.Begin(self.srcPool)
+	if err != nil {
+		return
+	}
 	tx := pool.GetSql(self.srcPool)
 	if tx == nil {
 		// TODO: Should this instead just warn, and backup
@@ -103,6 +139,15 @@ func (self *backupState) Backup(path string, props map[string]string) (err error
 	back.Props["_date"] = strconv.FormatInt(now.UnixNano()/1000000, 10)
 	back.Props["fsuuid"] = self.fsUUID
 
+	// Retention policies find the backups of a host by this.
+	if _, ok := back.Props["host"]; !ok {
+		back.Props["host"], err = os.Hostname()
+		if err != nil {
+			return
+		}
+	}
+	back.Props["chunker"] = self.chunker
+
 	id, err := self.writeNode("back", back)
 	if err != nil {
 		return
@@ -175,6 +220,10 @@ func (self *backupState) directory(dirPath string, dirFi os.FileInfo) (oid *pool
 		if err != nil {
 			return
 		}
+		err = self.checkpoint()
+		if err != nil {
+			return
+		}
 	}
 
 	childId, err := writer.Finalize()
@@ -183,6 +232,10 @@ func (self *backupState) directory(dirPath string, dirFi os.FileInfo) (oid *pool
 	}
 	props := encodeProps(dirFi)
 	props.Props["children"] = childId.String()
+	err = self.addXattrs(dirPath, props)
+	if err != nil {
+		return
+	}
 
 	oid, err = self.writeNode("node", props)
 	if err != nil {
@@ -193,6 +246,28 @@ func (self *backupState) directory(dirPath string, dirFi os.FileInfo) (oid *pool
 	return
 }
 
+// Commit what has been written, if there is enough of it.  Each chunk
+// is written after the ones it refers to, so what is committed is
+// complete, and so is the cache, which only refers to it.
+func (self *backupState) checkpoint() (err error) {
+	if self.pool.chunkCount-self.savedChunks < CheckpointChunks &&
+		self.pool.byteCount-self.savedBytes < CheckpointBytes {
+		return
+	}
+	err = self.pool.Flush()
+	if err != nil {
+		return
+	}
+	self.savedChunks, self.savedBytes = self.pool.chunkCount, self.pool.byteCount
+
+	err = pool.Begin(self.srcPool)
+	if err != nil {
+		return
+	}
+	self.cache.SetTx(pool.GetSql(self.srcPool))
+	return
+}
+
 func (self *backupState) regularFile(name string, fi os.FileInfo, oldCache, newCache *cache.DirInfo) (oid *pool.OID, err error) {
 	// TODO: This is duplicated here an in directory.  Generalize
 	// this.
@@ -223,7 +298,7 @@ func (self *backupState) regularFile(name string, fi os.FileInfo, oldCache, newC
 	} else {
 		// Read the data, and generate a new cache entry for
 		// it.
-		data, err = store.WriteFile(self.pool, name)
+		data, err = store.WriteFile(self.pool, name, self.chunker, Workers)
 		if err != nil {
 			return
 		}
@@ -237,6 +312,10 @@ func (self *backupState) regularFile(name string, fi os.FileInfo, oldCache, newC
 
 	props := encodeProps(fi)
 	props.Props["data"] = data.String()
+	err = self.addXattrs(name, props)
+	if err != nil {
+		return
+	}
 
 	return self.writeNode("node", props)
 }
@@ -253,11 +332,29 @@ func (self *backupState) plainNode(name string, fi os.FileInfo) (oid *pool.OID,
 		}
 	}
 
+	err = self.addXattrs(name, props)
+	if err != nil {
+		return
+	}
+
 	return self.writeNode("node", props)
 }
 
+// Add the extended attributes of the named file to its properties.
+// This includes ACLs, SELinux labels and file capabilities.  A file
+// whose attributes can't be read is backed up without them.
+func (self *backupState) addXattrs(name string, props *store.PropertyMap) (err error) {
+	attrs, err := linuxdir.Lxattrs(name)
+	if err != nil {
+		log.Printf("WARN: unable to read xattrs of %q: %s", name, err)
+		err = nil
+		return
+	}
+	return props.SetXattrs(self.pool, attrs)
+}
+
 func (self *backupState) writeNode(kind string, node *store.PropertyMap) (oid *pool.OID, err error) {
-	ch := pool.NewChunk(kind, node.Encode())
+	ch := pool.NewPoolChunk(self.pool, kind, node.Encode())
 	err = self.pool.Insert(ch)
 	if err != nil {
 		return
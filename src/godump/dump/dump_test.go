@@ -0,0 +1,104 @@
+// Test dumping to a pool shared with another writer.
+
+package dump_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"database/sql"
+
+	"godump/dump"
+	"pool"
+	"tutil"
+)
+
+// A pool that is slow to write to, so that a dump takes longer than
+// another writer is willing to wait for it.
+type slowPool struct {
+	pool.Pool
+}
+
+func (self slowPool) Insert(chunk pool.Chunk) error {
+	time.Sleep(10 * time.Millisecond)
+	return self.Pool.Insert(chunk)
+}
+
+func (self slowPool) Begin() error      { return pool.Begin(self.Pool) }
+func (self slowPool) GetSqlTx() *sql.Tx { return pool.GetSql(self.Pool) }
+func (self slowPool) Codec() pool.Codec { return pool.PoolCodec(self.Pool) }
+
+func TestDumpOverlappingSql(t *testing.T) {
+	testOverlapping(t, pool.CreateSqlPool)
+}
+
+func TestDumpOverlappingFiles(t *testing.T) {
+	testOverlapping(t, pool.CreateFilePool)
+}
+
+func testOverlapping(t *testing.T, create func(string, *pool.CreateOptions) error) {
+	tmp := tutil.NewTempDir(t)
+	defer tmp.Clean()
+	tutil.FakeBlkid(t, tmp.Path())
+	t.Setenv("XDG_CACHE_HOME", tmp.Path()+"/cache")
+
+	base := tmp.Path() + "/pool"
+	err := create(base, nil)
+	if err != nil {
+		t.Fatalf("Unable to create pool: '%s'", err)
+	}
+
+	defer func(chunks int64, timeout time.Duration) {
+		dump.CheckpointChunks = chunks
+		pool.WriteLockTimeout = timeout
+	}(dump.CheckpointChunks, pool.WriteLockTimeout)
+	dump.CheckpointChunks = 4
+	pool.WriteLockTimeout = 500 * time.Millisecond
+
+	// Each dump writes 100 chunks, taking twice as long as the
+	// other will wait for the write lock.
+	names := []string{"one", "two"}
+	for _, name := range names {
+		src := tmp.Path() + "/" + name
+		err = os.Mkdir(src, 0755)
+		for i := 0; err == nil && i < 50; i++ {
+			data := fmt.Sprintf("file %d of %s\n", i, name)
+			err = ioutil.WriteFile(fmt.Sprintf("%s/%02d", src, i), []byte(data), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Unable to make source tree: %s", err)
+		}
+	}
+
+	done := make(chan error)
+	for _, name := range names {
+		go func(name string) {
+			pl, err := pool.OpenPoolMode(base, pool.LockWriter)
+			if err != nil {
+				done <- err
+				return
+			}
+			defer pl.Close()
+			done <- dump.Run(slowPool{pl}, tmp.Path()+"/"+name, map[string]string{"fs": name})
+		}(name)
+	}
+	for range names {
+		err = <-done
+		if err != nil {
+			t.Errorf("Error dumping: %s", err)
+		}
+	}
+
+	pl, err := pool.OpenPoolMode(base, pool.LockShared)
+	if err != nil {
+		t.Fatalf("Unable to open pool: '%s'", err)
+	}
+	defer pl.Close()
+	backups, err := pl.Backups()
+	if err != nil || len(backups) != len(names) {
+		t.Errorf("Expecting %d backups, found %d: %v", len(names), len(backups), err)
+	}
+}
@@ -28,6 +28,10 @@ func (self *wrappedPool) Search(oid *pool.OID) (chunk pool.Chunk, err error) {
 	return self.child.Search(oid)
 }
 func (self *wrappedPool) Backups() (backups []*pool.OID, err error) { return self.child.Backups() }
+func (self *wrappedPool) BlobOID(kind string, data []byte) *pool.OID {
+	return pool.PoolOID(self.child, kind, data)
+}
+func (self *wrappedPool) Codec() pool.Codec { return pool.PoolCodec(self.child) }
 
 // TODO: Check if already present, and count that separately.
 
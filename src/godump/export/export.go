@@ -0,0 +1,277 @@
+// Exporting a backup as a tar stream.
+
+package export
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"linuxdir"
+	"pool"
+	"store"
+)
+
+type exportState struct {
+	tar  *tar.Writer
+	pool pool.Pool
+
+	// The parts of the backup to export.
+	match *store.PathMatcher
+
+	// The first path written for each multiply linked inode.
+	links map[linkKey]string
+
+	// Data still expected for the file being written.
+	remain int64
+
+	store.PathTrackerImpl
+	store.EmptyVisitor
+}
+
+// Write the backup to 'out' as a POSIX pax archive, with names
+// relative to ".".  If any patterns are given, only the matching
+// parts of the backup are written, along with the directories
+// leading to them.
+func Run(pl pool.Pool, id *pool.OID, out io.Writer, patterns []string) (err error) {
+	buf := bufio.NewWriterSize(out, 256*1024)
+	state := exportState{
+		tar:   tar.NewWriter(buf),
+		pool:  pl,
+		links: make(map[linkKey]string),
+	}
+	state.InitPath()
+
+	state.match, err = store.NewPathMatcher(patterns)
+	if err != nil {
+		return
+	}
+
+	err = store.Walk(pl, id, &state)
+	if err != nil {
+		return
+	}
+	err = state.tar.Close()
+	if err != nil {
+		return
+	}
+	err = buf.Flush()
+	if err != nil {
+		return
+	}
+
+	missing := state.match.Unmatched()
+	if len(missing) > 0 {
+		err = fmt.Errorf("Not found in backup: %s", strings.Join(missing, ", "))
+	}
+	return
+}
+
+func (self *exportState) Enter(props *store.PropertyMap) (err error) {
+	selected, ancestor := self.match.Match(self.Path(""))
+	if !selected && !ancestor {
+		return store.Prune
+	}
+
+	hdr, err := self.header(props, tar.TypeDir)
+	if err != nil {
+		return
+	}
+	hdr.Name += "/"
+	return self.tar.WriteHeader(hdr)
+}
+
+func (self *exportState) Open(props *store.PropertyMap) (err error) {
+	if selected, _ := self.match.Match(self.Path("")); !selected {
+		return store.Prune
+	}
+
+	linked, err := self.hardLink(props)
+	if err != nil {
+		return
+	}
+	if linked {
+		return store.Prune
+	}
+
+	hdr, err := self.header(props, tar.TypeReg)
+	if err != nil {
+		return
+	}
+	size, err := props.GetUint64("size")
+	if err != nil {
+		return
+	}
+	hdr.Size = int64(size)
+	self.remain = hdr.Size
+	return self.tar.WriteHeader(hdr)
+}
+
+// The size in the header comes from when the file was examined, and
+// the file might have changed while it was being read.  Any extra
+// data is dropped, and missing data is filled with zeros.
+func (self *exportState) Blob(chunk pool.Chunk) (err error) {
+	data := chunk.Data()
+	if int64(len(data)) > self.remain {
+		data = data[:self.remain]
+	}
+	_, err = self.tar.Write(data)
+	self.remain -= int64(len(data))
+	return
+}
+
+func (self *exportState) Close(props *store.PropertyMap) (err error) {
+	if self.remain > 0 {
+		log.Printf("WARN: file data is shorter than its size, padding: %s", self.Path("."))
+		_, err = io.CopyN(self.tar, zeros{}, self.remain)
+		self.remain = 0
+	}
+	return
+}
+
+func (self *exportState) Node(props *store.PropertyMap) (err error) {
+	if selected, _ := self.match.Match(self.Path("")); !selected {
+		return
+	}
+
+	linked, err := self.hardLink(props)
+	if err != nil || linked {
+		return
+	}
+
+	var hdr *tar.Header
+	switch props.Kind {
+	case "LNK":
+		hdr, err = self.header(props, tar.TypeSymlink)
+		if err != nil {
+			return
+		}
+		hdr.Linkname = props.Props["target"]
+	case "CHR", "BLK":
+		hdr, err = self.header(props, specialTypes[props.Kind])
+		if err != nil {
+			return
+		}
+		var rdev uint64
+		rdev, err = props.GetUint64("rdev")
+		if err != nil {
+			return
+		}
+		hdr.Devmajor = int64(linuxdir.Major(rdev))
+		hdr.Devminor = int64(linuxdir.Minor(rdev))
+	case "FIFO":
+		hdr, err = self.header(props, tar.TypeFifo)
+		if err != nil {
+			return
+		}
+	default:
+		// Tar has no way to represent sockets.
+		log.Printf("Skipping %q node: %s", props.Kind, self.Path("."))
+		return
+	}
+	return self.tar.WriteHeader(hdr)
+}
+
+var specialTypes = map[string]byte{
+	"CHR": tar.TypeChar,
+	"BLK": tar.TypeBlock,
+}
+
+// Hard links are recognized by the device and inode the node had when
+// it was backed up.
+type linkKey struct {
+	dev, ino uint64
+}
+
+// If the node is another link to an inode that has already been
+// written, write a link to the earlier path, and return 'linked'.
+// Otherwise, remember this path for later links.
+func (self *exportState) hardLink(props *store.PropertyMap) (linked bool, err error) {
+	nlink, err := props.GetUint64("nlink")
+	if err != nil || nlink < 2 {
+		err = nil
+		return
+	}
+
+	var key linkKey
+	key.dev, err = props.GetUint64("dev")
+	if err != nil {
+		return
+	}
+	key.ino, err = props.GetUint64("ino")
+	if err != nil {
+		return
+	}
+
+	first, ok := self.links[key]
+	if !ok {
+		self.links[key] = self.Path(".")
+		return
+	}
+
+	hdr, err := self.header(props, tar.TypeLink)
+	if err != nil {
+		return
+	}
+	hdr.Linkname = first
+	err = self.tar.WriteHeader(hdr)
+	linked = err == nil
+	return
+}
+
+// Build the header common to every kind of node.
+func (self *exportState) header(props *store.PropertyMap, typeflag byte) (hdr *tar.Header, err error) {
+	mode, err := props.GetInt("mode")
+	if err != nil {
+		return
+	}
+	mtime, err := store.DecodeTimestamp(props.Props["mtime"])
+	if err != nil {
+		return
+	}
+
+	hdr = &tar.Header{
+		Typeflag: typeflag,
+		Name:     self.Path("."),
+		Mode:     int64(mode & 07777),
+		ModTime:  mtime,
+		Format:   tar.FormatPAX,
+	}
+
+	// The top directory of older backups has no owner.
+	if _, ok := props.Props["uid"]; ok {
+		hdr.Uid, err = props.GetInt("uid")
+		if err != nil {
+			return
+		}
+		hdr.Gid, err = props.GetInt("gid")
+		if err != nil {
+			return
+		}
+	}
+
+	attrs, err := props.Xattrs(self.pool)
+	if err != nil {
+		return
+	}
+	if len(attrs) > 0 {
+		hdr.PAXRecords = make(map[string]string)
+		for name, value := range attrs {
+			hdr.PAXRecords["SCHILY.xattr."+name] = string(value)
+		}
+	}
+	return
+}
+
+// A reader of endless zeros.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (n int, err error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,183 @@
+// Forget backups, and remove the data that only they reference.
+
+package forget
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"godump/config"
+	"godump/listing"
+	"godump/prune"
+	"pool"
+)
+
+// A mistake in the command line, rather than a failure to forget.
+type UsageError string
+
+func (self UsageError) Error() string {
+	return string(self)
+}
+
+func Run(conf *config.Config, args []string) (err error) {
+	dryRun := false
+	policy := false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-n":
+			dryRun = true
+		case "--policy":
+			policy = true
+		default:
+			err = UsageError(fmt.Sprintf("Unknown forget option: %q", args[0]))
+			return
+		}
+		args = args[1:]
+	}
+
+	if policy && len(args) != 2 {
+		err = UsageError("usage: godump forget [-n] --policy pool host")
+		return
+	}
+	if !policy && len(args) < 2 {
+		err = UsageError("usage: godump forget [-n] pool hash...")
+		return
+	}
+
+	pl, err := pool.OpenPool(args[0])
+	if err != nil {
+		return
+	}
+	defer pl.Close()
+
+	nodes, err := listing.Collect(pl)
+	if err != nil {
+		return
+	}
+
+	var plan []Decision
+	if policy {
+		var skipped int
+		plan, skipped, err = PlanPolicy(conf, args[1], nodes)
+		if skipped > 0 {
+			log.Printf("Leaving alone %d backups without a host", skipped)
+		}
+	} else {
+		plan, err = planHashes(args[1:], nodes)
+	}
+	if err != nil {
+		return
+	}
+
+	drop := make(map[pool.OID]bool)
+	fs := ""
+	for _, d := range plan {
+		if d.Fs != fs {
+			fs = d.Fs
+			fmt.Printf("%s:\n", fs)
+		}
+		if len(d.Keep) > 0 {
+			fmt.Printf("  keep %s (%s)\n", d.Node.String(), strings.Join(d.Keep, ", "))
+		} else {
+			fmt.Printf("  drop %s\n", d.Node.String())
+			drop[*d.Node.OID] = true
+		}
+	}
+
+	if len(drop) == 0 {
+		log.Printf("No backups to forget")
+		return
+	}
+
+	keep := make([]*pool.OID, 0, len(nodes))
+	for _, bn := range nodes {
+		if !drop[*bn.OID] {
+			keep = append(keep, bn.OID)
+		}
+	}
+
+	return prune.Remove(pl, keep, dryRun)
+}
+
+// What to do with one backup.
+type Decision struct {
+	Fs   string
+	Node *listing.BackNode
+
+	// The rules keeping the backup, empty if it is to be dropped.
+	Keep []string
+}
+
+// Apply the configured retention policies to the backups of each
+// filesystem of the given host.  Backups are matched to filesystems
+// by their 'host' and 'fs' properties.  Backups without a 'host'
+// can't be told apart from another host's, so they are left alone,
+// and counted in 'skipped'.  Filesystems without a policy keep all of
+// their backups.
+func PlanPolicy(conf *config.Config, host string, nodes []*listing.BackNode) (plan []Decision, skipped int, err error) {
+	hinfo, ok := conf.Hosts[host]
+	if !ok {
+		err = fmt.Errorf("Unknown host %q (not in config file)", host)
+		return
+	}
+
+	for _, bn := range nodes {
+		if _, ok := bn.Props["host"]; !ok {
+			skipped++
+		}
+	}
+
+	for _, fs := range hinfo.Fs {
+		keep := hinfo.Policy(fs)
+		if keep == nil {
+			continue
+		}
+
+		group := make([]*listing.BackNode, 0)
+		for _, bn := range nodes {
+			if bn.Props["host"] == host && bn.Props["fs"] == fs.Volume {
+				group = append(group, bn)
+			}
+		}
+		if len(group) == 0 {
+			continue
+		}
+
+		reasons := ApplyPolicy(keep, group)
+		if len(reasons) == 0 {
+			err = fmt.Errorf("Policy for %q keeps no backups", fs.Volume)
+			return
+		}
+
+		for _, bn := range group {
+			plan = append(plan, Decision{Fs: fs.Volume, Node: bn, Keep: reasons[bn]})
+		}
+	}
+	return
+}
+
+// Forget the specifically named backups.
+func planHashes(args []string, nodes []*listing.BackNode) (plan []Decision, err error) {
+	byOID := make(map[pool.OID]*listing.BackNode)
+	for _, bn := range nodes {
+		byOID[*bn.OID] = bn
+	}
+
+	for _, arg := range args {
+		var id *pool.OID
+		id, err = pool.ParseOID(arg)
+		if err != nil {
+			err = UsageError(fmt.Sprintf("Invalid hash: %s", err))
+			return
+		}
+
+		bn, ok := byOID[*id]
+		if !ok {
+			err = fmt.Errorf("Not a backup: %s", id.String())
+			return
+		}
+		plan = append(plan, Decision{Fs: bn.Props["fs"], Node: bn})
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package forget
+
+import (
+	"fmt"
+	"time"
+
+	"godump/config"
+	"godump/listing"
+)
+
+// A single retention rule: keep the newest backup from each of the
+// most recent 'count' periods that have backups.
+type rule struct {
+	name   string
+	count  int
+	period func(t time.Time) string
+}
+
+func rules(keep *config.Retention) []rule {
+	return []rule{
+		{"last", keep.Last, func(t time.Time) string {
+			return t.Format(time.RFC3339Nano)
+		}},
+		{"daily", keep.Daily, func(t time.Time) string {
+			return t.Format("2006-01-02")
+		}},
+		{"weekly", keep.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", keep.Monthly, func(t time.Time) string {
+			return t.Format("2006-01")
+		}},
+		{"yearly", keep.Yearly, func(t time.Time) string {
+			return t.Format("2006")
+		}},
+	}
+}
+
+// Decide which of the backups to keep.  The nodes must be sorted by
+// date, oldest first.  The result maps each kept backup to the names
+// of the rules keeping it; any backup not present should be removed.
+func ApplyPolicy(keep *config.Retention, nodes []*listing.BackNode) (reasons map[*listing.BackNode][]string) {
+	reasons = make(map[*listing.BackNode][]string)
+
+	for _, r := range rules(keep) {
+		seen := 0
+		last := ""
+
+		// Since the nodes are sorted, backups in the same
+		// period are adjacent.  Walk from the newest, keeping
+		// the first backup of each period.
+		for i := len(nodes) - 1; i >= 0 && seen < r.count; i-- {
+			period := r.period(nodes[i].Date)
+			if period == last {
+				continue
+			}
+			last = period
+			seen++
+			reasons[nodes[i]] = append(reasons[nodes[i]], r.name)
+		}
+	}
+	return
+}
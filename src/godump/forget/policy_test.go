@@ -0,0 +1,219 @@
+// Test retention policies.
+
+package forget_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"godump/config"
+	"godump/forget"
+	"godump/listing"
+	"pool"
+)
+
+// Make backup nodes with the given dates, "2006-01-02 15:04", which
+// must be in order.
+func makeNodes(props map[string]string, dates ...string) (nodes []*listing.BackNode) {
+	for _, text := range dates {
+		date, err := time.Parse("2006-01-02 15:04", text)
+		if err != nil {
+			panic(err)
+		}
+		oid := pool.BlobOID("back", []byte(text+props["fs"]+props["host"]))
+		nodes = append(nodes, &listing.BackNode{OID: oid, Date: date, Props: props})
+	}
+	return
+}
+
+var policyTests = []struct {
+	name  string
+	keep  config.Retention
+	dates []string
+
+	// The rules keeping each kept backup, by index.
+	want map[int]string
+}{
+	{
+		name:  "nothing",
+		keep:  config.Retention{},
+		dates: []string{"2026-01-01 10:00", "2026-01-02 10:00"},
+		want:  map[int]string{},
+	},
+	{
+		name: "last",
+		keep: config.Retention{Last: 2},
+		dates: []string{"2026-01-01 10:00", "2026-01-01 11:00",
+			"2026-01-01 12:00", "2026-01-01 13:00"},
+		want: map[int]string{2: "last", 3: "last"},
+	},
+	{
+		name: "daily",
+		keep: config.Retention{Daily: 3},
+		dates: []string{"2025-12-31 08:00", "2026-01-01 08:00", "2026-01-01 20:00",
+			"2026-01-02 08:00", "2026-01-03 08:00"},
+		want: map[int]string{2: "daily", 3: "daily", 4: "daily"},
+	},
+	{
+		// 2025-12-31 is in ISO week 2026-W01.
+		name: "weekly",
+		keep: config.Retention{Weekly: 3},
+		dates: []string{"2025-12-20 08:00", "2025-12-29 08:00", "2025-12-31 08:00",
+			"2026-01-05 08:00", "2026-01-07 08:00"},
+		want: map[int]string{0: "weekly", 2: "weekly", 4: "weekly"},
+	},
+	{
+		name: "monthly",
+		keep: config.Retention{Monthly: 2},
+		dates: []string{"2025-11-15 08:00", "2025-12-01 08:00", "2025-12-31 08:00",
+			"2026-01-02 08:00"},
+		want: map[int]string{2: "monthly", 3: "monthly"},
+	},
+	{
+		name: "yearly",
+		keep: config.Retention{Yearly: 3},
+		dates: []string{"2024-06-01 08:00", "2025-03-01 08:00", "2025-12-31 08:00",
+			"2026-01-02 08:00"},
+		want: map[int]string{0: "yearly", 2: "yearly", 3: "yearly"},
+	},
+	{
+		name:  "more periods than backups",
+		keep:  config.Retention{Daily: 10},
+		dates: []string{"2026-01-01 08:00", "2026-01-02 08:00"},
+		want:  map[int]string{0: "daily", 1: "daily"},
+	},
+	{
+		name: "overlapping",
+		keep: config.Retention{Last: 1, Daily: 2, Monthly: 2, Yearly: 1},
+		dates: []string{"2025-12-31 10:00", "2026-01-01 09:00", "2026-01-02 09:00",
+			"2026-01-02 18:00"},
+		want: map[int]string{0: "monthly", 1: "daily",
+			3: "last,daily,monthly,yearly"},
+	},
+}
+
+func TestApplyPolicy(t *testing.T) {
+	for _, tt := range policyTests {
+		keep := tt.keep
+		nodes := makeNodes(nil, tt.dates...)
+		reasons := forget.ApplyPolicy(&keep, nodes)
+
+		for i, bn := range nodes {
+			got := strings.Join(reasons[bn], ",")
+			if got != tt.want[i] {
+				t.Errorf("%s: backup %d (%s) kept by %q, expecting %q",
+					tt.name, i, tt.dates[i], got, tt.want[i])
+			}
+		}
+		if len(reasons) != len(tt.want) {
+			t.Errorf("%s: %d backups kept, expecting %d", tt.name, len(reasons), len(tt.want))
+		}
+	}
+}
+
+// The backups a plan drops.
+func dropped(plan []forget.Decision) map[pool.OID]bool {
+	drop := make(map[pool.OID]bool)
+	for _, d := range plan {
+		if len(d.Keep) == 0 {
+			drop[*d.Node.OID] = true
+		}
+	}
+	return drop
+}
+
+func TestPlanPolicy(t *testing.T) {
+	conf := &config.Config{Hosts: map[string]*config.Host{
+		"alpha": {
+			Keep: &config.Retention{Last: 1},
+			Fs: []*config.FileSystem{
+				{Volume: "root"},
+				{Volume: "home", Keep: &config.Retention{Last: 2}},
+				{Volume: "scratch"},
+			},
+		},
+		"beta": {
+			Keep: &config.Retention{Last: 1},
+			Fs: []*config.FileSystem{
+				{Volume: "root"},
+			},
+		},
+		"gamma": {
+			Fs: []*config.FileSystem{
+				{Volume: "root", Keep: &config.Retention{}},
+			},
+		},
+		"delta": {
+			Fs: []*config.FileSystem{
+				{Volume: "root"},
+			},
+		},
+	}}
+
+	// Alpha and beta both have a "root" volume.  Backups without a
+	// host could belong to either.
+	anyRoot := makeNodes(map[string]string{"fs": "root"}, "2026-01-01 01:00")
+	alphaRoot := makeNodes(map[string]string{"fs": "root", "host": "alpha"},
+		"2026-01-01 02:00", "2026-01-02 02:00")
+	alphaHome := makeNodes(map[string]string{"fs": "home", "host": "alpha"},
+		"2026-01-01 03:00", "2026-01-02 03:00", "2026-01-03 03:00")
+	betaRoot := makeNodes(map[string]string{"fs": "root", "host": "beta"},
+		"2026-01-01 04:00", "2026-01-02 04:00", "2026-01-03 04:00")
+	deltaRoot := makeNodes(map[string]string{"fs": "root", "host": "delta"},
+		"2026-01-01 05:00", "2026-01-02 05:00")
+
+	var nodes []*listing.BackNode
+	for _, group := range [][]*listing.BackNode{anyRoot, alphaRoot, alphaHome, betaRoot, deltaRoot} {
+		nodes = append(nodes, group...)
+	}
+
+	check := func(host string, want []*listing.BackNode, planned int) {
+		plan, skipped, err := forget.PlanPolicy(conf, host, nodes)
+		if err != nil {
+			t.Fatalf("Error planning policy for %s: '%s'", host, err)
+		}
+		if skipped != len(anyRoot) {
+			t.Errorf("%s: skipped %d backups, expecting %d", host, skipped, len(anyRoot))
+		}
+		for _, d := range plan {
+			if d.Node.Props["host"] != host {
+				t.Errorf("%s: plan includes backup of %s from %q", host, d.Fs, d.Node.Props["host"])
+			}
+		}
+		if len(plan) != planned {
+			t.Errorf("%s: planned %d backups, expecting %d", host, len(plan), planned)
+		}
+		drop := dropped(plan)
+		for _, bn := range want {
+			if !drop[*bn.OID] {
+				t.Errorf("%s: backup %s of %s should be dropped", host, bn.Date, bn.Props["fs"])
+			}
+		}
+		if len(drop) != len(want) {
+			t.Errorf("%s: %d backups dropped, expecting %d", host, len(drop), len(want))
+		}
+	}
+
+	// The host's policy applies to root, and home's overrides it.
+	// Scratch has no backups.
+	check("alpha", []*listing.BackNode{alphaRoot[0], alphaHome[0]}, 5)
+	check("beta", []*listing.BackNode{betaRoot[0], betaRoot[1]}, 3)
+
+	// Without any policy, nothing is dropped.
+	check("delta", nil, 0)
+
+	_, _, err := forget.PlanPolicy(conf, "gamma", nodes)
+	if err != nil {
+		t.Errorf("Gamma has no backups, but planning failed: '%s'", err)
+	}
+	nodes = append(nodes, makeNodes(map[string]string{"fs": "root", "host": "gamma"}, "2026-01-01 06:00")...)
+	_, _, err = forget.PlanPolicy(conf, "gamma", nodes)
+	if err == nil {
+		t.Errorf("A policy keeping nothing should be refused")
+	}
+	_, _, err = forget.PlanPolicy(conf, "epsilon", nodes)
+	if err == nil {
+		t.Errorf("An unknown host should be refused")
+	}
+}
@@ -5,17 +5,33 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"pool"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"godump/cachecmd"
+	"godump/cat"
 	"godump/config"
+	"godump/diff"
 	"godump/dump"
+	"godump/export"
+	"godump/forget"
+	"godump/history"
+	"godump/httpserve"
+	"godump/importtar"
 	"godump/listing"
+	"godump/ls"
 	"godump/manager"
+	"godump/migrate"
+	"godump/mount"
+	"godump/prune"
+	"godump/reindex"
+	"godump/replicate"
 	"godump/restore"
+	"godump/verify"
 	"meter"
 )
 
@@ -24,9 +40,31 @@ func mainz() {
 }
 
 var configFile = flag.String("config", "/etc/godump.toml", "Path to config file")
+var workers = flag.Int("workers", 0, "Goroutines used to compress file data during a dump (default: one per CPU)")
+var remoteCommand = flag.String("remote-command", pool.RemoteCommand, "Command run on the remote host to serve ssh:// pools")
+
+// Commands that need to report failure to a calling script set a
+// non-zero exit status.
+var exitStatus = 0
 
 func main() {
+	defer func() {
+		if exitStatus != 0 {
+			os.Exit(exitStatus)
+		}
+	}()
+
 	flag.Parse()
+	pool.Passphrase = getPassphrase
+	if *workers > 0 {
+		dump.Workers = *workers
+	}
+	pool.RemoteCommand = *remoteCommand
+	// Keep messages out of data written to stdout.
+	switch flag.Arg(0) {
+	case "cat", "export", "serve":
+		meter.Output = os.Stderr
+	}
 	meter.Setup()
 	defer meter.Shutdown()
 
@@ -47,11 +85,53 @@ func main() {
 	args = args[1:]
 	switch cmd {
 	case "create":
+		var opts pool.CreateOptions
+		encrypt := false
+		files := false
+		for len(args) > 1 && strings.HasPrefix(args[0], "-") {
+			switch {
+			case args[0] == "-encrypt":
+				encrypt = true
+				args = args[1:]
+			case args[0] == "-files":
+				files = true
+				args = args[1:]
+			case args[0] == "-file-limit" && len(args) > 2:
+				var mib int64
+				mib, err = strconv.ParseInt(args[1], 10, 64)
+				if err != nil || mib <= 0 {
+					log.Printf("Invalid file limit: %q", args[1])
+					return
+				}
+				opts.FileLimit = mib * 1024 * 1024
+				args = args[2:]
+			case args[0] == "-codec" && len(args) > 2:
+				opts.Codec, err = pool.ParseCodec(args[1])
+				if err != nil {
+					log.Printf("%s", err)
+					return
+				}
+				args = args[2:]
+			default:
+				args = nil
+			}
+		}
 		if len(args) != 1 {
-			log.Printf("usage: godump create path")
+			log.Printf("usage: godump create [-encrypt] [-codec zlib|zstd] [-files [-file-limit MiB]] path")
 			return
 		}
-		err := pool.CreateSqlPool(args[0])
+		if encrypt {
+			opts.Passphrase, err = newPassphrase(args[0])
+			if err != nil {
+				log.Printf("Error reading passphrase: %s", err)
+				return
+			}
+		}
+		if files {
+			err = pool.CreateFilePool(args[0], &opts)
+		} else {
+			err = pool.CreateSqlPool(args[0], &opts)
+		}
 		if err != nil {
 			log.Printf("Error creating pool: %s", err)
 			return
@@ -62,7 +142,7 @@ func main() {
 			log.Printf("usage: godump list path")
 			return
 		}
-		pl, err := pool.OpenPool(args[0])
+		pl, err := pool.OpenPoolMode(args[0], pool.LockShared)
 		if err != nil {
 			log.Printf("Error opening pool: %s", err)
 			return
@@ -74,12 +154,175 @@ func main() {
 			return
 		}
 
-	case "restore":
+	case "ls":
+		recursive := len(args) > 0 && args[0] == "-R"
+		if recursive {
+			args = args[1:]
+		}
+		if len(args) < 2 || len(args) > 3 {
+			log.Printf("usage: godump ls [-R] path hash [path-in-backup]")
+			exitStatus = 2
+			return
+		}
+		pl, err := pool.OpenPoolMode(args[0], pool.LockShared)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		id, err := pool.ParseOID(args[1])
+		if err != nil {
+			log.Printf("Invalid hash: %s", err)
+			exitStatus = 2
+			return
+		}
+		name := ""
+		if len(args) > 2 {
+			name = args[2]
+		}
+		err = ls.Run(pl, id, name, recursive)
+		if err != nil {
+			log.Printf("Error listing backup: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "cat":
 		if len(args) != 3 {
-			log.Printf("usage: godump restore path hash dir")
+			log.Printf("usage: godump cat path hash path-in-backup")
+			exitStatus = 2
 			return
 		}
-		pl, err := pool.OpenPool(args[0])
+		pl, err := pool.OpenPoolMode(args[0], pool.LockShared)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		id, err := pool.ParseOID(args[1])
+		if err != nil {
+			log.Printf("Invalid hash: %s", err)
+			exitStatus = 2
+			return
+		}
+		err = cat.Run(pl, id, args[2])
+		if err != nil {
+			log.Printf("Error reading file: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "diff":
+		asJSON := len(args) > 0 && args[0] == "-json"
+		if asJSON {
+			args = args[1:]
+		}
+		if len(args) < 3 || len(args) > 4 {
+			log.Printf("usage: godump diff [-json] path hash-a hash-b [path-in-backup]")
+			exitStatus = 2
+			return
+		}
+		pl, err := pool.OpenPoolMode(args[0], pool.LockShared)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		ids, err := parseOIDs(args[1:3])
+		if err != nil {
+			log.Printf("Invalid hash: %s", err)
+			exitStatus = 2
+			return
+		}
+		name := ""
+		if len(args) > 3 {
+			name = args[3]
+		}
+		err = diff.Run(pl, ids[0], ids[1], name, asJSON)
+		if err != nil {
+			log.Printf("Error comparing backups: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "history":
+		if len(args) != 2 {
+			log.Printf("usage: godump history path path-in-backup")
+			exitStatus = 2
+			return
+		}
+		pl, err := pool.OpenPoolMode(args[0], pool.LockShared)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		err = history.Run(pl, args[1])
+		if err != nil {
+			log.Printf("Error reading history: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "find":
+		useRegexp := len(args) > 0 && args[0] == "-regex"
+		if useRegexp {
+			args = args[1:]
+		}
+		if len(args) != 2 {
+			log.Printf("usage: godump find [-regex] path pattern")
+			exitStatus = 2
+			return
+		}
+		pl, err := pool.OpenPoolMode(args[0], pool.LockShared)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		err = history.Find(pl, args[1], useRegexp)
+		if err != nil {
+			log.Printf("Error finding files: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "mount":
+		if len(args) != 2 {
+			log.Printf("usage: godump mount path mountpoint")
+			exitStatus = 2
+			return
+		}
+		pl, err := pool.OpenPoolMode(args[0], pool.LockShared)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		err = mount.Run(pl, args[1])
+		if err != nil {
+			log.Printf("Error mounting pool: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "restore":
+		var skipXattrs []string
+		if len(args) > 1 && args[0] == "-skip-xattrs" {
+			skipXattrs = strings.Split(args[1], ",")
+			args = args[2:]
+		}
+		if len(args) < 3 {
+			log.Printf("usage: godump restore [-skip-xattrs namespace,...] path hash dir [path-in-backup...]")
+			return
+		}
+		pl, err := pool.OpenPoolMode(args[0], pool.LockShared)
 		if err != nil {
 			log.Printf("Error opening pool: %s", err)
 			return
@@ -90,18 +333,259 @@ func main() {
 			log.Printf("Invalid hash: %s", err)
 			return
 		}
-		err = restore.Run(pl, id, args[2])
+		err = restore.Run(pl, id, args[2], args[3:], skipXattrs)
 		if err != nil {
 			log.Printf("Error restoring backup: %s", err)
 			return
 		}
 
+	case "export":
+		if len(args) < 2 {
+			log.Printf("usage: godump export path hash [path-in-backup...] > out.tar")
+			exitStatus = 2
+			return
+		}
+		pl, err := pool.OpenPoolMode(args[0], pool.LockShared)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		id, err := pool.ParseOID(args[1])
+		if err != nil {
+			log.Printf("Invalid hash: %s", err)
+			exitStatus = 2
+			return
+		}
+		err = export.Run(pl, id, os.Stdout, args[2:])
+		if err != nil {
+			log.Printf("Error exporting backup: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "copy":
+		if len(args) < 2 {
+			log.Printf("usage: godump copy src-path dest-path [hash...]")
+			exitStatus = 2
+			return
+		}
+		src, err := pool.OpenPoolMode(args[0], pool.LockShared)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer src.Close()
+		dst, err := pool.OpenPoolMode(args[1], pool.LockWriter)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer dst.Close()
+		ids, err := parseOIDs(args[2:])
+		if err != nil {
+			log.Printf("Invalid hash: %s", err)
+			exitStatus = 2
+			return
+		}
+		err = replicate.Run(src, dst, ids)
+		if err != nil {
+			log.Printf("Error copying backups: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "serve":
+		if len(args) != 1 {
+			log.Printf("usage: godump serve path")
+			exitStatus = 2
+			return
+		}
+		pl, err := pool.OpenPoolMode(args[0], pool.LockWriter)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		err = pool.Serve(pl, os.Stdin, os.Stdout)
+		if err != nil {
+			log.Printf("Error serving pool: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "http-serve":
+		listen := ":8080"
+		if len(args) == 3 && (args[1] == "-listen" || args[1] == "--listen") {
+			listen = args[2]
+			args = args[:1]
+		}
+		if len(args) != 1 {
+			log.Printf("usage: godump http-serve path [-listen addr:port]")
+			exitStatus = 2
+			return
+		}
+		pl, err := pool.OpenPoolMode(args[0], pool.LockWriter)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		err = httpserve.Run(pl, listen)
+		if err != nil {
+			log.Printf("Error serving pool: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "reindex":
+		truncate := len(args) > 0 && args[0] == "-truncate"
+		if truncate {
+			args = args[1:]
+		}
+		if len(args) != 1 {
+			log.Printf("usage: godump reindex [-truncate] path")
+			exitStatus = 2
+			return
+		}
+		err = reindex.Run(args[0], truncate)
+		if err != nil {
+			log.Printf("Error reindexing pool: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "migrate":
+		var opts pool.CreateOptions
+		format := ""
+		for len(args) > 2 && strings.HasPrefix(args[0], "-") {
+			switch {
+			case args[0] == "-files" || args[0] == "-sql":
+				format = args[0][1:]
+				args = args[1:]
+			case args[0] == "-file-limit" && len(args) > 3:
+				mib, err := strconv.ParseInt(args[1], 10, 64)
+				if err != nil || mib <= 0 {
+					log.Printf("Invalid file limit: %q", args[1])
+					exitStatus = 2
+					return
+				}
+				opts.FileLimit = mib * 1024 * 1024
+				args = args[2:]
+			default:
+				args = nil
+			}
+		}
+		if len(args) != 2 {
+			log.Printf("usage: godump migrate [-files [-file-limit MiB] | -sql] src-path dest-path")
+			exitStatus = 2
+			return
+		}
+		err = migrate.Run(args[0], args[1], format, opts)
+		if err != nil {
+			log.Printf("Error migrating pool: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "upgrade":
+		if len(args) != 1 {
+			log.Printf("usage: godump upgrade path")
+			exitStatus = 2
+			return
+		}
+		from, backup, err := pool.UpgradeSqlPool(args[0])
+		if err != nil {
+			log.Printf("Error upgrading pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		if backup == "" {
+			log.Printf("Pool schema %s is current", from)
+		} else {
+			log.Printf("Upgraded pool schema from %s, previous database saved as %q", from, backup)
+		}
+
+	case "verify":
+		if len(args) < 1 {
+			log.Printf("usage: godump verify path [hash...]")
+			exitStatus = 2
+			return
+		}
+		pl, err := pool.OpenPoolMode(args[0], pool.LockShared)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		ids, err := parseOIDs(args[1:])
+		if err != nil {
+			log.Printf("Invalid hash: %s", err)
+			exitStatus = 2
+			return
+		}
+		err = verify.Run(pl, ids)
+		if err != nil {
+			log.Printf("Error verifying pool: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "prune":
+		dryRun := len(args) > 0 && args[0] == "-n"
+		if dryRun {
+			args = args[1:]
+		}
+		if len(args) < 1 {
+			log.Printf("usage: godump prune [-n] path [keep-hash...]")
+			exitStatus = 2
+			return
+		}
+		pl, err := pool.OpenPool(args[0])
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		ids, err := parseOIDs(args[1:])
+		if err != nil {
+			log.Printf("Invalid hash: %s", err)
+			exitStatus = 2
+			return
+		}
+		err = prune.Run(pl, ids, dryRun)
+		if err != nil {
+			log.Printf("Error pruning pool: %s", err)
+			exitStatus = 1
+			return
+		}
+
+	case "forget":
+		err := forget.Run(config, args)
+		if _, ok := err.(forget.UsageError); ok {
+			log.Printf("%s", err)
+			exitStatus = 2
+			return
+		}
+		if err != nil {
+			log.Printf("Error forgetting backups: %s", err)
+			exitStatus = 1
+			return
+		}
+
 	case "dump":
 		if len(args) < 3 {
 			log.Printf("usage: godump dump pool dir fs=name host=name ...")
 			return
 		}
-		pl, err := pool.OpenPool(args[0])
+		pl, err := pool.OpenPoolMode(args[0], pool.LockWriter)
 		if err != nil {
 			log.Printf("Error opening pool: %s", err)
 			return
@@ -118,6 +602,32 @@ func main() {
 			return
 		}
 
+	case "import-tar":
+		if len(args) < 2 {
+			log.Printf("usage: godump import-tar pool file.tar fs=name host=name [date=yyyy-mm-dd hh:mm:ss] ...")
+			exitStatus = 2
+			return
+		}
+		pl, err := pool.OpenPoolMode(args[0], pool.LockWriter)
+		if err != nil {
+			log.Printf("Error opening pool: %s", err)
+			exitStatus = 1
+			return
+		}
+		defer pl.Close()
+		props, err := encodeProps(args[2:])
+		if err != nil {
+			log.Printf("%s", err)
+			exitStatus = 2
+			return
+		}
+		err = importtar.Run(pl, args[1], props)
+		if err != nil {
+			log.Printf("Error importing archive: %s", err)
+			exitStatus = 1
+			return
+		}
+
 	case "cache":
 		err := cachecmd.Run(args)
 		if err != nil {
@@ -152,6 +662,21 @@ func encodeProps(args []string) (props map[string]string, err error) {
 	return
 }
 
+// Parse each of the arguments as an OID.
+func parseOIDs(args []string) (oids []*pool.OID, err error) {
+	oids = make([]*pool.OID, 0, len(args))
+
+	for _, arg := range args {
+		var oid *pool.OID
+		oid, err = pool.ParseOID(arg)
+		if err != nil {
+			return
+		}
+		oids = append(oids, oid)
+	}
+	return
+}
+
 func mainy() {
 	// Testing hashes for size and speed.
 	m := make(map[pool.OID]int)
@@ -0,0 +1,333 @@
+// Following files across backups.
+
+package history
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"godump/listing"
+	"pool"
+	"store"
+)
+
+// A path as it was in one backup.  'props' is nil if the path wasn't
+// present.
+type version struct {
+	back  *listing.BackNode
+	props *store.PropertyMap
+}
+
+// Show each backup in which 'name' changed, oldest first, for each
+// filesystem it is in.
+func Run(pl pool.Pool, name string) (err error) {
+	backs, err := listing.Collect(pl)
+	if err != nil {
+		return
+	}
+
+	res := store.NewResolver(pl)
+	present := false
+	for _, group := range groupBackups(backs) {
+		versions := make([]version, 0, len(group.backs))
+		for _, back := range group.backs {
+			var root *pool.OID
+			root, err = pool.ParseOID(back.Props["hash"])
+			if err != nil {
+				return
+			}
+
+			var props *store.PropertyMap
+			_, props, err = res.Lookup(root, name)
+			if errors.Is(err, store.ErrNotFound) {
+				props, err = nil, nil
+			}
+			if err != nil {
+				return
+			}
+			versions = append(versions, version{back: back, props: props})
+		}
+
+		if showGroup(group.name, versions, "") {
+			present = true
+		}
+	}
+
+	if !present {
+		err = fmt.Errorf("%w: %s", store.ErrNotFound, name)
+	}
+	return
+}
+
+// The backups of one filesystem, which are the only ones a path is
+// compared between.
+type backupGroup struct {
+	name  string
+	backs []*listing.BackNode
+}
+
+// Group the backups by the host and filesystem they are of, keeping
+// them in order by date.  Backups made before hosts were recorded
+// have no host.
+func groupBackups(backs []*listing.BackNode) (groups []*backupGroup) {
+	byName := make(map[string]*backupGroup)
+	for _, back := range backs {
+		name := back.Props["fs"]
+		if host := back.Props["host"]; host != "" {
+			name = host + " " + name
+		}
+		group, ok := byName[name]
+		if !ok {
+			group = &backupGroup{name: name}
+			byName[name] = group
+			groups = append(groups, group)
+		}
+		group.backs = append(group.backs, back)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].name < groups[j].name })
+	return
+}
+
+// Show the changes within one group, under its name, if the path was
+// ever present in it.
+func showGroup(name string, versions []version, indent string) bool {
+	for _, ver := range versions {
+		if ver.props != nil {
+			fmt.Printf("%s%s:\n", indent, name)
+			return showChanges(versions, indent+"  ")
+		}
+	}
+	return false
+}
+
+// Find every path matching 'pattern' in any backup, and show the
+// changes to each.  A glob without a slash matches the last part of
+// the path, as with "find -name", and one with a slash matches the
+// whole path.  With 'useRegexp', the pattern is a regular expression
+// matched against the whole path.
+func Find(pl pool.Pool, pattern string, useRegexp bool) (err error) {
+	match, err := matcher(pattern, useRegexp)
+	if err != nil {
+		return
+	}
+
+	backs, err := listing.Collect(pl)
+	if err != nil {
+		return
+	}
+
+	// Searched in the order of the groups, so that the matches of
+	// each group's backups are together.
+	groups := groupBackups(backs)
+	backs = make([]*listing.BackNode, 0, len(backs))
+	for _, group := range groups {
+		backs = append(backs, group.backs...)
+	}
+
+	res := store.NewResolver(pl)
+	self := &finder{
+		pool:  pl,
+		match: match,
+		seen:  make(map[string][]found),
+	}
+
+	// The matches within each backup, by path.
+	perBack := make([]map[string]*pool.OID, len(backs))
+	names := make(map[string]bool)
+	for i, back := range backs {
+		var root *pool.OID
+		root, err = pool.ParseOID(back.Props["hash"])
+		if err != nil {
+			return
+		}
+		var props *store.PropertyMap
+		props, err = store.ReadNode(pl, root)
+		if err != nil {
+			return
+		}
+
+		var matches []found
+		matches, err = self.find("", props)
+		if err != nil {
+			return
+		}
+		perBack[i] = make(map[string]*pool.OID)
+		for _, item := range matches {
+			perBack[i][item.path] = item.oid
+			names[item.path] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		fmt.Printf("%s\n", name)
+		i := 0
+		for _, group := range groups {
+			versions := make([]version, len(group.backs))
+			for j, back := range group.backs {
+				versions[j].back = back
+				if oid, ok := perBack[i][name]; ok {
+					versions[j].props, err = res.Node(oid)
+					if err != nil {
+						return
+					}
+				}
+				i++
+			}
+			showGroup(group.name, versions, "  ")
+		}
+	}
+	return
+}
+
+// Build the test for paths matching the pattern.
+func matcher(pattern string, useRegexp bool) (match func(name string) bool, err error) {
+	if useRegexp {
+		var re *regexp.Regexp
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			return
+		}
+		return re.MatchString, nil
+	}
+
+	// Check the pattern now, rather than on every path.
+	_, err = path.Match(pattern, "")
+	if err != nil {
+		return
+	}
+	if strings.Contains(pattern, "/") {
+		pattern = strings.Trim(pattern, "/")
+		return func(name string) bool {
+			ok, _ := path.Match(pattern, name)
+			return ok
+		}, nil
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}, nil
+}
+
+type found struct {
+	path string
+	oid  *pool.OID
+}
+
+// Nodes are read as they are searched, rather than through a
+// Resolver, which would keep every node of every backup.
+type finder struct {
+	pool  pool.Pool
+	match func(name string) bool
+
+	// The matches already found below each directory, keyed by
+	// its path and contents.  Directories that didn't change
+	// between backups are only searched once.
+	seen map[string][]found
+}
+
+// Find the matching paths below the directory 'dir'.
+func (self *finder) find(dir string, props *store.PropertyMap) (matches []found, err error) {
+	key := dir + "\x00" + props.Props["children"]
+	matches, ok := self.seen[key]
+	if ok {
+		return
+	}
+
+	children, err := pool.ParseOID(props.Props["children"])
+	if err != nil {
+		return
+	}
+	entries, err := store.ReadDir(self.pool, children)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name
+		if dir != "" {
+			name = dir + "/" + name
+		}
+		if self.match(name) {
+			matches = append(matches, found{path: name, oid: entry.OID})
+		}
+
+		var child *store.PropertyMap
+		child, err = store.ReadNode(self.pool, entry.OID)
+		if err != nil {
+			return
+		}
+		if child.Kind == "DIR" {
+			var more []found
+			more, err = self.find(name, child)
+			if err != nil {
+				return
+			}
+			matches = append(matches, more...)
+		}
+	}
+
+	self.seen[key] = matches
+	return
+}
+
+// Print a line for each version whose contents differ from the one
+// before it, starting with the first backup the path appears in.
+// Returns false if the path was never present.
+func showChanges(versions []version, indent string) (present bool) {
+	last := ""
+	for _, ver := range versions {
+		if ver.props == nil && !present {
+			continue
+		}
+
+		key := contentKey(ver.props)
+		if present && key == last {
+			continue
+		}
+		present = true
+		last = key
+
+		fmt.Printf("%s%s %s\n", indent, ver.back.Date.Format("2006-01-02_15:04"), describe(ver.props))
+	}
+	return
+}
+
+// Identify the contents of a node.
+func contentKey(props *store.PropertyMap) string {
+	if props == nil {
+		return ""
+	}
+	return props.Kind + " " + props.Props["data"] + props.Props["target"] + props.Props["children"]
+}
+
+// Describe a version of a path: its size, modification time, and
+// contents.
+func describe(props *store.PropertyMap) string {
+	if props == nil {
+		return "(not present)"
+	}
+
+	text := fmt.Sprintf("%-4s %10s", props.Kind, props.Props["size"])
+	if mtime, err := store.DecodeTimestamp(props.Props["mtime"]); err == nil {
+		text += " " + mtime.Local().Format("2006-01-02 15:04:05")
+	}
+
+	switch props.Kind {
+	case "REG":
+		text += " " + props.Props["data"]
+	case "LNK":
+		text += " -> " + props.Props["target"]
+	case "DIR":
+		text += " " + props.Props["children"]
+	}
+	return text
+}
@@ -0,0 +1,33 @@
+// Serve a pool over HTTP.
+
+package httpserve
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"pool"
+	"syscall"
+)
+
+// Serve 'pl' on the 'listen' address until interrupted.  Chunks
+// clients haven't flushed are discarded.
+func Run(pl pool.Pool, listen string) (err error) {
+	srv := &http.Server{Addr: listen, Handler: pool.NewHttpHandler(pl)}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		srv.Shutdown(context.Background())
+	}()
+
+	log.Printf("Serving pool on %s, interrupt to stop", listen)
+	err = srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,461 @@
+// Importing tar archives as backups.
+
+package importtar
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"godump/dump"
+	"linuxdir"
+	"meter"
+	"pool"
+	"store"
+)
+
+// A file or directory read from the archive.  The tree is built in
+// memory, since archives needn't list directories before their
+// contents, and then written out the way a dump writes it.
+type tarNode struct {
+	props *store.PropertyMap
+	inode *inode
+
+	// Directories that only appear as part of other paths get
+	// their times once the whole archive has been read.
+	implied  bool
+	children map[string]*tarNode
+}
+
+// Hard links share an inode.
+type inode struct {
+	ino   uint64
+	nlink int
+}
+
+type importState struct {
+	pool    pool.Pool
+	chunker string
+
+	root    *tarNode
+	nodes   map[string]*tarNode
+	nextIno uint64
+
+	// The newest modification time in the archive.
+	newest time.Time
+
+	// For the progress meter.
+	lastPath  string
+	fileCount int64
+	dirCount  int64
+}
+
+// Layouts accepted for the "date" property, in local time.
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02_15:04:05",
+	"2006-01-02_15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Import the tar archive 'name' (or stdin, for "-"), which may be
+// gzip compressed, as a backup with the given properties.  The date
+// of the backup is the "date" property, if given, or else the newest
+// modification time in the archive.
+func Run(pl pool.Pool, name string, props map[string]string) (err error) {
+	var date time.Time
+	if text, ok := props["date"]; ok {
+		date, err = parseDate(text)
+		if err != nil {
+			return
+		}
+		delete(props, "date")
+	}
+
+	self := &importState{
+		pool:    pl,
+		chunker: store.DefaultChunker,
+		nodes:   make(map[string]*tarNode),
+	}
+	if chunker, ok := props["chunker"]; ok {
+		self.chunker = chunker
+	}
+	err = store.CheckChunker(self.chunker)
+	if err != nil {
+		return
+	}
+	self.root = self.newDir()
+	self.nodes[""] = self.root
+
+	var input io.Reader = os.Stdin
+	if name != "-" {
+		var file *os.File
+		file, err = os.Open(name)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		input = file
+	}
+	input, err = decompress(input)
+	if err != nil {
+		return
+	}
+
+	log.Printf("Importing %q", name)
+	err = self.readArchive(tar.NewReader(input))
+	if err != nil {
+		return
+	}
+	meter.Sync(self, true)
+
+	if date.IsZero() {
+		date = self.newest
+	}
+	self.fillImplied(self.root)
+
+	headId, err := self.writeTree(self.root)
+	if err != nil {
+		return
+	}
+
+	back := store.NewPropertyMap("back")
+	for k, v := range props {
+		back.Props[k] = v
+	}
+	back.Props["hash"] = headId.String()
+	back.Props["_date"] = strconv.FormatInt(date.UnixNano()/1000000, 10)
+	back.Props["chunker"] = self.chunker
+
+	id, err := writeNode(pl, "back", back)
+	if err != nil {
+		return
+	}
+
+	err = pl.Flush()
+	if err != nil {
+		return
+	}
+
+	log.Printf("Import complete: %s", id.String())
+	return
+}
+
+func parseDate(text string) (date time.Time, err error) {
+	for _, layout := range dateLayouts {
+		date, err = time.ParseInLocation(layout, text, time.Local)
+		if err == nil {
+			return
+		}
+	}
+	err = fmt.Errorf("Invalid date %q, expecting a form like %q", text, "2006-01-02 15:04:05")
+	return
+}
+
+// Undo gzip compression, if the input has any.
+func decompress(input io.Reader) (result io.Reader, err error) {
+	buf := bufio.NewReaderSize(input, 64*1024)
+	magic, err := buf.Peek(2)
+	if err != nil && err != io.EOF {
+		return
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buf)
+	}
+	return buf, nil
+}
+
+func (self *importState) readArchive(rd *tar.Reader) (err error) {
+	for {
+		var hdr *tar.Header
+		hdr, err = rd.Next()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		name := cleanName(hdr.Name)
+		self.lastPath = name
+		meter.Sync(self, false)
+
+		if hdr.Typeflag == tar.TypeLink {
+			self.hardLink(name, cleanName(hdr.Linkname))
+			continue
+		}
+
+		var props *store.PropertyMap
+		props, err = self.headerProps(hdr)
+		if err != nil {
+			return
+		}
+		if props == nil {
+			log.Printf("WARN: skipping unsupported entry type %q: %s", hdr.Typeflag, hdr.Name)
+			continue
+		}
+
+		if props.Kind == "REG" {
+			var data *pool.OID
+			data, err = store.WriteData(self.pool, rd, hdr.Name, self.chunker, dump.Workers)
+			if err != nil {
+				return
+			}
+			props.Props["data"] = data.String()
+		}
+
+		self.add(name, props, &inode{ino: self.newIno(), nlink: 1})
+	}
+}
+
+// Archive names are relative, but may start with "./" or "/", and
+// directories end with "/".  The top directory is "".
+func cleanName(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+var tarKinds = map[byte]string{
+	tar.TypeReg:     "REG",
+	tar.TypeRegA:    "REG",
+	tar.TypeDir:     "DIR",
+	tar.TypeSymlink: "LNK",
+	tar.TypeChar:    "CHR",
+	tar.TypeBlock:   "BLK",
+	tar.TypeFifo:    "FIFO",
+}
+
+// Build the node properties for an archive entry, as encodeProps
+// does for a file in a dump.  Returns nil for entries that can't be
+// represented.
+func (self *importState) headerProps(hdr *tar.Header) (props *store.PropertyMap, err error) {
+	kind, ok := tarKinds[hdr.Typeflag]
+	if !ok {
+		return
+	}
+
+	props = store.NewPropertyMap(kind)
+	props.Props["mode"] = strconv.FormatInt(hdr.Mode&07777, 10)
+	props.Props["dev"] = "0"
+	props.Props["uid"] = strconv.Itoa(hdr.Uid)
+	props.Props["gid"] = strconv.Itoa(hdr.Gid)
+	props.Props["mtime"] = encodeTime(hdr.ModTime)
+	ctime := hdr.ChangeTime
+	if ctime.IsZero() {
+		ctime = hdr.ModTime
+	}
+	props.Props["ctime"] = encodeTime(ctime)
+
+	if hdr.ModTime.After(self.newest) {
+		self.newest = hdr.ModTime
+	}
+
+	var size int64
+	switch kind {
+	case "REG":
+		size = hdr.Size
+	case "LNK":
+		props.Props["target"] = hdr.Linkname
+		size = int64(len(hdr.Linkname))
+	case "CHR", "BLK":
+		rdev := linuxdir.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		props.Props["rdev"] = strconv.FormatUint(rdev, 10)
+	}
+	props.Props["size"] = strconv.FormatInt(size, 10)
+
+	attrs := make(map[string][]byte)
+	for key, value := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "SCHILY.xattr.") {
+			attrs[strings.TrimPrefix(key, "SCHILY.xattr.")] = []byte(value)
+		}
+	}
+	if len(attrs) > 0 {
+		err = props.SetXattrs(self.pool, attrs)
+	}
+	return
+}
+
+func encodeTime(when time.Time) string {
+	return fmt.Sprintf("%d.%09d", when.Unix(), when.Nanosecond())
+}
+
+func (self *importState) newIno() uint64 {
+	self.nextIno++
+	return self.nextIno
+}
+
+func (self *importState) newDir() *tarNode {
+	props := store.NewPropertyMap("DIR")
+	props.Props["mode"] = "493"
+	props.Props["dev"] = "0"
+	props.Props["uid"] = "0"
+	props.Props["gid"] = "0"
+	props.Props["size"] = "0"
+	return &tarNode{
+		props:    props,
+		inode:    &inode{ino: self.newIno(), nlink: 1},
+		implied:  true,
+		children: make(map[string]*tarNode),
+	}
+}
+
+// Place a node in the tree, creating any directories above it that
+// the archive hasn't listed.  A later entry for the same path
+// replaces an earlier one, as it would when extracting.
+func (self *importState) add(name string, props *store.PropertyMap, ino *inode) {
+	if name == "" {
+		if props.Kind == "DIR" {
+			self.root.props = props
+			self.root.implied = false
+		}
+		return
+	}
+
+	parent := self.dir(path.Dir(name))
+	base := path.Base(name)
+
+	node, ok := parent.children[base]
+	if ok && node.props.Kind == "DIR" && props.Kind == "DIR" {
+		// Keep the contents already read.
+		node.props = props
+		node.implied = false
+		return
+	}
+
+	node = &tarNode{props: props, inode: ino}
+	if props.Kind == "DIR" {
+		node.children = make(map[string]*tarNode)
+		self.dirCount++
+	} else {
+		self.fileCount++
+	}
+	parent.children[base] = node
+	self.nodes[name] = node
+}
+
+// Find the named directory, creating it if needed.
+func (self *importState) dir(name string) *tarNode {
+	if name == "." {
+		name = ""
+	}
+	node, ok := self.nodes[name]
+	if ok && node.props.Kind == "DIR" {
+		return node
+	}
+
+	parent := self.dir(path.Dir(name))
+	node = self.newDir()
+	parent.children[path.Base(name)] = node
+	self.nodes[name] = node
+	self.dirCount++
+	return node
+}
+
+// Add another name for an earlier entry.
+func (self *importState) hardLink(name, target string) {
+	first, ok := self.nodes[target]
+	if !ok || first.props.Kind == "DIR" {
+		log.Printf("WARN: skipping hard link to unknown file %q: %s", target, name)
+		return
+	}
+
+	props := store.NewPropertyMap(first.props.Kind)
+	for key, value := range first.props.Props {
+		props.Props[key] = value
+	}
+	first.inode.nlink++
+	self.add(name, props, first.inode)
+}
+
+// Give the implied directories the newest time in the archive.
+func (self *importState) fillImplied(node *tarNode) {
+	if node.implied {
+		node.props.Props["mtime"] = encodeTime(self.newest)
+		node.props.Props["ctime"] = encodeTime(self.newest)
+	}
+	for _, child := range node.children {
+		if child.props.Kind == "DIR" {
+			self.fillImplied(child)
+		}
+	}
+}
+
+// Write the node, and everything below it, returning the node's OID.
+func (self *importState) writeTree(node *tarNode) (oid *pool.OID, err error) {
+	props := node.props
+	props.Props["ino"] = strconv.FormatUint(node.inode.ino, 10)
+	props.Props["nlink"] = strconv.Itoa(node.inode.nlink)
+
+	if props.Kind == "DIR" {
+		names := make([]string, 0, len(node.children))
+		subdirs := 0
+		for name, child := range node.children {
+			names = append(names, name)
+			if child.props.Kind == "DIR" {
+				subdirs++
+			}
+		}
+		sort.Strings(names)
+
+		writer := store.NewDirWriter(self.pool, 256*1024)
+		for _, name := range names {
+			var child *pool.OID
+			child, err = self.writeTree(node.children[name])
+			if err != nil {
+				return
+			}
+			err = writer.Add(name, child)
+			if err != nil {
+				return
+			}
+		}
+
+		var children *pool.OID
+		children, err = writer.Finalize()
+		if err != nil {
+			return
+		}
+		props.Props["children"] = children.String()
+		props.Props["nlink"] = strconv.Itoa(2 + subdirs)
+	}
+
+	return writeNode(self.pool, "node", props)
+}
+
+func writeNode(pl pool.Pool, kind string, node *store.PropertyMap) (oid *pool.OID, err error) {
+	ch := pool.NewPoolChunk(pl, kind, node.Encode())
+	err = pl.Insert(ch)
+	if err != nil {
+		return
+	}
+
+	oid = ch.OID()
+	return
+}
+
+// Generate the progress meter.
+func (self *importState) GetMeter() (result []string) {
+	result = make([]string, 4)
+
+	result[0] = "----------------------------------------------------------------------"
+	result[1] = fmt.Sprintf("   %9d files, %9d dirs", self.fileCount, self.dirCount)
+
+	path := self.lastPath
+	if len(path) > 73 {
+		path = "..." + path[len(path)-60:]
+	}
+	result[2] = fmt.Sprintf(" : %q", path)
+	result[3] = "----------------------------------------------------------------------"
+	return
+}
@@ -3,6 +3,7 @@
 package listing
 
 import (
+	"bytes"
 	"fmt"
 	"sort"
 	"time"
@@ -11,24 +12,25 @@ import (
 	"store"
 )
 
-type backNode struct {
-	oid   *pool.OID
-	date  time.Time
-	props map[string]string
+// The record describing a single backup.
+type BackNode struct {
+	OID   *pool.OID
+	Date  time.Time
+	Props map[string]string
 }
 
 type lister struct {
-	nodes []*backNode
+	nodes []*BackNode
 
 	store.PathTrackerImpl
 	store.EmptyVisitor
 }
 
 func (this *lister) Back(root *pool.OID, date time.Time, props map[string]string) (err error) {
-	bn := &backNode{
-		oid:   root,
-		date:  date,
-		props: props}
+	bn := &BackNode{
+		OID:   root,
+		Date:  date,
+		Props: props}
 	this.nodes = append(this.nodes, bn)
 	return store.Prune
 }
@@ -39,23 +41,44 @@ func (this *lister) sort() {
 
 func (this *lister) show() {
 	for _, bn := range this.nodes {
-		fmt.Printf("%s %s", bn.oid.String(),
-			bn.date.Format("2006-01-02_15:04"))
-		keys := make([]string, 0, len(bn.props))
-		for k := range bn.props {
-			if k == "hash" {
-				continue
-			}
-			keys = append(keys, k)
-		}
-		for _, k := range keys {
-			fmt.Printf(" %s=%s", k, bn.props[k])
+		fmt.Printf("%s\n", bn.String())
+	}
+}
+
+// Describe the backup on a single line.
+func (this *BackNode) String() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%s %s", this.OID.String(),
+		this.Date.Format("2006-01-02_15:04"))
+	keys := make([]string, 0, len(this.Props))
+	for k := range this.Props {
+		if k == "hash" {
+			continue
 		}
-		fmt.Printf("\n")
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		fmt.Fprintf(&buf, " %s=%s", k, this.Props[k])
 	}
+	return buf.String()
 }
 
 func Run(pl pool.Pool) (err error) {
+	nodes, err := Collect(pl)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("Listing: %d\n", len(nodes))
+	self := lister{nodes: nodes}
+	self.show()
+	return
+}
+
+// Read the records of all of the backups in the pool, sorted by
+// date.
+func Collect(pl pool.Pool) (nodes []*BackNode, err error) {
 	backups, err := pl.Backups()
 	if err != nil {
 		return
@@ -64,7 +87,6 @@ func Run(pl pool.Pool) (err error) {
 	var self lister
 	self.InitPath()
 
-	fmt.Printf("Listing: %d\n", len(backups))
 	for _, oid := range backups {
 		err = store.Walk(pl, oid, &self)
 		if err != nil {
@@ -72,12 +94,12 @@ func Run(pl pool.Pool) (err error) {
 		}
 	}
 	self.sort()
-	self.show()
+	nodes = self.nodes
 	return
 }
 
-type byDate []*backNode
+type byDate []*BackNode
 
 func (a byDate) Len() int           { return len(a) }
 func (a byDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a byDate) Less(i, j int) bool { return a[i].date.Before(a[j].date) }
+func (a byDate) Less(i, j int) bool { return a[i].Date.Before(a[j].Date) }
@@ -0,0 +1,160 @@
+// Listing the contents of a backup.
+
+package ls
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"linuxdir"
+	"pool"
+	"store"
+)
+
+type lister struct {
+	pool      pool.Pool
+	recursive bool
+}
+
+// List 'name' within the backup 'id' in the style of "ls -l".  A
+// directory lists its entries, and with 'recursive', everything below
+// it, named relative to 'name'.
+func Run(pl pool.Pool, id *pool.OID, name string, recursive bool) (err error) {
+	root, err := store.BackupRoot(pl, id)
+	if err != nil {
+		return
+	}
+	_, props, err := store.Lookup(pl, root, name)
+	if err != nil {
+		return
+	}
+
+	self := &lister{pool: pl, recursive: recursive}
+	if props.Kind != "DIR" {
+		return show(path.Base(name), props)
+	}
+	return self.listDir("", props)
+}
+
+// List the entries of a directory, whose entries are named below
+// 'prefix'.
+func (self *lister) listDir(prefix string, props *store.PropertyMap) (err error) {
+	children, err := pool.ParseOID(props.Props["children"])
+	if err != nil {
+		return
+	}
+	entries, err := store.ReadDir(self.pool, children)
+	if err != nil {
+		return
+	}
+	sort.Sort(byName(entries))
+
+	for _, entry := range entries {
+		var child *store.PropertyMap
+		child, err = store.ReadNode(self.pool, entry.OID)
+		if err != nil {
+			return
+		}
+
+		name := path.Join(prefix, entry.Name)
+		err = show(name, child)
+		if err != nil {
+			return
+		}
+
+		if self.recursive && child.Kind == "DIR" {
+			err = self.listDir(name, child)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Print a single line describing the node.
+func show(name string, props *store.PropertyMap) (err error) {
+	mode, err := props.GetInt("mode")
+	if err != nil {
+		return
+	}
+	mtime, err := store.DecodeTimestamp(props.Props["mtime"])
+	if err != nil {
+		return
+	}
+
+	var nums [5]uint64
+	for i, key := range []string{"nlink", "uid", "gid", "size", "rdev"} {
+		if _, ok := props.Props[key]; !ok {
+			continue
+		}
+		nums[i], err = props.GetUint64(key)
+		if err != nil {
+			return
+		}
+	}
+	nlink, uid, gid, size, rdev := nums[0], nums[1], nums[2], nums[3], nums[4]
+
+	// Devices show their numbers in place of the size.
+	sizeText := fmt.Sprintf("%d", size)
+	if props.Kind == "CHR" || props.Kind == "BLK" {
+		sizeText = fmt.Sprintf("%d, %d", linuxdir.Major(rdev), linuxdir.Minor(rdev))
+	}
+
+	line := fmt.Sprintf("%s %3d %5d %5d %10s %s %s", modeString(props.Kind, mode),
+		nlink, uid, gid, sizeText, mtime.Local().Format(timeFormat), name)
+	if props.Kind == "LNK" {
+		line += " -> " + props.Props["target"]
+	}
+	fmt.Println(line)
+	return
+}
+
+const timeFormat = "2006-01-02 15:04"
+
+var kindChars = map[string]byte{
+	"REG":  '-',
+	"DIR":  'd',
+	"LNK":  'l',
+	"CHR":  'c',
+	"BLK":  'b',
+	"FIFO": 'p',
+	"SOCK": 's',
+}
+
+// Format the kind and permission bits the way "ls -l" does.
+func modeString(kind string, mode int) string {
+	buf := []byte("?rwxrwxrwx")
+	if ch, ok := kindChars[kind]; ok {
+		buf[0] = ch
+	}
+	for i := 0; i < 9; i++ {
+		if mode&(1<<uint(8-i)) == 0 {
+			buf[i+1] = '-'
+		}
+	}
+
+	// The setuid, setgid and sticky bits share the execute
+	// column, in upper case when execute isn't set.
+	for _, special := range []struct {
+		bit, pos int
+		ch       byte
+	}{{04000, 3, 's'}, {02000, 6, 's'}, {01000, 9, 't'}} {
+		if mode&special.bit == 0 {
+			continue
+		}
+		if buf[special.pos] == '-' {
+			buf[special.pos] = special.ch - 'a' + 'A'
+		} else {
+			buf[special.pos] = special.ch
+		}
+	}
+	return string(buf)
+}
+
+type byName []store.DirEntry
+
+func (p byName) Len() int           { return len(p) }
+func (p byName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p byName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
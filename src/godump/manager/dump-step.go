@@ -13,6 +13,10 @@ func (m *DumpStep) Setup() (err error) {
 	props := make(map[string]string)
 
 	props["fs"] = m.fs.Volume
+	props["host"] = m.name
+	if m.fs.Chunker != nil {
+		props["chunker"] = *m.fs.Chunker
+	}
 	return dump.Run(m.pool, m.backupDir(), props)
 }
 
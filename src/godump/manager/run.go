@@ -44,10 +44,10 @@ func validateConfig(conf *config.Config, host string) (err error) {
 		return
 	}
 
-	mgr := Manager{conf: conf, host: hinfo}
+	mgr := Manager{conf: conf, name: host, host: hinfo}
 	// err = mgr.CheckPlainPaths()
 
-	mgr.pool, err = pool.OpenPool(conf.Defaults.Pool)
+	mgr.pool, err = pool.OpenPoolMode(conf.Defaults.Pool, pool.LockWriter)
 	if err != nil {
 		return
 	}
@@ -161,6 +161,7 @@ type StepData struct {
 
 type Manager struct {
 	conf *config.Config
+	name string
 	host *config.Host
 	pool pool.Pool
 
@@ -0,0 +1,109 @@
+// Moving a pool to another backend.
+
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"meter"
+	"pool"
+)
+
+type migrateState struct {
+	mig *pool.Migrator
+}
+
+// Create a pool at 'dstPath', in the given format, "sql" or "files",
+// holding everything in the pool at 'srcPath'.  An empty format
+// chooses the one 'src' doesn't use.  The new pool keeps the UUID,
+// codec, and for an encrypted pool, the key and passphrase of the old
+// one.
+func Run(srcPath, dstPath, format string, opts pool.CreateOptions) (err error) {
+	src, err := pool.OpenPool(srcPath)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	if format == "" {
+		format = "files"
+		if _, ok := src.(*pool.FilePool); ok {
+			format = "sql"
+		}
+	}
+
+	// Check that the new pool can hold the chunks, with the same
+	// OIDs, before making it.
+	opts.KeyProps, err = pool.PoolKeyProps(src)
+	if err != nil {
+		return
+	}
+	if opts.KeyProps != nil && format != "sql" {
+		err = errors.New("Encrypted pools can only be migrated to SQL pools")
+		return
+	}
+	if pass := pool.Passphrase; opts.KeyProps != nil && pass != nil {
+		pool.Passphrase = func(path string) ([]byte, error) {
+			if path == dstPath {
+				path = srcPath
+			}
+			return pass(path)
+		}
+		defer func() { pool.Passphrase = pass }()
+	}
+
+	opts.UUID, err = pool.PoolUUID(src)
+	if err != nil {
+		return
+	}
+	opts.Codec = pool.PoolCodec(src)
+	switch format {
+	case "sql":
+		err = pool.CreateSqlPool(dstPath, &opts)
+	case "files":
+		err = pool.CreateFilePool(dstPath, &opts)
+	default:
+		err = fmt.Errorf("Unknown pool format %q", format)
+	}
+	if err != nil {
+		return
+	}
+
+	dst, err := pool.OpenPool(dstPath)
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+
+	var self migrateState
+	self.mig, err = pool.NewMigrator(src, dst)
+	if err != nil {
+		return
+	}
+	self.mig.Progress = func() {
+		meter.Sync(&self, false)
+	}
+	err = self.mig.Run()
+	meter.Sync(&self, true)
+	if err != nil {
+		return
+	}
+
+	log.Printf("Migrated %d chunks and %d cache entries to %s pool %q",
+		self.mig.Chunks, self.mig.CacheRows, format, dstPath)
+	return
+}
+
+// Generate the progress meter.
+func (self *migrateState) GetMeter() (result []string) {
+	result = make([]string, 4)
+
+	result[0] = "----------------------------------------------------------------------"
+	result[1] = fmt.Sprintf("   %11d chunks copied, %11d verified",
+		self.mig.Chunks, self.mig.Verified)
+	result[2] = fmt.Sprintf("   %s data", meter.Humanize(self.mig.Bytes))
+	result[3] = "----------------------------------------------------------------------"
+	return
+}
@@ -0,0 +1,412 @@
+package mount
+
+// Just enough of the FUSE kernel protocol to serve a read-only
+// filesystem.  Requests are read from /dev/fuse one at a time, and
+// answered in order.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseReadlink    = 5
+	fuseOpen        = 14
+	fuseRead        = 15
+	fuseStatfs      = 17
+	fuseRelease     = 18
+	fuseGetxattr    = 22
+	fuseListxattr   = 23
+	fuseFlush       = 25
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseInterrupt   = 36
+	fuseDestroy     = 38
+	fuseBatchForget = 42
+)
+
+const (
+	fuseMajor = 7
+	fuseMinor = 31
+
+	// The largest request the kernel will send.
+	fuseMaxWrite  = 128 * 1024
+	fuseBufferLen = fuseMaxWrite + 4096
+
+	// Tell the kernel to keep the page cache between opens.
+	fuseKeepCache = 2
+
+	// The inode number of a directory entry the kernel hasn't
+	// looked up.
+	fuseUnknownIno = 0xffffffff
+)
+
+type fuseInHeader struct {
+	Len     uint32
+	Opcode  uint32
+	Unique  uint64
+	Nodeid  uint64
+	Uid     uint32
+	Gid     uint32
+	Pid     uint32
+	Padding uint32
+}
+
+type fuseOutHeader struct {
+	Len    uint32
+	Error  int32
+	Unique uint64
+}
+
+type fuseInitIn struct {
+	Major        uint32
+	Minor        uint32
+	MaxReadahead uint32
+	Flags        uint32
+}
+
+type fuseInitOut struct {
+	Major               uint32
+	Minor               uint32
+	MaxReadahead        uint32
+	Flags               uint32
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+	TimeGran            uint32
+	MaxPages            uint16
+	MapAlignment        uint16
+	Flags2              uint32
+	Unused              [7]uint32
+}
+
+type fuseAttr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Nlink     uint32
+	Uid       uint32
+	Gid       uint32
+	Rdev      uint32
+	Blksize   uint32
+	Flags     uint32
+}
+
+type fuseEntryOut struct {
+	Nodeid         uint64
+	Generation     uint64
+	EntryValid     uint64
+	AttrValid      uint64
+	EntryValidNsec uint32
+	AttrValidNsec  uint32
+	Attr           fuseAttr
+}
+
+type fuseAttrOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Dummy         uint32
+	Attr          fuseAttr
+}
+
+type fuseOpenOut struct {
+	Fh        uint64
+	OpenFlags uint32
+	Padding   uint32
+}
+
+type fuseReadIn struct {
+	Fh        uint64
+	Offset    uint64
+	Size      uint32
+	ReadFlags uint32
+	LockOwner uint64
+	Flags     uint32
+	Padding   uint32
+}
+
+type fuseForgetIn struct {
+	Nlookup uint64
+}
+
+type fuseBatchForgetIn struct {
+	Count uint32
+	Dummy uint32
+}
+
+type fuseForgetOne struct {
+	Nodeid  uint64
+	Nlookup uint64
+}
+
+type fuseReleaseIn struct {
+	Fh           uint64
+	Flags        uint32
+	ReleaseFlags uint32
+	LockOwner    uint64
+}
+
+type fuseXattrIn struct {
+	Size    uint32
+	Padding uint32
+}
+
+type fuseXattrOut struct {
+	Size    uint32
+	Padding uint32
+}
+
+type fuseStatfsOut struct {
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Bsize   uint32
+	Namelen uint32
+	Frsize  uint32
+	Padding uint32
+	Spare   [6]uint32
+}
+
+type fuseDirent struct {
+	Ino     uint64
+	Off     uint64
+	Namelen uint32
+	Type    uint32
+}
+
+// A request read from the kernel.
+type fuseRequest struct {
+	header fuseInHeader
+	body   []byte
+}
+
+// Decode the fixed part of the request body into 'item'.
+func (self *fuseRequest) decode(item interface{}) (err error) {
+	return binary.Read(bytes.NewReader(self.body), binary.LittleEndian, item)
+}
+
+// The name that follows the fixed part of the body, for requests
+// that have one.
+func (self *fuseRequest) name(skip int) string {
+	rest := self.body[skip:]
+	end := bytes.IndexByte(rest, 0)
+	if end >= 0 {
+		rest = rest[:end]
+	}
+	return string(rest)
+}
+
+// The nodes of a batch forget request.
+func (self *fuseRequest) forgets() (forgets []fuseForgetOne, err error) {
+	rd := bytes.NewReader(self.body)
+	var in fuseBatchForgetIn
+	err = binary.Read(rd, binary.LittleEndian, &in)
+	if err != nil {
+		return
+	}
+	if int(in.Count) > rd.Len()/int(unsafe.Sizeof(fuseForgetOne{})) {
+		err = fmt.Errorf("Short FUSE batch forget: %d nodes", in.Count)
+		return
+	}
+	forgets = make([]fuseForgetOne, in.Count)
+	err = binary.Read(rd, binary.LittleEndian, forgets)
+	return
+}
+
+// An open connection to the kernel.
+type fuseConn struct {
+	dev *os.File
+	buf []byte
+}
+
+// Mount a FUSE filesystem at 'dir'.  Root can mount directly,
+// otherwise fusermount is used.
+func fuseMount(dir string) (conn *fuseConn, err error) {
+	dev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+
+	opts := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d,default_permissions",
+		dev.Fd(), os.Getuid(), os.Getgid())
+	if os.Getuid() == 0 {
+		opts += ",allow_other"
+	}
+	err = syscall.Mount("godump", dir, "fuse.godump",
+		syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, opts)
+	if err == syscall.EPERM {
+		dev.Close()
+		dev, err = fusermount(dir)
+	}
+	if err != nil {
+		if dev != nil {
+			dev.Close()
+		}
+		return
+	}
+
+	conn = &fuseConn{dev: dev, buf: make([]byte, fuseBufferLen)}
+	return
+}
+
+// Mount through the setuid fusermount helper, which passes the
+// opened /dev/fuse back over a socket.
+func fusermount(dir string) (dev *os.File, err error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return
+	}
+	local := os.NewFile(uintptr(fds[0]), "fusermount-local")
+	remote := os.NewFile(uintptr(fds[1]), "fusermount-remote")
+	defer local.Close()
+	defer remote.Close()
+
+	cmd := exec.Command("fusermount", "-o", "ro,nosuid,nodev,default_permissions,fsname=godump,subtype=godump", "--", dir)
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	remote.Close()
+
+	buf := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(local.Fd()), buf, oob, 0)
+	waitErr := cmd.Wait()
+	if err != nil {
+		return
+	}
+	if waitErr != nil {
+		err = waitErr
+		return
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return
+	}
+	if len(msgs) != 1 {
+		err = fmt.Errorf("fusermount didn't return a device")
+		return
+	}
+	rights, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return
+	}
+	dev = os.NewFile(uintptr(rights[0]), "/dev/fuse")
+	return
+}
+
+// Unmount the filesystem, which ends the serving loop.
+func fuseUnmount(dir string) (err error) {
+	err = syscall.Unmount(dir, 0)
+	if err == syscall.EPERM {
+		err = exec.Command("fusermount", "-u", dir).Run()
+	}
+	return
+}
+
+// Read the next request.  Sets 'done' once the filesystem has been
+// unmounted.
+func (self *fuseConn) read() (req *fuseRequest, done bool, err error) {
+	for {
+		var n int
+		n, err = syscall.Read(int(self.dev.Fd()), self.buf)
+		if err == syscall.EINTR || err == syscall.ENOENT || err == syscall.EAGAIN {
+			continue
+		}
+		if err == syscall.ENODEV {
+			err = nil
+			done = true
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		hlen := int(unsafe.Sizeof(fuseInHeader{}))
+		if n < hlen {
+			err = fmt.Errorf("Short FUSE request: %d bytes", n)
+			return
+		}
+
+		req = &fuseRequest{}
+		err = binary.Read(bytes.NewReader(self.buf[:hlen]), binary.LittleEndian, &req.header)
+		if err != nil {
+			return
+		}
+		req.body = append([]byte(nil), self.buf[hlen:n]...)
+		return
+	}
+}
+
+// Send a reply.  'items' are encoded in order after the header, and
+// may be structs or byte slices.
+func (self *fuseConn) reply(req *fuseRequest, errno syscall.Errno, items ...interface{}) (err error) {
+	var body bytes.Buffer
+	if errno == 0 {
+		for _, item := range items {
+			err = binary.Write(&body, binary.LittleEndian, item)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	header := fuseOutHeader{
+		Len:    uint32(unsafe.Sizeof(fuseOutHeader{})) + uint32(body.Len()),
+		Error:  -int32(errno),
+		Unique: req.header.Unique,
+	}
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, &header)
+	out.Write(body.Bytes())
+
+	_, err = syscall.Write(int(self.dev.Fd()), out.Bytes())
+	if err == syscall.ENOENT {
+		// The request was interrupted.
+		err = nil
+	}
+	return
+}
+
+func (self *fuseConn) Close() error {
+	return self.dev.Close()
+}
+
+// Append a directory entry in the format of the readdir reply,
+// returning false if it doesn't fit in 'size'.
+func appendDirent(buf *bytes.Buffer, size int, ino uint64, off uint64, name string, mode uint32) bool {
+	entLen := int(unsafe.Sizeof(fuseDirent{})) + len(name)
+	padded := (entLen + 7) &^ 7
+	if buf.Len()+padded > size {
+		return false
+	}
+
+	ent := fuseDirent{Ino: ino, Off: off, Namelen: uint32(len(name)), Type: (mode & syscall.S_IFMT) >> 12}
+	binary.Write(buf, binary.LittleEndian, &ent)
+	buf.WriteString(name)
+	buf.Write(make([]byte, padded-entLen))
+	return true
+}
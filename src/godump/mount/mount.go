@@ -0,0 +1,592 @@
+// Mounting backups as a read-only filesystem.
+
+package mount
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"godump/listing"
+	"pool"
+	"store"
+)
+
+// Backups never change, so the kernel can cache everything for a
+// long time.
+const cacheTime = 3600
+
+// A node in the mounted tree.  Other than directories, nodes from the
+// backups are shared between every place the same node chunk appears.
+// The kernel doesn't allow a directory to have more than one parent,
+// so each place a directory appears gets a node of its own.
+type node struct {
+	ino   uint64
+	props *store.PropertyMap
+
+	// For directories, the entries, once they have been read.
+	entries []store.DirEntry
+	loaded  bool
+
+	// The lookups the kernel hasn't forgotten.  Once it forgets
+	// them all, the node is freed, and the key it is found by,
+	// 'oid' or 'place', is removed.
+	lookups uint64
+	oid     pool.OID
+	place   entryKey
+}
+
+type mountState struct {
+	pool pool.Pool
+	conn *fuseConn
+
+	// The top directory, holding one entry for each backup.
+	root *node
+
+	nodes   map[uint64]*node
+	byOID   map[pool.OID]*node
+	byEntry map[entryKey]*node
+	nextIno uint64
+
+	files  map[uint64]*store.FileReader
+	nextFh uint64
+}
+
+func Run(pl pool.Pool, dir string) (err error) {
+	self := &mountState{
+		pool:    pl,
+		nodes:   make(map[uint64]*node),
+		byOID:   make(map[pool.OID]*node),
+		byEntry: make(map[entryKey]*node),
+		nextIno: 2,
+		files:   make(map[uint64]*store.FileReader),
+		nextFh:  1,
+	}
+
+	err = self.makeRoot()
+	if err != nil {
+		return
+	}
+
+	self.conn, err = fuseMount(dir)
+	if err != nil {
+		return
+	}
+	defer self.conn.Close()
+
+	// Unmounting causes the serve loop to finish.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		err := fuseUnmount(dir)
+		if err != nil {
+			log.Printf("Unable to unmount %q: %s", dir, err)
+		}
+	}()
+
+	log.Printf("Mounted %d backups on %q, interrupt to unmount", len(self.root.entries), dir)
+	return self.serve()
+}
+
+// Build the top directory.  Each backup is named by its date, host
+// and filesystem.
+func (self *mountState) makeRoot() (err error) {
+	backs, err := listing.Collect(self.pool)
+	if err != nil {
+		return
+	}
+
+	props := store.NewPropertyMap("DIR")
+	props.Props["mode"] = "365"
+	props.Props["mtime"] = fmt.Sprintf("%d", time.Now().Unix())
+	self.root = &node{ino: 1, props: props, loaded: true}
+	self.nodes[1] = self.root
+
+	used := make(map[string]bool)
+	for _, back := range backs {
+		var oid *pool.OID
+		oid, err = pool.ParseOID(back.Props["hash"])
+		if err != nil {
+			return
+		}
+
+		name := back.Date.Format("2006-01-02_15:04:05")
+		for _, key := range []string{"host", "fs"} {
+			if value, ok := back.Props[key]; ok {
+				name += "-" + value
+			}
+		}
+		if used[name] {
+			name += "-" + back.OID.String()[:8]
+		}
+		used[name] = true
+
+		self.root.entries = append(self.root.entries, store.DirEntry{Name: name, OID: oid})
+	}
+	return
+}
+
+// Where a directory appears in the tree.
+type entryKey struct {
+	parent uint64
+	name   string
+}
+
+// The node the kernel already has for an entry of the directory
+// 'dir', or nil.  Directories are found by their place, and other
+// nodes by their OID.
+func (self *mountState) findNode(dir *node, entry *store.DirEntry) *node {
+	nd, ok := self.byEntry[entryKey{parent: dir.ino, name: entry.Name}]
+	if ok {
+		return nd
+	}
+	return self.byOID[*entry.OID]
+}
+
+// Find, or read in, the node for an entry of the directory 'dir'.
+func (self *mountState) getNode(dir *node, entry *store.DirEntry) (nd *node, err error) {
+	nd = self.findNode(dir, entry)
+	if nd != nil {
+		return
+	}
+
+	props, err := store.ReadNode(self.pool, entry.OID)
+	if err != nil {
+		return
+	}
+
+	nd = &node{ino: self.nextIno, props: props}
+	self.nextIno++
+	self.nodes[nd.ino] = nd
+	if props.Kind == "DIR" {
+		nd.place = entryKey{parent: dir.ino, name: entry.Name}
+		self.byEntry[nd.place] = nd
+	} else {
+		nd.oid = *entry.OID
+		self.byOID[nd.oid] = nd
+	}
+	return
+}
+
+// The kernel has forgotten 'count' lookups of the node 'ino'.
+func (self *mountState) forget(ino, count uint64) {
+	nd, ok := self.nodes[ino]
+	if !ok || nd == self.root {
+		return
+	}
+	if count > nd.lookups {
+		count = nd.lookups
+	}
+	nd.lookups -= count
+	if nd.lookups > 0 {
+		return
+	}
+
+	delete(self.nodes, ino)
+	if nd.props.Kind == "DIR" {
+		delete(self.byEntry, nd.place)
+	} else {
+		delete(self.byOID, nd.oid)
+	}
+}
+
+// Read the entries of a directory node, if that hasn't been done.
+func (self *mountState) loadDir(nd *node) (err error) {
+	if nd.loaded {
+		return
+	}
+
+	children, err := pool.ParseOID(nd.props.Props["children"])
+	if err != nil {
+		return
+	}
+	nd.entries, err = store.ReadDir(self.pool, children)
+	if err != nil {
+		return
+	}
+	nd.loaded = true
+	return
+}
+
+func (self *mountState) serve() (err error) {
+	for {
+		req, done, err := self.conn.read()
+		if err != nil || done {
+			return err
+		}
+
+		err = self.handle(req)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Answer a single request.  Errors that only concern the request are
+// returned to the kernel, only errors talking to the kernel stop the
+// mount.
+func (self *mountState) handle(req *fuseRequest) (err error) {
+	switch req.header.Opcode {
+	case fuseInit:
+		var in fuseInitIn
+		err = req.decode(&in)
+		if err != nil {
+			return
+		}
+		if in.Major != fuseMajor {
+			err = fmt.Errorf("Unsupported FUSE version %d.%d", in.Major, in.Minor)
+			return
+		}
+		out := fuseInitOut{
+			Major:        fuseMajor,
+			Minor:        fuseMinor,
+			MaxReadahead: in.MaxReadahead,
+			MaxWrite:     fuseMaxWrite,
+			TimeGran:     1,
+		}
+		if in.Minor < out.Minor {
+			out.Minor = in.Minor
+		}
+		return self.conn.reply(req, 0, &out)
+
+	// These have no reply.
+	case fuseForget:
+		var in fuseForgetIn
+		err = req.decode(&in)
+		if err == nil {
+			self.forget(req.header.Nodeid, in.Nlookup)
+		}
+		return
+	case fuseBatchForget:
+		var forgets []fuseForgetOne
+		forgets, err = req.forgets()
+		for _, one := range forgets {
+			self.forget(one.Nodeid, one.Nlookup)
+		}
+		return
+	case fuseInterrupt:
+		return
+
+	case fuseDestroy, fuseFlush, fuseReleasedir:
+		return self.conn.reply(req, 0)
+	}
+
+	nd, ok := self.nodes[req.header.Nodeid]
+	if !ok {
+		return self.conn.reply(req, syscall.ENOENT)
+	}
+
+	var items []interface{}
+	var tmpErr error
+	switch req.header.Opcode {
+	case fuseLookup:
+		items, tmpErr = self.lookup(nd, req.name(0))
+	case fuseGetattr:
+		var out fuseAttrOut
+		out.AttrValid = cacheTime
+		out.Attr, tmpErr = nodeAttr(nd)
+		items = []interface{}{&out}
+	case fuseReadlink:
+		target, ok := nd.props.Props["target"]
+		if !ok {
+			tmpErr = syscall.EINVAL
+		}
+		items = []interface{}{[]byte(target)}
+	case fuseOpendir:
+		if nd.props.Kind != "DIR" {
+			tmpErr = syscall.ENOTDIR
+		}
+		items = []interface{}{&fuseOpenOut{OpenFlags: fuseKeepCache}}
+	case fuseReaddir:
+		items, tmpErr = self.readdir(nd, req)
+	case fuseOpen:
+		items, tmpErr = self.open(nd)
+	case fuseRead:
+		items, tmpErr = self.read(req)
+	case fuseRelease:
+		var in fuseReleaseIn
+		tmpErr = req.decode(&in)
+		delete(self.files, in.Fh)
+	case fuseStatfs:
+		items = []interface{}{&fuseStatfsOut{Bsize: 4096, Namelen: 255, Frsize: 4096}}
+	case fuseGetxattr, fuseListxattr:
+		items, tmpErr = self.xattr(nd, req)
+	default:
+		tmpErr = syscall.ENOSYS
+	}
+
+	if tmpErr != nil {
+		errno, ok := tmpErr.(syscall.Errno)
+		if !ok {
+			log.Printf("Error reading backup: %s", tmpErr)
+			errno = syscall.EIO
+		}
+		return self.conn.reply(req, errno)
+	}
+	return self.conn.reply(req, 0, items...)
+}
+
+func (self *mountState) lookup(dir *node, name string) (items []interface{}, err error) {
+	if dir.props.Kind != "DIR" {
+		err = syscall.ENOTDIR
+		return
+	}
+	err = self.loadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for i := range dir.entries {
+		if dir.entries[i].Name != name {
+			continue
+		}
+
+		var nd *node
+		nd, err = self.getNode(dir, &dir.entries[i])
+		if err != nil {
+			return
+		}
+		out := fuseEntryOut{
+			Nodeid:     nd.ino,
+			EntryValid: cacheTime,
+			AttrValid:  cacheTime,
+		}
+		out.Attr, err = nodeAttr(nd)
+		if err != nil {
+			return
+		}
+		nd.lookups++
+		items = []interface{}{&out}
+		return
+	}
+
+	err = syscall.ENOENT
+	return
+}
+
+// Directory offsets are just indexes into the entries, after "." and
+// "..".  Reading a child node for its type is needed for each entry.
+// Entries the kernel hasn't looked up have no inode number yet, and
+// aren't kept, as the kernel would never forget them.
+func (self *mountState) readdir(dir *node, req *fuseRequest) (items []interface{}, err error) {
+	var in fuseReadIn
+	err = req.decode(&in)
+	if err != nil {
+		return
+	}
+	err = self.loadDir(dir)
+	if err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	for index := int(in.Offset); index < len(dir.entries)+2; index++ {
+		var name string
+		var ino uint64
+		var mode uint32
+		switch index {
+		case 0:
+			name, ino, mode = ".", dir.ino, syscall.S_IFDIR
+		case 1:
+			// The kernel fixes up the inode of "..".
+			name, ino, mode = "..", 1, syscall.S_IFDIR
+		default:
+			entry := &dir.entries[index-2]
+			name = entry.Name
+			if nd := self.findNode(dir, entry); nd != nil {
+				ino, mode = nd.ino, kindModes[nd.props.Kind]
+				break
+			}
+			var props *store.PropertyMap
+			props, err = store.ReadNode(self.pool, entry.OID)
+			if err != nil {
+				return
+			}
+			ino, mode = fuseUnknownIno, kindModes[props.Kind]
+		}
+
+		if !appendDirent(&buf, int(in.Size), ino, uint64(index+1), name, mode) {
+			break
+		}
+	}
+
+	items = []interface{}{buf.Bytes()}
+	return
+}
+
+func (self *mountState) open(nd *node) (items []interface{}, err error) {
+	if nd.props.Kind != "REG" {
+		err = syscall.EINVAL
+		return
+	}
+
+	data, err := pool.ParseOID(nd.props.Props["data"])
+	if err != nil {
+		return
+	}
+
+	size := int64(-1)
+	if _, ok := nd.props.Props["size"]; ok {
+		var value uint64
+		value, err = nd.props.GetUint64("size")
+		if err != nil {
+			return
+		}
+		size = int64(value)
+	}
+
+	file, err := store.NewFileReader(self.pool, data, size)
+	if err != nil {
+		return
+	}
+
+	fh := self.nextFh
+	self.nextFh++
+	self.files[fh] = file
+
+	items = []interface{}{&fuseOpenOut{Fh: fh, OpenFlags: fuseKeepCache}}
+	return
+}
+
+func (self *mountState) read(req *fuseRequest) (items []interface{}, err error) {
+	var in fuseReadIn
+	err = req.decode(&in)
+	if err != nil {
+		return
+	}
+
+	file, ok := self.files[in.Fh]
+	if !ok {
+		err = syscall.EBADF
+		return
+	}
+
+	buf := make([]byte, in.Size)
+	n, err := file.ReadAt(buf, int64(in.Offset))
+	if err == io.EOF {
+		err = nil
+	}
+	items = []interface{}{buf[:n]}
+	return
+}
+
+func (self *mountState) xattr(nd *node, req *fuseRequest) (items []interface{}, err error) {
+	var in fuseXattrIn
+	err = req.decode(&in)
+	if err != nil {
+		return
+	}
+
+	attrs, err := nd.props.Xattrs(self.pool)
+	if err != nil {
+		return
+	}
+
+	var value []byte
+	if req.header.Opcode == fuseListxattr {
+		names := make([]string, 0, len(attrs))
+		for name := range attrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value = append(value, name...)
+			value = append(value, 0)
+		}
+	} else {
+		var ok bool
+		value, ok = attrs[req.name(8)]
+		if !ok {
+			err = syscall.ENODATA
+			return
+		}
+	}
+
+	switch {
+	case in.Size == 0:
+		items = []interface{}{&fuseXattrOut{Size: uint32(len(value))}}
+	case int(in.Size) < len(value):
+		err = syscall.ERANGE
+	default:
+		items = []interface{}{value}
+	}
+	return
+}
+
+var kindModes = map[string]uint32{
+	"REG":  syscall.S_IFREG,
+	"DIR":  syscall.S_IFDIR,
+	"LNK":  syscall.S_IFLNK,
+	"CHR":  syscall.S_IFCHR,
+	"BLK":  syscall.S_IFBLK,
+	"FIFO": syscall.S_IFIFO,
+	"SOCK": syscall.S_IFSOCK,
+}
+
+// Build the attributes of a node from its properties.
+func nodeAttr(nd *node) (attr fuseAttr, err error) {
+	props := nd.props
+
+	mode, err := props.GetInt("mode")
+	if err != nil {
+		return
+	}
+	mtime, err := store.DecodeTimestamp(props.Props["mtime"])
+	if err != nil {
+		return
+	}
+	ctime := mtime
+	if text, ok := props.Props["ctime"]; ok {
+		ctime, err = store.DecodeTimestamp(text)
+		if err != nil {
+			return
+		}
+	}
+
+	attr.Ino = nd.ino
+	attr.Mode = kindModes[props.Kind] | uint32(mode&07777)
+	attr.Nlink = 1
+	attr.Blksize = 4096
+	attr.Mtime, attr.Mtimensec = uint64(mtime.Unix()), uint32(mtime.Nanosecond())
+	attr.Atime, attr.Atimensec = attr.Mtime, attr.Mtimensec
+	attr.Ctime, attr.Ctimensec = uint64(ctime.Unix()), uint32(ctime.Nanosecond())
+
+	// The remaining properties are missing on the top directory.
+	attr.Size, err = optUint64(props, "size")
+	if err != nil {
+		return
+	}
+	attr.Blocks = (attr.Size + 511) / 512
+
+	for name, value := range map[string]*uint32{
+		"nlink": &attr.Nlink,
+		"uid":   &attr.Uid,
+		"gid":   &attr.Gid,
+		"rdev":  &attr.Rdev,
+	} {
+		var tmp uint64
+		tmp, err = optUint64(props, name)
+		if err != nil {
+			return
+		}
+		if tmp != 0 {
+			*value = uint32(tmp)
+		}
+	}
+	return
+}
+
+// Get a numeric property, which is zero if missing.
+func optUint64(props *store.PropertyMap, name string) (value uint64, err error) {
+	if _, ok := props.Props[name]; !ok {
+		return
+	}
+	return props.GetUint64(name)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Passphrases for encrypted pools.
+
+var keyFile = flag.String("keyfile", "", "File holding the passphrase for encrypted pools")
+
+// Passphrases already given, by pool path, so that the user is only
+// asked once.
+var passphrases = make(map[string][]byte)
+
+// Get the passphrase for an encrypted pool.  It is read from the
+// keyfile if one was given, otherwise from the GODUMP_PASSPHRASE
+// environment variable, and otherwise asked for on the terminal.
+func getPassphrase(path string) (pass []byte, err error) {
+	pass, ok := passphrases[path]
+	if ok {
+		return
+	}
+
+	pass, _, err = readPassphrase("Passphrase for " + path + ": ")
+	if err != nil {
+		return
+	}
+
+	passphrases[path] = pass
+	return
+}
+
+// Get the passphrase for a new pool.  If it comes from the terminal,
+// ask for it twice to guard against typos.
+func newPassphrase(path string) (pass []byte, err error) {
+	pass, prompted, err := readPassphrase("New passphrase for " + path + ": ")
+	if err != nil || !prompted {
+		return
+	}
+
+	again, _, err := readPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(pass, again) {
+		err = errors.New("Passphrases do not match")
+	}
+	return
+}
+
+func readPassphrase(prompt string) (pass []byte, prompted bool, err error) {
+	if *keyFile != "" {
+		pass, err = ioutil.ReadFile(*keyFile)
+		pass = bytes.TrimRight(pass, "\r\n")
+		return
+	}
+
+	env := os.Getenv("GODUMP_PASSPHRASE")
+	if env != "" {
+		pass = []byte(env)
+		return
+	}
+
+	prompted = true
+	pass, err = promptPassphrase(prompt)
+	return
+}
+
+// Ask for a passphrase on the terminal, with echo turned off.
+func promptPassphrase(prompt string) (pass []byte, err error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer tty.Close()
+
+	var old syscall.Termios
+	err = ioctl(tty.Fd(), syscall.TCGETS, &old)
+	if err != nil {
+		return
+	}
+	noEcho := old
+	noEcho.Lflag &^= syscall.ECHO
+	err = ioctl(tty.Fd(), syscall.TCSETS, &noEcho)
+	if err != nil {
+		return
+	}
+	defer ioctl(tty.Fd(), syscall.TCSETS, &old)
+
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadBytes('\n')
+	fmt.Fprintln(tty)
+	if err != nil {
+		return
+	}
+
+	pass = bytes.TrimRight(line, "\r\n")
+	if len(pass) == 0 {
+		err = errors.New("Empty passphrase")
+	}
+	return
+}
+
+func ioctl(fd uintptr, request uintptr, termios *syscall.Termios) (err error) {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request,
+		uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		err = errno
+	}
+	return
+}
@@ -0,0 +1,127 @@
+// Remove chunks that are not referenced by any kept backup.
+
+package prune
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"meter"
+	"pool"
+	"store"
+)
+
+type markState struct {
+	// All of the chunks reachable from the kept backups.
+	reachable map[pool.OID]bool
+
+	store.PathTrackerImpl
+	store.EmptyVisitor
+}
+
+// Remove all of the chunks in the pool that aren't reachable from the
+// given backups.  If 'keep' is empty, all of the backups in the pool
+// are kept, and only chunks unreferenced by any backup are removed.
+// With 'dryRun' set, only report what would be freed.
+func Run(pl pool.Pool, keep []*pool.OID, dryRun bool) (err error) {
+	backups, err := pl.Backups()
+	if err != nil {
+		return
+	}
+
+	if len(keep) == 0 {
+		keep = backups
+	} else {
+		err = checkBackups(backups, keep)
+		if err != nil {
+			return
+		}
+	}
+
+	return Remove(pl, keep, dryRun)
+}
+
+// Remove everything from the pool not reachable from 'keep', which
+// may be empty.
+func Remove(pl pool.Pool, keep []*pool.OID, dryRun bool) (err error) {
+	reachable, err := Mark(pl, keep)
+	if err != nil {
+		return
+	}
+
+	stats, err := pool.Sweep(pl, reachable, dryRun)
+	if err != nil {
+		return
+	}
+
+	verb := "Freed"
+	if dryRun {
+		verb = "Would free"
+	}
+	log.Printf("%s %d chunks, %s (%d cached files)", verb, stats.Chunks,
+		meter.Humanize(stats.Bytes), stats.CacheEntries)
+	return
+}
+
+// Make sure that every given OID is actually a backup.  Otherwise a
+// mistyped hash would result in every backup being removed.
+func checkBackups(backups, ids []*pool.OID) (err error) {
+	known := make(map[pool.OID]bool)
+	for _, id := range backups {
+		known[*id] = true
+	}
+
+	for _, id := range ids {
+		if !known[*id] {
+			err = fmt.Errorf("Not a backup: %s", id.String())
+			return
+		}
+	}
+	return
+}
+
+// Collect the OIDs of every chunk reachable from the given roots.
+func Mark(pl pool.Pool, roots []*pool.OID) (reachable map[pool.OID]bool, err error) {
+	var self markState
+	self.reachable = make(map[pool.OID]bool)
+
+	for _, id := range roots {
+		self.InitPath()
+		err = store.Walk(pl, id, &self)
+		if err != nil {
+			return
+		}
+	}
+
+	reachable = self.reachable
+	return
+}
+
+func (self *markState) EarlyVisit(oid *pool.OID) (err error) {
+	if self.reachable[*oid] {
+		return store.Prune
+	}
+	self.reachable[*oid] = true
+	return
+}
+
+// The children of the lowest level of file indirect blocks are all
+// data blobs.  Mark them directly, rather than reading all of the
+// file data back in.
+func (self *markState) Chunk(chunk pool.Chunk) (err error) {
+	if chunk.Kind() != pool.StringToKind("ind0") {
+		return
+	}
+
+	buf := bytes.NewBuffer(chunk.Data())
+	for buf.Len() > 0 {
+		var oid *pool.OID
+		oid, err = pool.OIDFromBytes(buf)
+		if err != nil {
+			return
+		}
+		self.reachable[*oid] = true
+	}
+	return store.Prune
+}
@@ -0,0 +1,24 @@
+// Rebuild the indexes of a file pool.
+
+package reindex
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"pool"
+)
+
+func Run(path string, truncate bool) (err error) {
+	results, err := pool.ReindexFilePool(path, truncate)
+	for _, res := range results {
+		log.Printf("%s: %d chunks, %d bytes", filepath.Base(res.Name), res.Chunks, res.Size)
+		if res.Truncated {
+			log.Printf("%s: removed %d bytes of damaged data", filepath.Base(res.Name), res.Torn)
+		}
+	}
+	if len(results) > 0 && results[len(results)-1].Truncatable && !truncate {
+		err = fmt.Errorf("%s, which -truncate removes", err)
+	}
+	return
+}
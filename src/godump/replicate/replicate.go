@@ -0,0 +1,74 @@
+// Copying backups from one pool to another.
+
+package replicate
+
+import (
+	"fmt"
+	"log"
+
+	"godump/listing"
+	"meter"
+	"pool"
+	"store"
+)
+
+type copyState struct {
+	copier *store.Copier
+
+	// The backup being copied.
+	current string
+}
+
+// Copy the given backups from 'src' to 'dst', or all of the backups
+// in 'src', oldest first, if none are given.  Only chunks missing
+// from 'dst' are copied.
+func Run(src, dst pool.Pool, ids []*pool.OID) (err error) {
+	if len(ids) == 0 {
+		var backs []*listing.BackNode
+		backs, err = listing.Collect(src)
+		if err != nil {
+			return
+		}
+		for _, back := range backs {
+			ids = append(ids, back.OID)
+		}
+	}
+
+	var self copyState
+	self.copier, err = store.NewCopier(src, dst)
+	if err != nil {
+		return
+	}
+	self.copier.Progress = func() {
+		meter.Sync(&self, false)
+	}
+
+	for _, id := range ids {
+		self.current = id.String()
+		before := self.copier.Backups
+		err = self.copier.Copy(id)
+		if err != nil {
+			return
+		}
+		meter.Sync(&self, true)
+		if self.copier.Backups == before {
+			log.Printf("Already present: %s", id.String())
+		} else {
+			log.Printf("Copied backup: %s", id.String())
+		}
+	}
+	return
+}
+
+// Generate the progress meter.
+func (self *copyState) GetMeter() (result []string) {
+	result = make([]string, 5)
+
+	result[0] = "----------------------------------------------------------------------"
+	result[1] = fmt.Sprintf("   %11d chunks copied, %11d already present",
+		self.copier.Chunks, self.copier.Skipped)
+	result[2] = fmt.Sprintf("   %s data", meter.Humanize(self.copier.Bytes))
+	result[3] = fmt.Sprintf(" : %s", self.current)
+	result[4] = "----------------------------------------------------------------------"
+	return
+}
@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"syscall"
 
+	"linuxdir"
 	"meter"
 	"pool"
 	"store"
@@ -20,6 +22,19 @@ type restoreState struct {
 	// Current open file.
 	file *os.File
 
+	// The parts of the backup to restore.
+	match *store.PathMatcher
+
+	// The first path restored for each multiply linked inode.
+	links map[linkKey]string
+
+	pool pool.Pool
+
+	// Xattr namespaces not to restore, and those that have
+	// already had a failure reported.
+	skipXattrs  map[string]bool
+	xattrWarned map[string]bool
+
 	// Part of progress meter.
 	chunkCount int64
 	byteCount  int64
@@ -31,20 +46,55 @@ type restoreState struct {
 	store.EmptyVisitor
 }
 
-func Run(pl pool.Pool, id *pool.OID, path string) (err error) {
+// Restore the backup into the directory 'path'.  If any patterns are
+// given, only the matching parts of the backup are restored, along
+// with the directories leading to them.  Extended attributes in the
+// namespaces in 'skipXattrs' (such as "security" or "trusted") are
+// not restored.
+func Run(pl pool.Pool, id *pool.OID, path string, patterns []string, skipXattrs []string) (err error) {
 	var state restoreState
 	state.base = path
+	state.pool = pl
+	state.links = make(map[linkKey]string)
+	state.skipXattrs = make(map[string]bool)
+	state.xattrWarned = make(map[string]bool)
+	for _, space := range skipXattrs {
+		state.skipXattrs[space] = true
+	}
 	state.InitPath()
 
+	state.match, err = store.NewPathMatcher(patterns)
+	if err != nil {
+		return
+	}
+
 	err = store.Walk(pl, id, &state)
 	if err != nil {
 		return
 	}
 	meter.Sync(&state, true)
+
+	missing := state.match.Unmatched()
+	if len(missing) > 0 {
+		err = fmt.Errorf("Not found in backup: %s", strings.Join(missing, ", "))
+	}
 	return
 }
 
 func (self *restoreState) Open(props *store.PropertyMap) (err error) {
+	if selected, _ := self.match.Match(self.Path("")); !selected {
+		return store.Prune
+	}
+
+	linked, err := self.hardLink(props)
+	if err != nil {
+		return
+	}
+	if linked {
+		self.fileCount++
+		return store.Prune
+	}
+
 	self.file, err = os.OpenFile(self.FullPath(),
 		os.O_WRONLY|os.O_CREATE|os.O_EXCL,
 		0600)
@@ -58,13 +108,18 @@ func (self *restoreState) Close(props *store.PropertyMap) (err error) {
 	if err != nil {
 		return
 	}
-	return restoreReg(self.FullPath(), props)
+	return self.restoreReg(self.FullPath(), props)
 }
 
 func (self *restoreState) Enter(props *store.PropertyMap) (err error) {
 	// TODO: Do we want to special case the root directory should
 	// exist, or should we always restore into a new dir, and
 	// require things to be moved out later.
+	selected, ancestor := self.match.Match(self.Path(""))
+	if !selected && !ancestor {
+		return store.Prune
+	}
+
 	name := self.FullPath()
 	err = os.Mkdir(name, 0700)
 
@@ -74,26 +129,120 @@ func (self *restoreState) Enter(props *store.PropertyMap) (err error) {
 }
 
 func (self *restoreState) Leave(props *store.PropertyMap) (err error) {
-	return restoreReg(self.FullPath(), props)
+	return self.restoreReg(self.FullPath(), props)
 }
 
 func (self *restoreState) Node(props *store.PropertyMap) (err error) {
+	if selected, _ := self.match.Match(self.Path("")); !selected {
+		return
+	}
+
+	linked, err := self.hardLink(props)
+	if err != nil || linked {
+		return
+	}
+
 	switch props.Kind {
 	case "LNK":
-		err = restoreLink(self.FullPath(), props)
+		err = self.restoreLink(self.FullPath(), props)
+	case "CHR", "BLK", "FIFO", "SOCK":
+		err = self.restoreSpecial(self.FullPath(), props)
 	default:
 		log.Printf("TODO: Restore node %q: %s", props.Kind, self.FullPath())
 	}
 	return
 }
 
+// Hard links are recognized by the device and inode the node had when
+// it was backed up.
+type linkKey struct {
+	dev, ino uint64
+}
+
+// If the node is another link to an inode that has already been
+// restored, link it to the earlier path, and return 'linked'.
+// Otherwise, remember this path for later links.
+func (self *restoreState) hardLink(props *store.PropertyMap) (linked bool, err error) {
+	nlink, err := props.GetUint64("nlink")
+	if err != nil || nlink < 2 {
+		err = nil
+		return
+	}
+
+	var key linkKey
+	key.dev, err = props.GetUint64("dev")
+	if err != nil {
+		return
+	}
+	key.ino, err = props.GetUint64("ino")
+	if err != nil {
+		return
+	}
+
+	name := self.FullPath()
+	first, ok := self.links[key]
+	if !ok {
+		self.links[key] = name
+		return
+	}
+
+	err = os.Link(first, name)
+	linked = err == nil
+	return
+}
+
+var specialModes = map[string]uint32{
+	"CHR":  syscall.S_IFCHR,
+	"BLK":  syscall.S_IFBLK,
+	"FIFO": syscall.S_IFIFO,
+	"SOCK": syscall.S_IFSOCK,
+}
+
+// Restore a device node, fifo, or socket.  Only root can create
+// device nodes, so these are skipped with a warning otherwise.
+func (self *restoreState) restoreSpecial(path string, props *store.PropertyMap) (err error) {
+	mode, err := props.GetInt("mode")
+	if err != nil {
+		return
+	}
+
+	var rdev uint64
+	if props.Kind == "CHR" || props.Kind == "BLK" {
+		if !isRoot {
+			log.Printf("Skipping device node, not root: %s", path)
+			return
+		}
+		rdev, err = props.GetUint64("rdev")
+		if err != nil {
+			return
+		}
+	}
+
+	oldMode := syscall.Umask(0)
+	err = syscall.Mknod(path, specialModes[props.Kind]|uint32(mode&4095), int(rdev))
+	syscall.Umask(oldMode)
+	if err != nil {
+		err = &os.PathError{Op: "mknod", Path: path, Err: err}
+		return
+	}
+
+	return self.restoreReg(path, props)
+}
+
 // Restore the stats on the given file.
-func restoreReg(path string, props *store.PropertyMap) (err error) {
+func (self *restoreState) restoreReg(path string, props *store.PropertyMap) (err error) {
 	err = propChown(path, props, os.Chown)
 	if err != nil {
 		return
 	}
 
+	// After the chown, which clears any file capabilities, but
+	// before the chmod, which may leave the file read-only.
+	err = self.restoreXattrs(path, props)
+	if err != nil {
+		return
+	}
+
 	mode, err := props.GetInt("mode")
 	if err != nil {
 		return
@@ -109,7 +258,7 @@ func restoreReg(path string, props *store.PropertyMap) (err error) {
 // Restore a symlink.  There isn't an lchmod in Linux, but we can set
 // a umask before creating the node.  The link permissions aren't
 // useful anyway, but it's nice to restore them correctly.
-func restoreLink(path string, props *store.PropertyMap) (err error) {
+func (self *restoreState) restoreLink(path string, props *store.PropertyMap) (err error) {
 	mode, err := props.GetInt("mode")
 	if err != nil {
 		return
@@ -128,6 +277,37 @@ func restoreLink(path string, props *store.PropertyMap) (err error) {
 	}
 
 	err = propChown(path, props, os.Lchown)
+	if err != nil {
+		return
+	}
+
+	return self.restoreXattrs(path, props)
+}
+
+// Set the extended attributes recorded for a node.  Attributes in
+// the namespaces being skipped are left off.  Failing to set an
+// attribute, such as when not running as root, or when the
+// filesystem doesn't support them, is warned about once for each
+// namespace, but doesn't stop the restore.
+func (self *restoreState) restoreXattrs(path string, props *store.PropertyMap) (err error) {
+	attrs, err := props.Xattrs(self.pool)
+	if err != nil {
+		return
+	}
+
+	for name, value := range attrs {
+		space := strings.SplitN(name, ".", 2)[0]
+		if self.skipXattrs[space] {
+			continue
+		}
+
+		tmpErr := linuxdir.Lsetxattr(path, name, value)
+		if tmpErr != nil && !self.xattrWarned[space] {
+			self.xattrWarned[space] = true
+			log.Printf("WARN: unable to restore %q xattrs (%s), first on %q",
+				space, tmpErr, path)
+		}
+	}
 	return
 }
 
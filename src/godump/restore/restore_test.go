@@ -0,0 +1,94 @@
+// Test restoring special files and hard links.
+
+package restore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"godump/dump"
+	"godump/restore"
+	"tutil"
+)
+
+func TestRestoreSpecial(t *testing.T) {
+	pt := tutil.NewPoolTest(t)
+	defer pt.Clean()
+	tutil.FakeBlkid(t, pt.Tmp.Path())
+
+	src := pt.Tmp.Path() + "/src"
+	data := []byte("linked twice\n")
+	for _, step := range []error{
+		os.MkdirAll(src+"/sub", 0755),
+		syscall.Mkfifo(src+"/fifo", 0640),
+		ioutil.WriteFile(src+"/file", data, 0644),
+		os.Link(src+"/file", src+"/sub/link"),
+	} {
+		if step != nil {
+			t.Fatalf("Unable to make source tree: %s", step)
+		}
+	}
+
+	// Only root can make device nodes.
+	isRoot := os.Geteuid() == 0
+	nullDev := 1<<8 | 3
+	if isRoot {
+		err := syscall.Mknod(src+"/null", syscall.S_IFCHR|0600, nullDev)
+		if err != nil {
+			t.Fatalf("Unable to make device node: %s", err)
+		}
+	}
+
+	err := dump.Run(pt.Pool, src, map[string]string{"fs": "test"})
+	if err != nil {
+		t.Fatalf("Error dumping: %s", err)
+	}
+	backups, err := pt.Pool.Backups()
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("Expecting one backup, found %d: %v", len(backups), err)
+	}
+
+	dst := pt.Tmp.Path() + "/dst"
+	err = restore.Run(pt.Pool, backups[0], dst, nil, nil)
+	if err != nil {
+		t.Fatalf("Error restoring: %s", err)
+	}
+
+	fi, err := os.Lstat(dst + "/fifo")
+	if err != nil {
+		t.Fatalf("FIFO not restored: %s", err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 || fi.Mode().Perm() != 0640 {
+		t.Errorf("FIFO restored with mode %s", fi.Mode())
+	}
+
+	first, err := os.Lstat(dst + "/file")
+	if err != nil {
+		t.Fatalf("File not restored: %s", err)
+	}
+	second, err := os.Lstat(dst + "/sub/link")
+	if err != nil {
+		t.Fatalf("Link not restored: %s", err)
+	}
+	if !os.SameFile(first, second) {
+		t.Errorf("Hard links restored as separate files")
+	}
+	got, err := ioutil.ReadFile(dst + "/sub/link")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Linked file read back as %q: %v", got, err)
+	}
+
+	if isRoot {
+		var st syscall.Stat_t
+		err = syscall.Lstat(dst+"/null", &st)
+		if err != nil {
+			t.Fatalf("Device not restored: %s", err)
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != uint64(nullDev) {
+			t.Errorf("Device restored with mode %o, rdev %x", st.Mode, st.Rdev)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Verify the integrity of backups.
+
+package verify
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"meter"
+	"pool"
+	"store"
+)
+
+type verifyState struct {
+	pool *searchPool
+
+	// The backup currently being walked.
+	backup *pool.OID
+
+	// Chunks that have already been checked and found to be
+	// good.  Shared subtrees are only walked once.
+	good map[pool.OID]bool
+
+	// Chunks that are missing or corrupt, along with where they
+	// were referenced from.
+	bad map[pool.OID]*badChunk
+
+	// The good chunks being walked, outermost first, and the bad
+	// chunks found beneath good ones, so that they can be reported
+	// under every path reaching them without walking shared
+	// subtrees again.
+	walking []walkingChunk
+	below   map[pool.OID][]badRef
+
+	// Part of progress meter.
+	chunkCount int64
+	byteCount  int64
+
+	store.PathTrackerImpl
+	store.EmptyVisitor
+}
+
+type badChunk struct {
+	problem string
+	paths   []string
+}
+
+type walkingChunk struct {
+	oid  pool.OID
+	path string
+}
+
+// A bad chunk, and its path relative to a chunk above it.
+type badRef struct {
+	oid  pool.OID
+	path string
+}
+
+// Verify every chunk reachable from the given backups.  If no
+// backups are given, all of the backups in the pool are verified.
+// Each problem found is logged, and an error is returned if there
+// were any.
+func Run(pl pool.Pool, backups []*pool.OID) (err error) {
+	if len(backups) == 0 {
+		backups, err = pl.Backups()
+		if err != nil {
+			return
+		}
+	}
+
+	var self verifyState
+	self.pool = &searchPool{Pool: pl}
+	self.good = make(map[pool.OID]bool)
+	self.bad = make(map[pool.OID]*badChunk)
+	self.below = make(map[pool.OID][]badRef)
+
+	for _, id := range backups {
+		self.backup = id
+		self.InitPath()
+
+		err = store.Walk(self.pool, id, &self)
+		if err != nil {
+			return
+		}
+	}
+	meter.Sync(&self, true)
+
+	return self.report()
+}
+
+// Each chunk is read and checked before it is decoded, so that
+// problems can be recorded and the walk can continue past them.
+func (self *verifyState) EarlyVisit(oid *pool.OID) (err error) {
+	if self.good[*oid] {
+		path := self.Path(".")
+		for _, ref := range self.below[*oid] {
+			self.addPath(&ref.oid, path+ref.path)
+		}
+		return store.Prune
+	}
+
+	if _, ok := self.bad[*oid]; ok {
+		self.addPath(oid, self.Path("."))
+		return store.Prune
+	}
+
+	ch, err := self.pool.Pool.Search(oid)
+	if err == sql.ErrNoRows {
+		self.addBad(oid, "missing")
+		return store.Prune
+	}
+	if err != nil {
+		self.addBad(oid, err.Error())
+		return store.Prune
+	}
+
+	err = pool.VerifyChunk(self.pool.Pool, ch)
+	if err != nil {
+		self.addBad(oid, err.Error())
+		return store.Prune
+	}
+
+	self.good[*oid] = true
+	self.pool.last = ch
+	self.walking = append(self.walking, walkingChunk{oid: *oid, path: self.Path(".")})
+
+	self.chunkCount++
+	self.byteCount += int64(ch.DataLen())
+	meter.Sync(self, false)
+	return
+}
+
+// Called once the subtree of a good chunk has been walked.
+func (self *verifyState) LateVisit(chunk pool.Chunk) (err error) {
+	self.walking = self.walking[:len(self.walking)-1]
+	return
+}
+
+func (self *verifyState) addBad(oid *pool.OID, problem string) {
+	self.bad[*oid] = &badChunk{problem: problem}
+	self.addPath(oid, self.Path("."))
+}
+
+// Record that the bad chunk is reached by 'path' in the current
+// backup, both for the report, and for the chunks above it.
+func (self *verifyState) addPath(oid *pool.OID, path string) {
+	bad := self.bad[*oid]
+	bad.paths = append(bad.paths, fmt.Sprintf("%s:%s", self.backup.String(), path))
+	for _, above := range self.walking {
+		self.below[above.oid] = append(self.below[above.oid],
+			badRef{oid: *oid, path: strings.TrimPrefix(path, above.path)})
+	}
+}
+
+func (self *verifyState) report() (err error) {
+	if len(self.bad) == 0 {
+		log.Printf("Verified %d chunks", self.chunkCount)
+		return
+	}
+
+	oids := make([]pool.OID, 0, len(self.bad))
+	for oid := range self.bad {
+		oids = append(oids, oid)
+	}
+	sort.Sort(pool.OIDSlice(oids))
+
+	for i := range oids {
+		bad := self.bad[oids[i]]
+		log.Printf("ERROR: %s: %s", oids[i].String(), bad.problem)
+		for _, path := range bad.paths {
+			log.Printf("    %s", path)
+		}
+	}
+
+	err = fmt.Errorf("%d missing or corrupt chunks", len(self.bad))
+	return
+}
+
+// Generate the progress meter.
+func (self *verifyState) GetMeter() (result []string) {
+	result = make([]string, 5)
+
+	result[0] = "----------------------------------------------------------------------"
+	result[1] = fmt.Sprintf("   %11d chunks, %9d bad", self.chunkCount, len(self.bad))
+	result[2] = fmt.Sprintf("   %s data", meter.Humanize(self.byteCount))
+
+	path := self.Path(".")
+	if len(path) > 73 {
+		path = "..." + path[len(path)-60:]
+	}
+	result[3] = fmt.Sprintf(" : %q", path)
+	result[4] = "----------------------------------------------------------------------"
+	return
+}
+
+// The walk searches for each chunk after EarlyVisit has already read
+// it.  Hand back that chunk rather than reading it a second time.
+type searchPool struct {
+	pool.Pool
+	last pool.Chunk
+}
+
+func (self *searchPool) Search(oid *pool.OID) (chunk pool.Chunk, err error) {
+	if self.last != nil && self.last.OID().Compare(oid) == 0 {
+		chunk = self.last
+		self.last = nil
+		return
+	}
+	return self.Pool.Search(oid)
+}
@@ -0,0 +1,82 @@
+// Test verifying backups that share damaged chunks.
+
+package verify_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"godump/dump"
+	"godump/verify"
+	"pool"
+	"tutil"
+)
+
+func TestVerifyShared(t *testing.T) {
+	pt := tutil.NewPoolTest(t)
+	defer pt.Clean()
+	tutil.FakeBlkid(t, pt.Tmp.Path())
+
+	src := pt.Tmp.Path() + "/src"
+	data := []byte("damaged\n")
+	for _, step := range []error{
+		os.MkdirAll(src+"/shared/sub", 0755),
+		ioutil.WriteFile(src+"/shared/sub/file", data, 0644),
+	} {
+		if step != nil {
+			t.Fatalf("Unable to make source tree: %s", step)
+		}
+	}
+
+	// The second backup shares the whole tree with the first, and
+	// the third only the damaged subtree.
+	for _, name := range []string{"one", "two"} {
+		err := dump.Run(pt.Pool, src, map[string]string{"fs": name})
+		if err != nil {
+			t.Fatalf("Error dumping: %s", err)
+		}
+	}
+	err := os.Rename(src+"/shared", src+"/moved")
+	if err == nil {
+		err = dump.Run(pt.Pool, src, map[string]string{"fs": "three"})
+	}
+	if err != nil {
+		t.Fatalf("Error dumping: %s", err)
+	}
+
+	oid := pool.PoolOID(pt.Pool, "blob", data)
+	_, err = pool.GetSql(pt.Pool).Exec("DELETE FROM blobs WHERE oid = ?", oid[:])
+	if err == nil {
+		err = pt.Pool.Flush()
+	}
+	if err != nil {
+		t.Fatalf("Unable to remove chunk: %s", err)
+	}
+	backups, err := pt.Pool.Backups()
+	if err != nil || len(backups) != 3 {
+		t.Fatalf("Expecting three backups, found %d: %v", len(backups), err)
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	err = verify.Run(pt.Pool, backups)
+	log.SetOutput(os.Stderr)
+	if err == nil {
+		t.Fatalf("Missing chunk not found")
+	}
+
+	wants := []string{
+		backups[0].String() + ":./shared/sub/file",
+		backups[1].String() + ":./shared/sub/file",
+		backups[2].String() + ":./moved/sub/file",
+	}
+	for _, want := range wants {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("Report doesn't name %q:\n%s", want, out.String())
+		}
+	}
+}
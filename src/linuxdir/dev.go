@@ -0,0 +1,17 @@
+// Device numbers, encoded the way glibc does, which is what stat
+// returns in st_rdev.
+
+package linuxdir
+
+func Major(dev uint64) uint32 {
+	return uint32((dev>>8)&0xfff | (dev>>32)&^0xfff)
+}
+
+func Minor(dev uint64) uint32 {
+	return uint32(dev&0xff | (dev>>12)&^0xff)
+}
+
+func Mkdev(major, minor uint32) uint64 {
+	ma, mi := uint64(major), uint64(minor)
+	return (ma&0xfff)<<8 | (ma&^0xfff)<<32 | mi&0xff | (mi&^0xff)<<12
+}
@@ -0,0 +1,29 @@
+package linuxdir_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"linuxdir"
+)
+
+func TestDev(t *testing.T) {
+	for _, nums := range [][2]uint32{{0, 0}, {1, 3}, {8, 17}, {259, 1}, {4095, 255}, {4096, 256}, {0xfffff, 0xfffff}} {
+		dev := linuxdir.Mkdev(nums[0], nums[1])
+		if linuxdir.Major(dev) != nums[0] || linuxdir.Minor(dev) != nums[1] {
+			t.Errorf("Device %d:%d encoded as %x, decoded as %d:%d", nums[0], nums[1],
+				dev, linuxdir.Major(dev), linuxdir.Minor(dev))
+		}
+	}
+
+	// /dev/null is 1:3 everywhere.
+	fi, err := os.Stat("/dev/null")
+	if err != nil {
+		t.Skipf("No /dev/null: %s", err)
+	}
+	rdev := fi.Sys().(*syscall.Stat_t).Rdev
+	if linuxdir.Major(rdev) != 1 || linuxdir.Minor(rdev) != 3 {
+		t.Errorf("/dev/null decoded as %d:%d", linuxdir.Major(rdev), linuxdir.Minor(rdev))
+	}
+}
@@ -0,0 +1,112 @@
+// Extended attributes.  The syscall package only has the versions
+// that follow symlinks, and the attributes of a symlink itself are
+// needed for backups.
+
+package linuxdir
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Return the extended attributes of the named file, without following
+// a symlink.  Filesystems without extended attributes return an empty
+// map.
+func Lxattrs(path string) (attrs map[string][]byte, err error) {
+	attrs = make(map[string][]byte)
+
+	names, err := lxattrCall(syscall.SYS_LLISTXATTR, path, nil)
+	if err == syscall.ENOTSUP {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		var value []byte
+		value, err = lxattrCall(syscall.SYS_LGETXATTR, path, name)
+		if err == syscall.ENODATA {
+			// Removed while we were looking.
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		attrs[string(name)] = value
+	}
+	return
+}
+
+// Set an extended attribute on the named file, without following a
+// symlink.
+func Lsetxattr(path, name string, value []byte) (err error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return
+	}
+	var v unsafe.Pointer
+	if len(value) > 0 {
+		v = unsafe.Pointer(&value[0])
+	}
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR,
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)),
+		uintptr(v), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		err = os.NewSyscallError("lsetxattr", errno)
+	}
+	return
+}
+
+// Perform llistxattr (with a nil name) or lgetxattr, growing the
+// buffer until the result fits.
+func lxattrCall(trap uintptr, path string, name []byte) (result []byte, err error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return
+	}
+	var n *byte
+	if name != nil {
+		n, err = syscall.BytePtrFromString(string(name))
+		if err != nil {
+			return
+		}
+	}
+
+	size := 256
+	for {
+		buf := make([]byte, size)
+		var r uintptr
+		var errno syscall.Errno
+		if n == nil {
+			r, _, errno = syscall.Syscall(trap, uintptr(unsafe.Pointer(p)),
+				uintptr(unsafe.Pointer(&buf[0])), uintptr(size))
+		} else {
+			r, _, errno = syscall.Syscall6(trap, uintptr(unsafe.Pointer(p)),
+				uintptr(unsafe.Pointer(n)),
+				uintptr(unsafe.Pointer(&buf[0])), uintptr(size), 0, 0)
+		}
+		if errno == syscall.ERANGE {
+			size *= 4
+			continue
+		}
+		if errno != 0 {
+			err = errno
+			return
+		}
+		result = buf[:r]
+		return
+	}
+}
@@ -0,0 +1,38 @@
+package linuxdir_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"linuxdir"
+)
+
+func TestXattrs(t *testing.T) {
+	file, err := ioutil.TempFile("", "xattr")
+	if err != nil {
+		t.Fatalf("Unable to make temp file: %q", err)
+	}
+	name := file.Name()
+	file.Close()
+	defer os.Remove(name)
+
+	value := bytes.Repeat([]byte("value"), 100)
+	err = linuxdir.Lsetxattr(name, "user.godump", value)
+	if se, ok := err.(*os.SyscallError); ok && se.Err == syscall.ENOTSUP {
+		t.Skip("Temp filesystem doesn't support user xattrs")
+	}
+	if err != nil {
+		t.Fatalf("Unable to set xattr: %q", err)
+	}
+
+	attrs, err := linuxdir.Lxattrs(name)
+	if err != nil {
+		t.Fatalf("Unable to read xattrs: %q", err)
+	}
+	if !bytes.Equal(attrs["user.godump"], value) {
+		t.Errorf("Xattr read back as %q", attrs["user.godump"])
+	}
+}
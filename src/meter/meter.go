@@ -9,6 +9,7 @@ package meter
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"time"
@@ -22,6 +23,11 @@ type Informer interface {
 	GetMeter() []string
 }
 
+// Where the meter and log messages are written.  Commands that write
+// their results to stdout should set this to os.Stderr before calling
+// Setup.
+var Output io.Writer = os.Stdout
+
 // Initialize the progress meter.  Spawns off a thread to show the
 // output, and captures the log output.
 func Setup() {
@@ -35,10 +41,10 @@ func Setup() {
 }
 
 // Stop the logging.  Displays any pending messages before returning.
-// After this, logging just goes to stdout as normal.
+// After this, logging just goes to Output as normal.
 func Shutdown() {
 	close(main.log)
-	log.SetOutput(os.Stdout)
+	log.SetOutput(Output)
 	<-main.done
 }
 
@@ -77,7 +83,7 @@ func (self *meter) Run() {
 			if ok {
 				// Show message.
 				self.Clear()
-				fmt.Print(msg)
+				fmt.Fprint(Output, msg)
 				self.Show()
 			} else {
 				// The log is closed.
@@ -108,7 +114,7 @@ func (self *meter) Clear() {
 		return
 	}
 
-	fmt.Printf("\x1b[%dF\x1b[J", len(self.msg))
+	fmt.Fprintf(Output, "\x1b[%dF\x1b[J", len(self.msg))
 }
 
 func (self *meter) Show() {
@@ -116,6 +122,6 @@ func (self *meter) Show() {
 		return
 	}
 	for _, line := range self.msg {
-		fmt.Println(line)
+		fmt.Fprintln(Output, line)
 	}
 }
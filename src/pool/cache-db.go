@@ -0,0 +1,114 @@
+// Dump caches kept in a database of their own, for pools that don't
+// hold them.
+
+package pool
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var cacheSchema = schema{
+	version: "remote-cache:2026-10-17",
+	schema: append([]string{
+		`CREATE TABLE props (
+			key text primary key,
+			value text)`,
+	}, cacheTables...),
+}
+
+// Open the cache database 'name', creating it if needed, and begin a
+// transaction on it.  'sweep' identifies the chunks removed from the
+// pool so far, and the cache is cleared when it changes.
+func openCacheDB(name, sweep string) (db *sql.DB, tx *sql.Tx, err error) {
+	_, err = os.Stat(name)
+	if os.IsNotExist(err) {
+		err = createCacheDB(name)
+	}
+	if err != nil {
+		return
+	}
+
+	db, err = sql.Open("sqlite3", name)
+	if err != nil {
+		return
+	}
+	_, err = checkSchema(db, &cacheSchema)
+	if err == nil {
+		tx, err = db.Begin()
+	}
+	if err == nil {
+		err = clearStaleCache(tx, sweep)
+		if err != nil {
+			tx.Rollback()
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err == nil {
+		tx, err = db.Begin()
+	}
+	if err != nil {
+		db.Close()
+		db, tx = nil, nil
+	}
+	return
+}
+
+// Make the cache database under another name, and link it into place,
+// so that a writer opening the pool at the same time never sees it
+// without its tables.  If one got there first, its database is used.
+func createCacheDB(name string) (err error) {
+	fd, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return
+	}
+	tmp := fd.Name()
+	fd.Close()
+	defer os.Remove(tmp)
+
+	db, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return
+	}
+	err = setSchema(db, &cacheSchema)
+	closeErr := db.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+
+	err = os.Link(tmp, name)
+	if os.IsExist(err) {
+		err = nil
+	}
+	return
+}
+
+func clearStaleCache(tx *sql.Tx, sweep string) (err error) {
+	var last string
+	err = tx.QueryRow("SELECT value FROM props WHERE key = 'sweep'").Scan(&last)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil || last == sweep {
+		return
+	}
+
+	for _, stmt := range []string{
+		"DELETE FROM ctime_cache",
+		"DELETE FROM ctime_dirs",
+	} {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return
+		}
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO props (key, value) VALUES ('sweep', ?)", sweep)
+	return
+}
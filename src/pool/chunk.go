@@ -4,9 +4,9 @@ package pool
 
 import (
 	"bytes"
-	"compress/zlib"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"sync"
 )
@@ -17,10 +17,14 @@ type Chunk interface {
 	Data() []byte
 	DataLen() uint32
 	ZData() (zdata []byte, present bool)
+
+	// The codec used for ZData.
+	Codec() Codec
 }
 
 var ChunkError = errors.New("Error reading chunk")
 var chunkMagic = []byte("adump-pool-v1.1\n")
+var chunkMagicCodec = []byte("adump-pool-v1.2\n")
 var padding = make([]byte, 16)
 
 // Data associated with any kind of chunk.
@@ -36,32 +40,28 @@ func (ch *sharedChunk) OID() *OID  { return ch.oid }
 type dataChunk struct {
 	sharedChunk
 	data     []byte
+	codec    Codec
 	getZData func() (zdata []byte, present bool)
 }
 
 func (ch *dataChunk) Data() []byte          { return ch.data }
 func (ch *dataChunk) DataLen() uint32       { return uint32(len(ch.data)) }
 func (ch *dataChunk) ZData() ([]byte, bool) { return ch.getZData() }
+func (ch *dataChunk) Codec() Codec          { return ch.codec }
 
-func newDataChunk(kind Kind, oid *OID, data []byte) Chunk {
+// The data is compressed with 'codec' the first time it is needed.
+func newDataChunk(kind Kind, oid *OID, data []byte, codec Codec) Chunk {
 	var zdata []byte
 	present := false
 
 	getZData := func() {
-		var zbuf bytes.Buffer
-		w := zlib.NewWriter(&zbuf)
-		io.Copy(w, bytes.NewBuffer(data))
-		w.Close()
-		tmp := zbuf.Bytes()
-		if len(tmp) < len(data) {
-			zdata = tmp
-			present = true
-		}
+		zdata, present = compress(codec, data)
 	}
 	var once sync.Once
 	return &dataChunk{
 		sharedChunk{kind, oid},
 		data,
+		codec,
 		func() ([]byte, bool) {
 			once.Do(getZData)
 			return zdata, present
@@ -74,7 +74,16 @@ func NewChunk(kind string, data []byte) Chunk {
 		panic("Chunk kind must be 4 characters")
 	}
 	oid := BlobOID(kind, data)
-	return newDataChunk(StringToKind(kind), oid, data)
+	return newDataChunk(StringToKind(kind), oid, data, DefaultCodec)
+}
+
+// Construct a chunk to be written to the given pool.
+func NewPoolChunk(p Pool, kind string, data []byte) Chunk {
+	if len(kind) != 4 {
+		panic("Chunk kind must be 4 characters")
+	}
+	oid := PoolOID(p, kind, data)
+	return newDataChunk(StringToKind(kind), oid, data, PoolCodec(p))
 }
 
 // Performing Chunk IO.
@@ -87,6 +96,14 @@ type chunkHeader struct {
 	Oid        OID
 }
 
+// Chunks compressed with a codec other than zlib are written with the
+// version 1.2 magic, and this extension after the header.  The
+// reserved space keeps the header a multiple of 16 bytes.
+type chunkHeaderCodec struct {
+	Codec    uint32
+	Reserved [12]byte
+}
+
 // Write the Chunk encoded to the given writer.
 func ChunkWrite(ch Chunk, w io.Writer) (err error) {
 	var header chunkHeader
@@ -109,11 +126,24 @@ func ChunkWrite(ch Chunk, w io.Writer) (err error) {
 		payload = ch.Data()
 	}
 
+	withCodec := hasZ && ch.Codec() != CodecZlib
+	if withCodec {
+		copy(header.Magic[:], chunkMagicCodec)
+	}
+
 	err = binary.Write(w, binary.LittleEndian, &header)
 	if err != nil {
 		return
 	}
 
+	if withCodec {
+		ext := chunkHeaderCodec{Codec: uint32(ch.Codec())}
+		err = binary.Write(w, binary.LittleEndian, &ext)
+		if err != nil {
+			return
+		}
+	}
+
 	_, err = w.Write(payload)
 	if err != nil {
 		return
@@ -147,34 +177,37 @@ func readLE32(piece []byte) uint32 {
 
 type compressedChunk struct {
 	sharedChunk
-	dataLen uint32
-	zdata   []byte
-	getData func() []byte
+	data  []byte
+	zdata []byte
+	codec Codec
 }
 
-func (ch *compressedChunk) Data() []byte          { return ch.getData() }
-func (ch *compressedChunk) DataLen() uint32       { return ch.dataLen }
+func (ch *compressedChunk) Data() []byte          { return ch.data }
+func (ch *compressedChunk) DataLen() uint32       { return uint32(len(ch.data)) }
 func (ch *compressedChunk) ZData() ([]byte, bool) { return ch.zdata, true }
+func (ch *compressedChunk) Codec() Codec          { return ch.codec }
 
-// Construct a new chunk out of compressed data.
-func newCompressedChunk(kind Kind, oid *OID, dataLen uint32, zdata []byte) Chunk {
-	var data []byte
-
-	getData := func() {
-		var dataBuf bytes.Buffer
-		r, _ := zlib.NewReader(bytes.NewBuffer(zdata))
-		io.Copy(&dataBuf, r)
-		r.Close()
-		data = dataBuf.Bytes()
-		if len(data) != int(dataLen) {
-			panic("Wrong length on decompress")
-		}
+// Construct a new chunk out of compressed data.  It is decompressed
+// here, so that a damaged payload is an error from reading the chunk.
+func newCompressedChunk(kind Kind, oid *OID, dataLen uint32, zdata []byte, codec Codec) (chunk Chunk, err error) {
+	data, err := decompress(codec, zdata, dataLen)
+	if err != nil {
+		err = fmt.Errorf("Unable to decompress chunk %s: %s", oid.String(), err)
+		return
 	}
-	var once sync.Once
-	return &compressedChunk{
-		sharedChunk{kind, oid},
-		dataLen, zdata,
-		func() []byte { once.Do(getData); return data }}
+	chunk = &compressedChunk{sharedChunk{kind, oid}, data, zdata, codec}
+	return
+}
+
+// Check that the contents of the chunk hash to the OID it has in the
+// given pool (or the plain BlobOID if 'p' is nil).
+func VerifyChunk(p Pool, ch Chunk) (err error) {
+	data := ch.Data()
+	oid := PoolOID(p, ch.Kind().String(), data)
+	if oid.Compare(ch.OID()) != 0 {
+		err = fmt.Errorf("Chunk %s hashes to %s", ch.OID().String(), oid.String())
+	}
+	return
 }
 
 // Read a chunk from the reader.  Also returns an amount of padding
@@ -183,7 +216,17 @@ func ChunkRead(rd io.Reader) (chunk Chunk, pad int, err error) {
 	var header chunkHeader
 	err = binary.Read(rd, binary.LittleEndian, &header)
 
-	if !bytes.Equal(header.Magic[:], chunkMagic) {
+	codec := CodecZlib
+	switch {
+	case bytes.Equal(header.Magic[:], chunkMagic):
+	case bytes.Equal(header.Magic[:], chunkMagicCodec):
+		var ext chunkHeaderCodec
+		err = binary.Read(rd, binary.LittleEndian, &ext)
+		if err != nil {
+			return
+		}
+		codec = Codec(ext.Codec)
+	default:
 		err = ChunkError
 		return
 	}
@@ -197,9 +240,12 @@ func ChunkRead(rd io.Reader) (chunk Chunk, pad int, err error) {
 	oid := header.Oid
 
 	if header.DataLen == 0xFFFFFFFF {
-		chunk = newDataChunk(header.Kind, &oid, payload)
+		chunk = newDataChunk(header.Kind, &oid, payload, DefaultCodec)
 	} else {
-		chunk = newCompressedChunk(header.Kind, &oid, header.DataLen, payload)
+		chunk, err = newCompressedChunk(header.Kind, &oid, header.DataLen, payload, codec)
+		if err != nil {
+			return
+		}
 	}
 
 	pad = 15 & -int(header.PayloadLen)
@@ -5,6 +5,7 @@ import (
 	"compress/zlib"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -81,6 +82,62 @@ func TestChunkIO(t *testing.T) {
 	}
 }
 
+func TestVerifyChunk(t *testing.T) {
+	for _, size := range makeSizes() {
+		c := pool.MakeRandomChunk(size)
+		err := pool.VerifyChunk(nil, c)
+		if err != nil {
+			t.Errorf("Unable to verify chunk: '%s'", err)
+		}
+
+		var buf bytes.Buffer
+		pool.ChunkWrite(c, &buf)
+
+		// Damage the last byte of the payload, which follows
+		// the 48 byte header.
+		raw := buf.Bytes()
+		payloadLen := binary.LittleEndian.Uint32(raw[16:20])
+		raw[48+payloadLen-1] ^= 0x55
+
+		// Compressed payloads that no longer decompress are
+		// found reading them.
+		c2, _, err := pool.ChunkRead(bytes.NewBuffer(raw))
+		if err == nil {
+			err = pool.VerifyChunk(nil, c2)
+		}
+		if err == nil {
+			t.Errorf("Damaged chunk of size %d verified", size)
+		}
+	}
+}
+
+// A pool that only chooses a codec.
+type codecPool struct {
+	pool.Pool
+	codec pool.Codec
+}
+
+func (self codecPool) Codec() pool.Codec { return self.codec }
+
+// Payloads are only decompressed to the length in their header.
+func TestChunkOversized(t *testing.T) {
+	for _, codec := range []pool.Codec{pool.CodecZlib, pool.CodecZstd} {
+		ch := pool.NewPoolChunk(codecPool{codec: codec}, "blob", make([]byte, 4*1024*1024))
+		var buf bytes.Buffer
+		err := pool.ChunkWrite(ch, &buf)
+		if err != nil {
+			t.Fatalf("Error writing chunk: '%s'", err)
+		}
+
+		raw := buf.Bytes()
+		binary.LittleEndian.PutUint32(raw[20:24], 100)
+		_, _, err = pool.ChunkRead(bytes.NewBuffer(raw))
+		if err == nil {
+			t.Errorf("Chunk compressed with %s read past its length", codec)
+		}
+	}
+}
+
 func notTestChunkIO(t *testing.T) {
 	tmp, err := makeTempDir()
 	if err != nil {
@@ -0,0 +1,173 @@
+// Compression codecs for chunk payloads.
+
+package pool
+
+import (
+	"bytes"
+	"compress/zlib"
+	"database/sql"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// A Codec identifies how a chunk's payload is compressed.  The
+// numbers are written to chunk files, and must not change.
+type Codec uint8
+
+const (
+	CodecZlib Codec = 0
+	CodecZstd Codec = 1
+)
+
+// The codec for pools that don't ask for another one.
+const DefaultCodec = CodecZlib
+
+type codecInfo struct {
+	name       string
+	compress   func(data []byte) []byte
+	decompress func(zdata []byte, dataLen uint32) ([]byte, error)
+}
+
+var codecs = map[Codec]*codecInfo{
+	CodecZlib: {"zlib", zlibCompress, zlibDecompress},
+	CodecZstd: {"zstd", zstdCompress, zstdDecompress},
+}
+
+func (c Codec) String() string {
+	info, ok := codecs[c]
+	if !ok {
+		return fmt.Sprintf("codec-%d", c)
+	}
+	return info.name
+}
+
+// Find a codec by name.
+func ParseCodec(name string) (codec Codec, err error) {
+	for c, info := range codecs {
+		if info.name == name {
+			codec = c
+			return
+		}
+	}
+	err = fmt.Errorf("Unknown codec: %q", name)
+	return
+}
+
+// Compress the data with the given codec.  'present' is false if this
+// doesn't make the data smaller.
+func compress(codec Codec, data []byte) (zdata []byte, present bool) {
+	tmp := codecs[codec].compress(data)
+	if len(tmp) < len(data) {
+		zdata = tmp
+		present = true
+	}
+	return
+}
+
+// Decompress a payload, checking that it has the expected length.  No
+// more than that is decompressed, however much the payload holds.
+func decompress(codec Codec, zdata []byte, dataLen uint32) (data []byte, err error) {
+	info, ok := codecs[codec]
+	if !ok {
+		err = fmt.Errorf("Unsupported codec: %s", codec.String())
+		return
+	}
+
+	data, err = info.decompress(zdata, dataLen)
+	if err != nil {
+		return
+	}
+
+	if len(data) != int(dataLen) {
+		err = fmt.Errorf("Chunk decompressed to %d bytes, expecting %d",
+			len(data), dataLen)
+	}
+	return
+}
+
+// Return the chunk's payload compressed with the given codec.  The
+// chunk's own compressed data is used if it already has that codec.
+func ZDataWith(ch Chunk, codec Codec) (zdata []byte, present bool) {
+	if ch.Codec() == codec {
+		return ch.ZData()
+	}
+	return compress(codec, ch.Data())
+}
+
+func zlibCompress(data []byte) []byte {
+	var zbuf bytes.Buffer
+	w := zlib.NewWriter(&zbuf)
+	w.Write(data)
+	w.Close()
+	return zbuf.Bytes()
+}
+
+// One byte past 'dataLen' is read, so that longer data is found.
+func zlibDecompress(zdata []byte, dataLen uint32) (data []byte, err error) {
+	r, err := zlib.NewReader(bytes.NewBuffer(zdata))
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	var dataBuf bytes.Buffer
+	_, err = io.Copy(&dataBuf, io.LimitReader(r, int64(dataLen)+1))
+	if err != nil {
+		return
+	}
+	data = dataBuf.Bytes()
+	return
+}
+
+// The zstd encoder and decoder can be shared, and are expensive to
+// set up, so only make them once.
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+
+func zstdSetup() {
+	var err error
+	zstdEncoder, err = zstd.NewWriter(nil)
+	if err != nil {
+		panic("Unable to create zstd encoder")
+	}
+	zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecodeAllCapLimit(true))
+	if err != nil {
+		panic("Unable to create zstd decoder")
+	}
+}
+
+func zstdCompress(data []byte) []byte {
+	zstdOnce.Do(zstdSetup)
+	return zstdEncoder.EncodeAll(data, nil)
+}
+
+// The decoder stops at the capacity of the buffer it is given.
+func zstdDecompress(zdata []byte, dataLen uint32) ([]byte, error) {
+	zstdOnce.Do(zstdSetup)
+	return zstdDecoder.DecodeAll(zdata, make([]byte, 0, dataLen))
+}
+
+// Read the codec a pool uses for new chunks from its properties.
+// Pools that predate codecs always use zlib.
+func loadCodec(db *sql.DB, inabilities map[string]bool) (codec Codec, err error) {
+	codec = DefaultCodec
+	if inabilities["codec"] {
+		return
+	}
+
+	var name string
+	err = db.QueryRow("SELECT value FROM props WHERE key = 'codec'").Scan(&name)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	return ParseCodec(name)
+}
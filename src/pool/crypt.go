@@ -0,0 +1,235 @@
+// Encrypted pools.
+
+package pool
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// In an encrypted pool, the chunk payloads are sealed with AES-GCM,
+// and the OIDs are an HMAC of the kind and data, so that the OIDs
+// can't be used to confirm the contents of a file.  Both keys come
+// from a random master key, which is stored in the props table,
+// wrapped with a key derived from the passphrase.  The kinds and
+// sizes of the chunks are not hidden.
+const cryptName = "aes256-gcm+hmac-sha1"
+
+const kdfIterations = 600000
+
+// The props that hold the wrapped master key.
+var keyPropNames = []string{"encryption", "kdf-salt", "kdf-iterations", "wrapped-key"}
+
+type poolKey struct {
+	aead cipher.AEAD
+	mac  []byte
+}
+
+func newPoolKey(master []byte) (key *poolKey, err error) {
+	block, err := aes.NewCipher(master[:32])
+	if err != nil {
+		return
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+
+	key = &poolKey{aead: aead, mac: master[32:]}
+	return
+}
+
+// The keyed equivalent of BlobOID.
+func (key *poolKey) blobOID(kind string, data []byte) (oid *OID) {
+	if len(kind) != 4 {
+		panic("blob kind must be 4 bytes long")
+	}
+	mac := hmac.New(sha1.New, key.mac)
+	io.WriteString(mac, kind)
+	mac.Write(data)
+
+	var result OID
+	mac.Sum(result[:0])
+	return &result
+}
+
+// Seal a chunk payload.  The OID and kind are authenticated along
+// with the payload, so that stored payloads can't be swapped
+// around.
+func (key *poolKey) seal(oid *OID, kind Kind, payload []byte) []byte {
+	nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(payload)+key.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		panic("Unable to generate nonce")
+	}
+	return key.aead.Seal(nonce, nonce, payload, chunkAD(oid, kind))
+}
+
+func (key *poolKey) open(oid *OID, kind Kind, sealed []byte) (payload []byte, err error) {
+	size := key.aead.NonceSize()
+	if len(sealed) < size {
+		err = errors.New("Sealed chunk is too short")
+		return
+	}
+	return key.aead.Open(nil, sealed[:size], sealed[size:], chunkAD(oid, kind))
+}
+
+func chunkAD(oid *OID, kind Kind) []byte {
+	return append(oid[:len(oid):len(oid)], kind.Bytes()...)
+}
+
+// Generate a new master key for a pool, and record it, wrapped, in
+// the pool's properties.
+func createKey(db *sql.DB, passphrase []byte) (err error) {
+	master := make([]byte, 64)
+	_, err = io.ReadFull(rand.Reader, master)
+	if err != nil {
+		return
+	}
+
+	salt := make([]byte, 16)
+	_, err = io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return
+	}
+
+	wrapper, err := wrapKey(passphrase, salt, kdfIterations)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, wrapper.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return
+	}
+	wrapped := wrapper.Seal(nonce, nonce, master, []byte(cryptName))
+
+	return writeKeyProps(db, map[string]string{
+		"encryption":     cryptName,
+		"kdf-salt":       hex.EncodeToString(salt),
+		"kdf-iterations": strconv.Itoa(kdfIterations),
+		"wrapped-key":    hex.EncodeToString(wrapped),
+	})
+}
+
+func writeKeyProps(db *sql.DB, props map[string]string) (err error) {
+	for _, key := range keyPropNames {
+		_, err = db.Exec("insert into props (key, value) values (?, ?)",
+			key, props[key])
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// The props holding the wrapped master key of 'p', or nil if it isn't
+// encrypted.  A pool created with them shares the key, and passphrase,
+// and so computes the same OIDs.
+func PoolKeyProps(p Pool) (props map[string]string, err error) {
+	sp, ok := p.(*SqlPool)
+	if !ok || sp.key == nil {
+		return
+	}
+	props = make(map[string]string)
+	for _, key := range keyPropNames {
+		var value string
+		err = sp.q.QueryRow("SELECT value FROM props WHERE key = ?", key).Scan(&value)
+		if err != nil {
+			return
+		}
+		props[key] = value
+	}
+	return
+}
+
+// Read the pool's key, if it is encrypted.  Returns a nil key for a
+// plain pool.  'passphrase' is called to get the passphrase only if
+// the pool needs one.
+func loadKey(db *sql.DB, path string, passphrase func(path string) ([]byte, error)) (key *poolKey, err error) {
+	var name string
+	err = db.QueryRow("SELECT value FROM props WHERE key = 'encryption'").Scan(&name)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if name != cryptName {
+		err = errors.New("Unsupported pool encryption: " + name)
+		return
+	}
+
+	props := make(map[string]string)
+	for _, k := range []string{"kdf-salt", "kdf-iterations", "wrapped-key"} {
+		var value string
+		err = db.QueryRow("SELECT value FROM props WHERE key = ?", k).Scan(&value)
+		if err != nil {
+			return
+		}
+		props[k] = value
+	}
+
+	salt, err := hex.DecodeString(props["kdf-salt"])
+	if err != nil {
+		return
+	}
+	iterations, err := strconv.Atoi(props["kdf-iterations"])
+	if err != nil {
+		return
+	}
+	wrapped, err := hex.DecodeString(props["wrapped-key"])
+	if err != nil {
+		return
+	}
+
+	if passphrase == nil {
+		err = errors.New("Pool is encrypted, and no passphrase is available")
+		return
+	}
+	pass, err := passphrase(path)
+	if err != nil {
+		return
+	}
+
+	wrapper, err := wrapKey(pass, salt, iterations)
+	if err != nil {
+		return
+	}
+	size := wrapper.NonceSize()
+	if len(wrapped) < size {
+		err = errors.New("Invalid wrapped key in pool")
+		return
+	}
+	master, err := wrapper.Open(nil, wrapped[:size], wrapped[size:], []byte(cryptName))
+	if err != nil {
+		err = errors.New("Incorrect passphrase for pool")
+		return
+	}
+
+	return newPoolKey(master)
+}
+
+// Build the cipher used to wrap the master key.
+func wrapKey(passphrase, salt []byte, iterations int) (aead cipher.AEAD, err error) {
+	kek, err := pbkdf2.Key(sha256.New, string(passphrase), salt, iterations, 32)
+	if err != nil {
+		return
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,689 @@
+// File-based storage pools.
+
+package pool
+
+// Chunks are appended, in the ChunkWrite format, to data files named
+// pool-data-NNNN.data.  Each data file has an index, pool-data-NNNN.idx,
+// written by WriteIndex, which covers the chunks written as of the
+// last flush.  Anything past the indexed size of the last file wasn't
+// flushed, and is discarded when the pool is opened.  A new data file
+// is started when the current one would grow past the pool's limit.
+//
+//	metadata/props.txt    key=value lines: uuid, limit and codec
+//	metadata/backups.txt  OIDs of the backups, one per line
+//	metadata/cache.db     the cache used by dumps
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// Data files are limited to this size unless the pool says otherwise.
+const DefaultFileLimit = 640 * 1024 * 1024
+
+// Offsets in the index are 32 bits.
+const maxFileLimit = 1<<32 - 1
+
+type FilePool struct {
+	base  string
+	uuid  string
+	limit int64
+	codec Codec
+
+	// The data files, the last of which is written to.
+	files []*poolFile
+
+	// The index of the last file, including the chunks written
+	// since the last flush.
+	index RamIndex
+
+	backups      []*OID
+	savedBackups int
+
+	cache   *sql.DB
+	cacheTx *sql.Tx
+
+	lock     *PoolLock
+	mode     LockMode
+	readOnly bool
+
+	// Set from the first write until the flush, while holding the
+	// write lock.
+	writing bool
+}
+
+type poolFile struct {
+	num   int
+	fd    *os.File
+	index IndexBuilder
+	size  int64
+}
+
+// Construct a new, empty, file pool in the directory 'path', which
+// must not exist.  File pools can't be encrypted.
+func CreateFilePool(path string, opts *CreateOptions) (err error) {
+	id := uuid.New()
+	if opts != nil && opts.UUID != "" {
+		id = opts.UUID
+	}
+	props := map[string]string{
+		"uuid":  id,
+		"limit": strconv.FormatInt(DefaultFileLimit, 10),
+	}
+	if opts != nil {
+		if opts.Passphrase != nil || opts.KeyProps != nil {
+			err = errors.New("File pools can't be encrypted")
+			return
+		}
+		if opts.Codec != DefaultCodec {
+			props["codec"] = opts.Codec.String()
+		}
+		if opts.FileLimit != 0 {
+			if opts.FileLimit < 0 || opts.FileLimit > maxFileLimit {
+				err = fmt.Errorf("Invalid data file limit %d", opts.FileLimit)
+				return
+			}
+			props["limit"] = strconv.FormatInt(opts.FileLimit, 10)
+		}
+	}
+
+	err = os.Mkdir(path, 0755)
+	if err != nil {
+		return
+	}
+	err = os.Mkdir(filepath.Join(path, "metadata"), 0755)
+	if err != nil {
+		return
+	}
+	err = writeProps(filepath.Join(path, "metadata", "props.txt"), props)
+	if err != nil {
+		return
+	}
+	return writeOIDFile(filepath.Join(path, "metadata", "backups.txt"), nil)
+}
+
+// Is 'path' laid out as a file pool?
+func isFilePool(path string) bool {
+	fi, err := os.Stat(filepath.Join(path, "metadata", "props.txt"))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// Open the file pool at 'path', for exclusive use.
+func OpenFilePool(path string) (pf Pool, err error) {
+	return openFilePool(path, LockExclusive)
+}
+
+// With LockShared, the pool is opened read-only, and sees the chunks
+// flushed when it was opened.  Unflushed data is left for the writer
+// that may still be adding it.  With LockWriter, the pool catches up
+// with other writers each time it starts writing.
+func openFilePool(path string, mode LockMode) (pf Pool, err error) {
+	pool := &FilePool{base: path, mode: mode, readOnly: mode == LockShared}
+	defer func() {
+		if err != nil {
+			pool.Close()
+		}
+	}()
+
+	pool.lock, err = LockPool(path, mode)
+	if err != nil {
+		return
+	}
+
+	props, err := readProps(pool.metaName("props.txt"))
+	if err != nil {
+		return
+	}
+	pool.uuid = props["uuid"]
+	pool.limit, err = strconv.ParseInt(props["limit"], 10, 64)
+	if err != nil || pool.limit <= 0 || pool.limit > maxFileLimit {
+		err = fmt.Errorf("Invalid data file limit %q in pool", props["limit"])
+		return
+	}
+	pool.codec = DefaultCodec
+	if name, ok := props["codec"]; ok {
+		pool.codec, err = ParseCodec(name)
+		if err != nil {
+			return
+		}
+	}
+
+	if !pool.readOnly {
+		pool.cache, pool.cacheTx, err = openCacheDB(pool.metaName("cache.db"), "")
+		if err != nil {
+			return
+		}
+	}
+
+	if mode == LockExclusive {
+		err = pool.Begin()
+	} else {
+		err = pool.loadFiles()
+	}
+	if err != nil {
+		return
+	}
+
+	pf = pool
+	return
+}
+
+// Catch up with the data files and backups flushed by other writers.
+// The files before the last one already open are complete, and don't
+// change.
+func (pool *FilePool) loadFiles() (err error) {
+	nums, err := pool.dataFiles()
+	if err != nil {
+		return
+	}
+	if len(pool.files) > 0 {
+		last := pool.files[len(pool.files)-1]
+		pool.files = pool.files[:len(pool.files)-1]
+		err = last.fd.Close()
+		if err != nil {
+			return
+		}
+		for len(nums) > 0 && nums[0] < last.num {
+			nums = nums[1:]
+		}
+	}
+	for i, num := range nums {
+		err = pool.openFile(num, i == len(nums)-1)
+		if err != nil {
+			return
+		}
+	}
+
+	pool.backups, err = readOIDFile(pool.metaName("backups.txt"))
+	if err != nil {
+		return
+	}
+	pool.savedBackups = len(pool.backups)
+	return
+}
+
+// Start writing, unless already, waiting for the write lock.  Anything
+// left unflushed by a writer that went away is removed.
+func (pool *FilePool) Begin() (err error) {
+	if pool.readOnly {
+		return errReadOnly
+	}
+	if pool.writing {
+		return
+	}
+	err = pool.lock.BeginWrite()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			pool.lock.EndWrite()
+		}
+	}()
+
+	err = pool.loadFiles()
+	if err != nil {
+		return
+	}
+	err = pool.dropUnflushed()
+	if err != nil {
+		return
+	}
+	if len(pool.files) == 0 {
+		err = pool.newFile(0)
+		if err != nil {
+			return
+		}
+	}
+	pool.writing = true
+	return
+}
+
+func (pool *FilePool) metaName(name string) string {
+	return filepath.Join(pool.base, "metadata", name)
+}
+
+func (pool *FilePool) dataName(num int) string {
+	return filepath.Join(pool.base, fmt.Sprintf("pool-data-%04d.data", num))
+}
+
+func (pool *FilePool) indexName(num int) string {
+	return filepath.Join(pool.base, fmt.Sprintf("pool-data-%04d.idx", num))
+}
+
+// The numbers of the data files in the pool, in order.
+func (pool *FilePool) dataFiles() (nums []int, err error) {
+	names, err := filepath.Glob(filepath.Join(pool.base, "pool-data-*.data"))
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		text := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), "pool-data-"), ".data")
+		num, err := strconv.Atoi(text)
+		if err != nil || num < 0 {
+			continue
+		}
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	return
+}
+
+// Open an existing data file, with its index.  Only the last file may
+// have data past its index, which dropUnflushed removes once the
+// backups are known.
+func (pool *FilePool) openFile(num int, last bool) (err error) {
+	flags := os.O_RDONLY
+	if last && !pool.readOnly {
+		flags = os.O_RDWR
+	}
+	fd, err := os.OpenFile(pool.dataName(num), flags, 0)
+	if err != nil {
+		return
+	}
+	file := &poolFile{num: num, fd: fd}
+	pool.files = append(pool.files, file)
+
+	index, size, err := ReadFileIndex(pool.indexName(num))
+	if err != nil {
+		err = fmt.Errorf("%s (\"godump reindex\" can rebuild it)", err)
+		return
+	}
+	file.index = index
+	file.size = int64(size)
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() < file.size || (fi.Size() > file.size && !last) {
+		err = fmt.Errorf("Index %q doesn't match the size of its data file (\"godump reindex\" can rebuild it)",
+			pool.indexName(num))
+		return
+	}
+
+	if last {
+		pool.index = make(RamIndex)
+		for _, key := range index.GetKeys() {
+			pool.index[key], _ = index.Lookup(&key)
+		}
+		file.index = pool.index
+	}
+	return
+}
+
+// Remove the unflushed data at the end of the last file.  Every
+// backup must be in the indexes: one that isn't means an index is
+// older than the data it should cover, and the data past it may have
+// been flushed.
+func (pool *FilePool) dropUnflushed() (err error) {
+	for _, oid := range pool.backups {
+		if _, _, present := pool.find(oid); !present {
+			err = fmt.Errorf("Backup %s is missing from the pool indexes (\"godump reindex\" can rebuild them)",
+				oid.String())
+			return
+		}
+	}
+	if len(pool.files) == 0 {
+		return
+	}
+	file := pool.files[len(pool.files)-1]
+	fi, err := file.fd.Stat()
+	if err != nil || fi.Size() == file.size {
+		return
+	}
+	return file.fd.Truncate(file.size)
+}
+
+// Start a new data file, with an empty index so that the pool can
+// be opened before it is flushed.  The index is written first, so that
+// another writer opening the pool never finds the file without it.
+func (pool *FilePool) newFile(num int) (err error) {
+	index := make(RamIndex)
+	err = WriteIndex(pool.indexName(num), index, 0)
+	if err != nil {
+		return
+	}
+	fd, err := os.OpenFile(pool.dataName(num), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return
+	}
+	pool.index = index
+	pool.files = append(pool.files, &poolFile{num: num, fd: fd, index: pool.index})
+	return
+}
+
+// Make the chunks written to the last file durable, and write its
+// index.
+func (pool *FilePool) syncLast() (err error) {
+	file := pool.files[len(pool.files)-1]
+	err = file.fd.Sync()
+	if err != nil {
+		return
+	}
+	return WriteIndex(pool.indexName(file.num), pool.index, uint32(file.size))
+}
+
+// Find the file holding the given chunk, and its offset.
+func (pool *FilePool) find(oid *OID) (file *poolFile, offset int64, present bool) {
+	for i := len(pool.files) - 1; i >= 0; i-- {
+		value, ok := pool.files[i].index.Lookup(oid)
+		if ok {
+			return pool.files[i], int64(value.Offset), true
+		}
+	}
+	return
+}
+
+func (pool *FilePool) Insert(chunk Chunk) (err error) {
+	err = pool.Begin()
+	if err != nil {
+		return
+	}
+	if _, _, present := pool.find(chunk.OID()); present {
+		return
+	}
+
+	var buf bytes.Buffer
+	err = ChunkWrite(chunk, &buf)
+	if err != nil {
+		return
+	}
+
+	file := pool.files[len(pool.files)-1]
+	if file.size > 0 && file.size+int64(buf.Len()) > pool.limit {
+		err = pool.syncLast()
+		if err != nil {
+			return
+		}
+		err = pool.newFile(file.num + 1)
+		if err != nil {
+			return
+		}
+		file = pool.files[len(pool.files)-1]
+	}
+	if file.size+int64(buf.Len()) > maxFileLimit {
+		err = fmt.Errorf("Chunk of %d bytes is too large for a data file", buf.Len())
+		return
+	}
+
+	_, err = file.fd.WriteAt(buf.Bytes(), file.size)
+	if err != nil {
+		return
+	}
+	pool.index[*chunk.OID()] = IndexValue{Offset: uint32(file.size), Kind: chunk.Kind().String()}
+	file.size += int64(buf.Len())
+
+	if chunk.Kind() == StringToKind("back") {
+		pool.backups = append(pool.backups, chunk.OID())
+	}
+	return
+}
+
+func (pool *FilePool) Contains(oid *OID) (result bool, err error) {
+	_, _, result = pool.find(oid)
+	return
+}
+
+// Missing chunks give sql.ErrNoRows, as with SQL pools.
+func (pool *FilePool) Search(oid *OID) (chunk Chunk, err error) {
+	file, offset, present := pool.find(oid)
+	if !present {
+		err = sql.ErrNoRows
+		return
+	}
+
+	rd := bufio.NewReader(io.NewSectionReader(file.fd, offset, file.size-offset))
+	chunk, _, err = ChunkRead(rd)
+	if err == nil && chunk.OID().Compare(oid) != 0 {
+		err = fmt.Errorf("Chunk at %d in %q is %s, expecting %s",
+			offset, file.fd.Name(), chunk.OID().String(), oid.String())
+		chunk = nil
+	}
+	return
+}
+
+// Read only the header of the chunk.
+func (pool *FilePool) DataLen(oid *OID) (size uint32, err error) {
+	file, offset, present := pool.find(oid)
+	if !present {
+		err = sql.ErrNoRows
+		return
+	}
+
+	var header chunkHeader
+	err = binary.Read(io.NewSectionReader(file.fd, offset, file.size-offset), binary.LittleEndian, &header)
+	if err != nil {
+		return
+	}
+	if header.Oid.Compare(oid) != 0 {
+		err = fmt.Errorf("Chunk at %d in %q is %s, expecting %s",
+			offset, file.fd.Name(), header.Oid.String(), oid.String())
+		return
+	}
+
+	size = header.DataLen
+	if size == 0xFFFFFFFF {
+		size = header.PayloadLen
+	}
+	return
+}
+
+func (pool *FilePool) ForEachOID(f func(oid *OID) error) (err error) {
+	for _, file := range pool.files {
+		keys := file.index.GetKeys()
+		for i := range keys {
+			err = f(&keys[i])
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (pool *FilePool) Backups() (backups []*OID, err error) {
+	backups = append(backups, pool.backups...)
+	return
+}
+
+// The data is made durable before the index that covers it, and the
+// indexes before the backups list.
+func (pool *FilePool) Flush() (err error) {
+	if !pool.writing {
+		return
+	}
+	err = pool.syncLast()
+	if err != nil {
+		return
+	}
+
+	if len(pool.backups) != pool.savedBackups {
+		err = writeOIDFile(pool.metaName("backups.txt"), pool.backups)
+		if err != nil {
+			return
+		}
+		pool.savedBackups = len(pool.backups)
+	}
+
+	err = pool.cacheTx.Commit()
+	if err != nil {
+		return
+	}
+	pool.cacheTx, err = pool.cache.Begin()
+	if err != nil {
+		return
+	}
+
+	pool.writing = false
+	err = pool.lock.EndWrite()
+	if err == nil && pool.mode == LockExclusive {
+		err = pool.Begin()
+	}
+	return
+}
+
+// Close the pool, discarding anything not flushed.
+func (pool *FilePool) Close() (err error) {
+	if pool.cacheTx != nil {
+		pool.cacheTx.Rollback()
+		pool.cacheTx = nil
+	}
+	if pool.cache != nil {
+		err = pool.cache.Close()
+		pool.cache = nil
+	}
+	for _, file := range pool.files {
+		closeErr := file.fd.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	pool.files = nil
+	if pool.lock != nil {
+		lockErr := pool.lock.Unlock()
+		if err == nil {
+			err = lockErr
+		}
+		pool.lock = nil
+	}
+	return
+}
+
+func (pool *FilePool) Codec() Codec {
+	return pool.codec
+}
+
+// File pools never remove chunks, so the cache is never invalidated.
+func (pool *FilePool) Identity() (id, sweep string, err error) {
+	return pool.uuid, "", nil
+}
+
+// The transaction of the cache database.  Using it is writing, so
+// Begin should be called first, to see any error waiting for the
+// write lock.
+func (pool *FilePool) GetSqlTx() *sql.Tx {
+	if pool.cacheTx == nil {
+		return nil
+	}
+	err := pool.Begin()
+	if err != nil {
+		log.Printf("Unable to write to pool: %s", err)
+		return nil
+	}
+	return pool.cacheTx
+}
+
+// Read a file of key=value lines.
+func readProps(path string) (props map[string]string, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	props = make(map[string]string)
+	for _, line := range strings.Split(string(raw), "\n") {
+		if line == "" {
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			err = fmt.Errorf("Invalid line %q in %q", line, path)
+			return
+		}
+		props[line[:eq]] = line[eq+1:]
+	}
+	return
+}
+
+func writeProps(path string, props map[string]string) error {
+	keys := make([]string, 0, len(props))
+	for key := range props {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%s=%s\n", key, props[key])
+	}
+	return replaceFile(path, buf.Bytes())
+}
+
+func readOIDFile(path string) (oids []*OID, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Fields(string(raw)) {
+		var oid *OID
+		oid, err = ParseOID(line)
+		if err != nil {
+			return
+		}
+		oids = append(oids, oid)
+	}
+	return
+}
+
+func writeOIDFile(path string, oids []*OID) error {
+	var buf bytes.Buffer
+	for _, oid := range oids {
+		fmt.Fprintf(&buf, "%s\n", oid.String())
+	}
+	return replaceFile(path, buf.Bytes())
+}
+
+// Write a file through a temporary name, so that readers see either
+// the old or the new contents.
+func replaceFile(path string, data []byte) (err error) {
+	tmpName := path + ".tmp"
+	fd, err := os.Create(tmpName)
+	if err != nil {
+		return
+	}
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	closeErr := fd.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return
+	}
+	err = os.Rename(tmpName, path)
+	if err != nil {
+		return
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Make the names created or renamed in 'dir' durable.
+func syncDir(dir string) (err error) {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	err = fd.Sync()
+	closeErr := fd.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
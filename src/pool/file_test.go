@@ -0,0 +1,169 @@
+// Test file pools.
+
+package pool_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pool"
+	"tutil"
+)
+
+// A PoolTest holding a file pool, rather than an SQL one.
+func newFilePoolTest(t *testing.T, limit int64) (pt *PoolTest, base string) {
+	pt = &PoolTest{PoolTest: &tutil.PoolTest{T: t, Tmp: tutil.NewTempDir(t)}}
+	t.Setenv("XDG_CACHE_HOME", pt.Tmp.Path()+"/cache")
+
+	base = pt.Tmp.Path() + "/pool"
+	err := pool.CreateFilePool(base, &pool.CreateOptions{Codec: pool.CodecZstd, FileLimit: limit})
+	if err != nil {
+		t.Fatalf("Unable to create pool: '%s'", err)
+	}
+	pt.reopen(base)
+	return
+}
+
+func (pt *PoolTest) reopen(base string) {
+	if pt.Pool != nil {
+		pt.Pool.Close()
+	}
+	var err error
+	pt.Pool, err = pool.OpenPool(base)
+	if err != nil {
+		pt.T.Fatalf("Unable to open pool: '%s'", err)
+	}
+}
+
+func TestFilePool(t *testing.T) {
+	pt, base := newFilePoolTest(t, 64*1024)
+	defer pt.Clean()
+
+	if _, ok := pt.Pool.(*pool.FilePool); !ok {
+		t.Fatalf("OpenPool gave %T, expecting a file pool", pt.Pool)
+	}
+	if pool.PoolCodec(pt.Pool) != pool.CodecZstd {
+		t.Errorf("Pool codec is %v", pool.PoolCodec(pt.Pool))
+	}
+
+	for _, sz := range makeSizes() {
+		pt.Insert(sz)
+		if sz > 16 {
+			pt.InsertRandom(sz)
+		}
+	}
+	pt.Check()
+	back := pool.NewChunk("back", []byte("backup"))
+	err := pt.Pool.Insert(back)
+	if err != nil {
+		t.Fatalf("Error inserting: '%s'", err)
+	}
+	pt.Flush()
+
+	files, _ := filepath.Glob(base + "/pool-data-*.data")
+	indexes, _ := filepath.Glob(base + "/pool-data-*.idx")
+	if len(files) < 2 || len(indexes) != len(files) {
+		t.Errorf("Pool has %d data files and %d indexes", len(files), len(indexes))
+	}
+
+	pt.reopen(base)
+	pt.Check()
+	backups, err := pt.Pool.Backups()
+	if err != nil || len(backups) != 1 || backups[0].Compare(back.OID()) != 0 {
+		t.Errorf("Backups are %v (%v)", backups, err)
+	}
+
+	size, err := pool.ChunkDataLen(pt.Pool, pt.known[5].OID())
+	if err != nil || size != pt.known[5].DataLen() {
+		t.Errorf("Data length is %d (%v), expecting %d", size, err, pt.known[5].DataLen())
+	}
+	_, err = pt.Pool.Search(pool.IntOID(12345))
+	if err != sql.ErrNoRows {
+		t.Errorf("Missing chunk gave %v, expecting sql.ErrNoRows", err)
+	}
+
+	// Chunks not flushed are gone after reopening.
+	extra := pool.MakeRandomChunk(1000)
+	err = pt.Pool.Insert(pool.NewChunk("back", []byte("unflushed")))
+	if err == nil {
+		err = pt.Pool.Insert(extra)
+	}
+	if err != nil {
+		t.Fatalf("Error inserting: '%s'", err)
+	}
+	pt.reopen(base)
+	has, err := pt.Pool.Contains(extra.OID())
+	if err != nil || has {
+		t.Errorf("Unflushed chunk is present after reopening")
+	}
+	backups, _ = pt.Pool.Backups()
+	if len(backups) != 1 {
+		t.Errorf("Unflushed backup is present after reopening")
+	}
+
+	// And can be written again.
+	err = pt.Pool.Insert(extra)
+	if err != nil {
+		t.Fatalf("Error inserting: '%s'", err)
+	}
+	pt.known = append(pt.known, extra)
+	pt.Flush()
+	pt.reopen(base)
+	pt.Check()
+}
+
+// An index older than the backups list must not lose the data after
+// it.
+func TestFilePoolStaleIndex(t *testing.T) {
+	pt, base := newFilePoolTest(t, 0)
+	defer pt.Clean()
+
+	pt.Insert(100)
+	pt.Flush()
+	indexName := base + "/pool-data-0000.idx"
+	old, err := ioutil.ReadFile(indexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	back := pool.NewChunk("back", []byte("backup"))
+	err = pt.Pool.Insert(back)
+	if err != nil {
+		t.Fatalf("Error inserting: '%s'", err)
+	}
+	pt.Flush()
+	pt.Pool.Close()
+	pt.Pool = nil
+
+	dataName := base + "/pool-data-0000.data"
+	before, err := os.Stat(dataName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(indexName, old, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pool.OpenPool(base)
+	if err == nil || !strings.Contains(err.Error(), "reindex") {
+		t.Fatalf("Opening with a stale index gave %v", err)
+	}
+	after, err := os.Stat(dataName)
+	if err != nil || after.Size() != before.Size() {
+		t.Errorf("Data file changed from %d bytes to %d (%v)", before.Size(), after.Size(), err)
+	}
+
+	_, err = pool.ReindexFilePool(base, false)
+	if err != nil {
+		t.Fatalf("Error reindexing: '%s'", err)
+	}
+	pt.reopen(base)
+	has, err := pt.Pool.Contains(back.OID())
+	if err != nil || !has {
+		t.Errorf("Backup missing after reindexing")
+	}
+}
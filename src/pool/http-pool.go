@@ -0,0 +1,192 @@
+// Pools reached over HTTP, from "godump http-serve".
+
+package pool
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The remote protocol over the HTTP API described in http-serve.go.
+type httpConn struct {
+	base    string
+	client  *http.Client
+	session string
+}
+
+// Open the pool served at 'url'.  The URL may include a path, when
+// the server is behind a proxy, and a user and password, which are
+// sent with basic authentication.
+func OpenHttpPool(url string) (pool *RemotePool, err error) {
+	session := make([]byte, 16)
+	_, err = io.ReadFull(rand.Reader, session)
+	if err != nil {
+		return
+	}
+	return openRemote(&httpConn{
+		base:    strings.TrimSuffix(url, "/"),
+		client:  &http.Client{},
+		session: hex.EncodeToString(session),
+	})
+}
+
+// Make a request, returning the response if it succeeded.  A missing
+// chunk gives sql.ErrNoRows.
+func (conn *httpConn) do(method, path string, body []byte, contentType string) (resp *http.Response, err error) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, conn.base+path, rd)
+	if err != nil {
+		return
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(httpSessionHeader, conn.session)
+
+	resp, err = conn.client.Do(req)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == http.StatusOK {
+		return
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && strings.HasPrefix(path, "/chunk/") {
+		err = sql.ErrNoRows
+	} else {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		err = fmt.Errorf("Remote pool: %s: %s", resp.Status, strings.TrimSpace(string(text)))
+	}
+	resp = nil
+	return
+}
+
+// Make a request with an optional JSON body, decoding the JSON reply
+// into 'result'.
+func (conn *httpConn) doJSON(method, path string, args interface{}, result interface{}) (err error) {
+	var body []byte
+	if args != nil {
+		body, err = json.Marshal(args)
+		if err != nil {
+			return
+		}
+	}
+	resp, err := conn.do(method, path, body, "application/json")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+	}
+	return
+}
+
+func (conn *httpConn) hello() (props map[string]string, err error) {
+	err = conn.doJSON("GET", "/", nil, &props)
+	if err != nil {
+		return
+	}
+	if props["version"] != httpVersion {
+		err = fmt.Errorf("Unsupported remote protocol %q, expecting %q", props["version"], httpVersion)
+	}
+	return
+}
+
+func (conn *httpConn) contains(oids []*OID) (present []bool, err error) {
+	err = conn.doJSON("POST", "/has", oidStrings(oids), &present)
+	if err == nil && len(present) != len(oids) {
+		err = fmt.Errorf("Remote pool answered %d of %d OIDs", len(present), len(oids))
+	}
+	return
+}
+
+func (conn *httpConn) insert(chunks []Chunk) (err error) {
+	for _, ch := range chunks {
+		var body bytes.Buffer
+		err = ChunkWrite(ch, &body)
+		if err != nil {
+			return
+		}
+		var resp *http.Response
+		resp, err = conn.do("PUT", "/chunk/"+ch.OID().String(), body.Bytes(), "application/octet-stream")
+		if err != nil {
+			return
+		}
+		drainBody(resp.Body)
+	}
+	return
+}
+
+func (conn *httpConn) search(oid *OID) (chunk Chunk, err error) {
+	resp, err := conn.do("GET", "/chunk/"+oid.String(), nil, "")
+	if err != nil {
+		return
+	}
+	defer drainBody(resp.Body)
+	chunk, _, err = ChunkRead(resp.Body)
+	return
+}
+
+func (conn *httpConn) dataLen(oid *OID) (size uint32, err error) {
+	resp, err := conn.do("HEAD", "/chunk/"+oid.String(), nil, "")
+	if err != nil {
+		return
+	}
+	drainBody(resp.Body)
+	value, err := strconv.ParseUint(resp.Header.Get("X-Godump-Data-Len"), 10, 32)
+	if err != nil {
+		err = fmt.Errorf("Invalid data length from remote pool: %s", err)
+		return
+	}
+	size = uint32(value)
+	return
+}
+
+func (conn *httpConn) backups() (backups []*OID, err error) {
+	var names []string
+	err = conn.doJSON("GET", "/backups", nil, &names)
+	if err != nil {
+		return
+	}
+	backups = make([]*OID, len(names))
+	for i, name := range names {
+		backups[i], err = ParseOID(name)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (conn *httpConn) flush() (err error) {
+	resp, err := conn.do("POST", "/flush", nil, "")
+	if err != nil {
+		return
+	}
+	drainBody(resp.Body)
+	return
+}
+
+func (conn *httpConn) close() error {
+	conn.client.CloseIdleConnections()
+	return nil
+}
+
+// Discard the rest of a body, so that the connection can be reused.
+func drainBody(body io.ReadCloser) {
+	io.Copy(io.Discard, body)
+	body.Close()
+}
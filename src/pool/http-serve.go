@@ -0,0 +1,390 @@
+// Serving a pool over HTTP.
+
+package pool
+
+// OIDs are written in hex.  Chunks are sent in the ChunkWrite format,
+// so compressed chunks are sent as they are stored.
+//
+//	GET  /            -> props, as a JSON object
+//	GET  /backups     -> JSON list of OIDs
+//	POST /has         JSON list of OIDs -> JSON list of booleans
+//	GET  /chunk/OID   -> chunk, or 404
+//	HEAD /chunk/OID   -> data length in X-Godump-Data-Len, or 404
+//	PUT  /chunk/OID   chunk
+//	POST /flush
+//
+// Errors are given as a status, and a text body.  There is no
+// authentication, which is left to a proxy in front of the server.
+//
+// Each client names itself with a random X-Godump-Session header, sent
+// with every request.  The chunks a client PUTs are staged in a
+// temporary file of its own, and only inserted into the pool when that
+// client flushes, so clients can write at the same time without seeing
+// or committing each other's chunks.  Staged chunks are visible to
+// their own client.  A client that goes away without flushing has its
+// chunks discarded once it has been idle for HttpSessionIdle.
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const httpVersion = "godump-http-2"
+
+const httpSessionHeader = "X-Godump-Session"
+
+// How long the chunks a client hasn't flushed are kept after its last
+// request.
+var HttpSessionIdle = 10 * time.Minute
+
+// Limit on the size of a request, and of the lists of OIDs in a has
+// query.
+const (
+	httpMaxBody = remoteMaxFrame
+	httpMaxHas  = 64 * 1024
+)
+
+type httpHandler struct {
+	lock sync.Mutex
+	pool Pool
+
+	// The clients with staged chunks.
+	sessions map[string]*httpSession
+}
+
+// The chunks a client has sent, but not yet flushed.
+type httpSession struct {
+	file    *os.File
+	size    int64
+	chunks  map[OID]int64 // Offset of each chunk in the file.
+	order   []OID
+	backups []*OID
+	seen    time.Time
+}
+
+// An http.Handler serving 'pl'.  Requests are handled one at a time.
+// Chunks are staged in the temporary directory until their client
+// flushes them.
+func NewHttpHandler(pl Pool) http.Handler {
+	return &httpHandler{pool: pl, sessions: make(map[string]*httpSession)}
+}
+
+func (self *httpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.expire(time.Now())
+	req.Body = http.MaxBytesReader(w, req.Body, httpMaxBody)
+	err := self.serve(w, req)
+	switch {
+	case err == nil:
+	case err == sql.ErrNoRows:
+		http.Error(w, "chunk not found", http.StatusNotFound)
+	default:
+		code := http.StatusInternalServerError
+		if he, ok := err.(*httpError); ok {
+			code = he.code
+		}
+		http.Error(w, err.Error(), code)
+	}
+}
+
+// Errors caused by the request, rather than the pool.
+type httpError struct {
+	code int
+	text string
+}
+
+func (self *httpError) Error() string {
+	return self.text
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &httpError{code: http.StatusBadRequest, text: fmt.Sprintf(format, args...)}
+}
+
+func (self *httpHandler) serve(w http.ResponseWriter, req *http.Request) (err error) {
+	path := req.URL.Path
+	method := req.Method
+
+	switch {
+	case path == "/" && method == "GET":
+		var props map[string]string
+		props, err = remoteProps(self.pool)
+		if err != nil {
+			return
+		}
+		props["version"] = httpVersion
+		return writeJSON(w, props)
+
+	case path == "/backups" && method == "GET":
+		var backups []*OID
+		backups, err = self.pool.Backups()
+		if err != nil {
+			return
+		}
+		if sess := self.sessions[req.Header.Get(httpSessionHeader)]; sess != nil {
+			backups = append(backups, sess.backups...)
+		}
+		return writeJSON(w, oidStrings(backups))
+
+	case path == "/has" && method == "POST":
+		var names []string
+		err = json.NewDecoder(req.Body).Decode(&names)
+		if err != nil {
+			return badRequest("Invalid has query: %s", err)
+		}
+		if len(names) > httpMaxHas {
+			return badRequest("Too many OIDs in has query: %d", len(names))
+		}
+		present := make([]bool, len(names))
+		for i, name := range names {
+			var oid *OID
+			oid, err = ParseOID(name)
+			if err != nil {
+				return badRequest("Invalid OID %q", name)
+			}
+			present[i] = self.staged(req, oid) != nil
+			if !present[i] {
+				present[i], err = self.pool.Contains(oid)
+				if err != nil {
+					return
+				}
+			}
+		}
+		return writeJSON(w, present)
+
+	case path == "/flush" && method == "POST":
+		var session string
+		session, err = self.session(req)
+		if err != nil {
+			return
+		}
+		return self.flush(session)
+
+	case strings.HasPrefix(path, "/chunk/"):
+		var oid *OID
+		oid, err = ParseOID(strings.TrimPrefix(path, "/chunk/"))
+		if err != nil {
+			return badRequest("Invalid OID in %q", path)
+		}
+		return self.serveChunk(w, req, oid)
+	}
+
+	return &httpError{code: http.StatusNotFound, text: fmt.Sprintf("No %s %s", method, path)}
+}
+
+func (self *httpHandler) serveChunk(w http.ResponseWriter, req *http.Request, oid *OID) (err error) {
+	switch req.Method {
+	case "GET":
+		var ch Chunk
+		if sess := self.staged(req, oid); sess != nil {
+			ch, err = sess.read(oid)
+		} else {
+			ch, err = self.pool.Search(oid)
+		}
+		if err != nil {
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		return ChunkWrite(ch, w)
+
+	case "HEAD":
+		var size uint32
+		if sess := self.staged(req, oid); sess != nil {
+			var ch Chunk
+			ch, err = sess.read(oid)
+			if err == nil {
+				size = ch.DataLen()
+			}
+		} else {
+			size, err = ChunkDataLen(self.pool, oid)
+		}
+		if err != nil {
+			return
+		}
+		w.Header().Set("X-Godump-Data-Len", fmt.Sprintf("%d", size))
+		return
+
+	case "PUT":
+		var ch Chunk
+		ch, _, err = ChunkRead(req.Body)
+		if err != nil {
+			return badRequest("Invalid chunk: %s", err)
+		}
+
+		// Clients may not be trusted, so check that the data
+		// matches the OID.
+		if ch.OID().Compare(oid) != 0 {
+			return badRequest("Chunk %s sent as %s", ch.OID().String(), oid.String())
+		}
+		err = VerifyChunk(self.pool, ch)
+		if err != nil {
+			return badRequest("%s", err)
+		}
+
+		var session string
+		session, err = self.session(req)
+		if err != nil {
+			return
+		}
+		sess := self.sessions[session]
+		if sess == nil {
+			sess, err = newHttpSession()
+			if err != nil {
+				return
+			}
+			self.sessions[session] = sess
+		}
+		sess.seen = time.Now()
+		return sess.write(ch)
+	}
+
+	w.Header().Set("Allow", "GET, HEAD, PUT")
+	return &httpError{code: http.StatusMethodNotAllowed, text: fmt.Sprintf("Method %s not allowed", req.Method)}
+}
+
+// Insert the chunks staged by 'session' into the pool, and commit them.
+func (self *httpHandler) flush(session string) (err error) {
+	sess := self.sessions[session]
+	if sess == nil {
+		// Nothing of this client's to commit.
+		return
+	}
+	delete(self.sessions, session)
+	defer sess.file.Close()
+
+	for _, oid := range sess.order {
+		var has bool
+		has, err = self.pool.Contains(&oid)
+		if err != nil {
+			return
+		}
+		if has {
+			continue
+		}
+		var ch Chunk
+		ch, err = sess.read(&oid)
+		if err != nil {
+			return
+		}
+		err = self.pool.Insert(ch)
+		if err != nil {
+			return
+		}
+	}
+	return self.pool.Flush()
+}
+
+// Discard the chunks of clients that have gone away.
+func (self *httpHandler) expire(now time.Time) {
+	for session, sess := range self.sessions {
+		if now.Sub(sess.seen) >= HttpSessionIdle {
+			log.Printf("Discarding %d unflushed chunks from an idle client", len(sess.order))
+			sess.file.Close()
+			delete(self.sessions, session)
+		}
+	}
+}
+
+// The session of the request, if it has staged the given chunk.
+func (self *httpHandler) staged(req *http.Request, oid *OID) *httpSession {
+	sess := self.sessions[req.Header.Get(httpSessionHeader)]
+	if sess == nil {
+		return nil
+	}
+	if _, ok := sess.chunks[*oid]; !ok {
+		return nil
+	}
+	return sess
+}
+
+// The staging file is removed at once, so that it goes away with the
+// server, however it stops.
+func newHttpSession() (sess *httpSession, err error) {
+	file, err := ioutil.TempFile("", "godump-session-")
+	if err != nil {
+		return
+	}
+	err = os.Remove(file.Name())
+	if err != nil {
+		file.Close()
+		return
+	}
+	sess = &httpSession{file: file, chunks: make(map[OID]int64)}
+	return
+}
+
+func (self *httpSession) write(ch Chunk) (err error) {
+	oid := *ch.OID()
+	if _, ok := self.chunks[oid]; ok {
+		return
+	}
+	// Only ever appended to, as reads don't move the offset.
+	buf := bufio.NewWriter(self.file)
+	counter := &countingWriter{w: buf}
+	err = ChunkWrite(ch, counter)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		return
+	}
+	self.chunks[oid] = self.size
+	self.order = append(self.order, oid)
+	if ch.Kind() == StringToKind("back") {
+		self.backups = append(self.backups, ch.OID())
+	}
+	self.size += counter.n
+	return
+}
+
+func (self *httpSession) read(oid *OID) (ch Chunk, err error) {
+	rd := io.NewSectionReader(self.file, self.chunks[*oid], math.MaxInt64)
+	ch, _, err = ChunkRead(bufio.NewReader(rd))
+	return
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (self *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = self.w.Write(p)
+	self.n += int64(n)
+	return
+}
+
+// The session named by the request.
+func (self *httpHandler) session(req *http.Request) (session string, err error) {
+	session = req.Header.Get(httpSessionHeader)
+	if session == "" {
+		err = badRequest("Missing %s header", httpSessionHeader)
+	}
+	return
+}
+
+func writeJSON(w http.ResponseWriter, item interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(item)
+}
+
+func oidStrings(oids []*OID) (names []string) {
+	names = make([]string, len(oids))
+	for i, oid := range oids {
+		names[i] = oid.String()
+	}
+	return
+}
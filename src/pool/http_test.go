@@ -0,0 +1,211 @@
+// Test pools served over HTTP.
+
+package pool_test
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"pool"
+)
+
+func TestHttp(t *testing.T) {
+	pt := NewPoolTest(t)
+	defer pt.Clean()
+	t.Setenv("XDG_CACHE_HOME", pt.Tmp.Path()+"/cache")
+
+	// Stand in for an authenticating proxy.
+	handler := pool.NewHttpHandler(pt.Pool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != "backup" || pass != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.StripPrefix("/pool", handler).ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	url := strings.Replace(srv.URL, "http://", "http://backup:secret@", 1) + "/pool/"
+
+	_, err := pool.OpenPool(srv.URL + "/pool")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Opening without credentials gave %v", err)
+	}
+
+	local := pt.Pool
+	remote, err := pool.OpenPool(url)
+	if err != nil {
+		t.Fatalf("Unable to open pool: '%s'", err)
+	}
+
+	pt.Pool = remote
+	for _, sz := range makeSizes() {
+		pt.Insert(sz)
+		if sz > 16 {
+			pt.InsertRandom(sz)
+		}
+	}
+	pt.Check()
+	pt.Flush()
+	pt.Check()
+	pt.Pool = local
+	pt.Check()
+
+	back := pool.NewChunk("back", []byte("backup"))
+	err = remote.Insert(back)
+	if err != nil {
+		t.Fatalf("Error inserting: '%s'", err)
+	}
+	backups, err := remote.Backups()
+	if err != nil || len(backups) != 1 || backups[0].Compare(back.OID()) != 0 {
+		t.Errorf("Remote backups are %v (%v)", backups, err)
+	}
+
+	_, err = remote.Search(pool.IntOID(12345))
+	if err != sql.ErrNoRows {
+		t.Errorf("Missing chunk gave %v, expecting sql.ErrNoRows", err)
+	}
+	_, err = pool.ChunkDataLen(remote, pool.IntOID(12345))
+	if err != sql.ErrNoRows {
+		t.Errorf("Missing chunk length gave %v, expecting sql.ErrNoRows", err)
+	}
+
+	size, err := pool.ChunkDataLen(remote, pt.known[3].OID())
+	if err != nil || size != pt.known[3].DataLen() {
+		t.Errorf("Remote data length is %d (%v), expecting %d", size, err, pt.known[3].DataLen())
+	}
+
+	err = remote.Close()
+	if err != nil {
+		t.Errorf("Error closing remote pool: '%s'", err)
+	}
+
+	// Chunks whose data doesn't match their OID are refused.
+	var body bytes.Buffer
+	err = pool.ChunkWrite(pool.NewChunk("blob", []byte("forged")), &body)
+	if err != nil {
+		t.Fatalf("Error encoding chunk: '%s'", err)
+	}
+	other := pool.NewChunk("blob", []byte("genuine")).OID()
+	req, _ := http.NewRequest("PUT", url+"chunk/"+other.String(), &body)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending chunk: '%s'", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Forged chunk gave status %d", resp.StatusCode)
+	}
+	has, err := local.Contains(other)
+	if err != nil || has {
+		t.Errorf("Forged chunk was stored")
+	}
+}
+
+func TestHttpWriters(t *testing.T) {
+	pt := NewPoolTest(t)
+	defer pt.Clean()
+
+	counted := &flushCounter{Pool: pt.Pool}
+	srv := httptest.NewServer(pool.NewHttpHandler(counted))
+	defer srv.Close()
+
+	send := func(method, path, session string, ch pool.Chunk) int {
+		var body bytes.Buffer
+		if ch != nil {
+			err := pool.ChunkWrite(ch, &body)
+			if err != nil {
+				t.Fatalf("Error encoding chunk: '%s'", err)
+			}
+		}
+		req, _ := http.NewRequest(method, srv.URL+path, &body)
+		if session != "" {
+			req.Header.Set("X-Godump-Session", session)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending %s %s: '%s'", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	put := func(session, text string) (pool.Chunk, int) {
+		ch := pool.NewChunk("blob", []byte(text))
+		return ch, send("PUT", "/chunk/"+ch.OID().String(), session, ch)
+	}
+	if _, code := put("", "anonymous"); code != http.StatusBadRequest {
+		t.Errorf("Chunk without a session gave status %d", code)
+	}
+
+	// Clients write at the same time, and each flush commits only
+	// that client's chunks, which are visible to it until then.
+	first, code := put("a", "first")
+	if code != http.StatusOK {
+		t.Fatalf("First client's chunk gave status %d", code)
+	}
+	second, code := put("b", "second")
+	if code != http.StatusOK {
+		t.Fatalf("Second client's chunk gave status %d", code)
+	}
+	if code = send("GET", "/chunk/"+first.OID().String(), "a", nil); code != http.StatusOK {
+		t.Errorf("First client reading its chunk gave status %d", code)
+	}
+	if code = send("GET", "/chunk/"+first.OID().String(), "b", nil); code != http.StatusNotFound {
+		t.Errorf("Second client reading the first's chunk gave status %d", code)
+	}
+
+	inPool := func(ch pool.Chunk) bool {
+		has, err := pt.Pool.Contains(ch.OID())
+		if err != nil {
+			t.Fatalf("Error checking pool: '%s'", err)
+		}
+		return has
+	}
+	if code = send("POST", "/flush", "b", nil); code != http.StatusOK || counted.flushes != 1 {
+		t.Errorf("Second client's flush gave status %d, and %d flushes", code, counted.flushes)
+	}
+	if !inPool(second) || inPool(first) {
+		t.Errorf("Second client's flush committed the wrong chunks")
+	}
+	if code = send("POST", "/flush", "a", nil); code != http.StatusOK || counted.flushes != 2 {
+		t.Errorf("First client's flush gave status %d, and %d flushes", code, counted.flushes)
+	}
+	if !inPool(first) {
+		t.Errorf("First client's chunk missing after its flush")
+	}
+
+	// A client that goes away has its chunks discarded.
+	defer func(idle time.Duration) {
+		pool.HttpSessionIdle = idle
+	}(pool.HttpSessionIdle)
+	pool.HttpSessionIdle = 50 * time.Millisecond
+	lost, code := put("c", "abandoned")
+	if code != http.StatusOK {
+		t.Fatalf("Third client's chunk gave status %d", code)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, code = put("a", "later"); code != http.StatusOK {
+		t.Errorf("First client's later chunk gave status %d", code)
+	}
+	if code = send("POST", "/flush", "a", nil); code != http.StatusOK {
+		t.Errorf("First client's later flush gave status %d", code)
+	}
+	if inPool(lost) {
+		t.Errorf("Abandoned chunk was committed")
+	}
+}
+
+type flushCounter struct {
+	pool.Pool
+	flushes int
+}
+
+func (self *flushCounter) Flush() error {
+	self.flushes++
+	return self.Pool.Flush()
+}
@@ -5,7 +5,9 @@ package pool
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 )
 
@@ -38,25 +40,35 @@ func (ri RamIndex) Lookup(key *OID) (value IndexValue, present bool) {
 
 // WriteIndex exports the given index to a file.  The index file also
 // records a size.  This can be used when reading the index back to
-// make sure that it completely covers a given pool file.
+// make sure that it completely covers a given pool file.  The index
+// is durable once this returns.
 func WriteIndex(path string, ri IndexBuilder, size uint32) (err error) {
-
 	tmpName := path + ".tmp"
 	fd, err := os.Create(tmpName)
-	success := false
-	defer func() {
-		fd.Close()
-		if success {
-			os.Rename(tmpName, path)
-		} else {
-			os.Remove(tmpName)
-		}
-	}()
 	if err != nil {
 		return
 	}
+	err = writeIndexParts(fd, ri, size)
+	if err == nil {
+		err = fd.Sync()
+	}
+	closeErr := fd.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return
+	}
+	err = os.Rename(tmpName, path)
+	if err != nil {
+		return
+	}
+	return syncDir(filepath.Dir(path))
+}
 
-	// Construct and write out the various parts.
+// Construct and write out the various parts.
+func writeIndexParts(fd *os.File, ri IndexBuilder, size uint32) (err error) {
 	err = writeHeader(fd, size)
 	if err != nil {
 		return
@@ -81,11 +93,6 @@ func WriteIndex(path string, ri IndexBuilder, size uint32) (err error) {
 	}
 
 	err = writeKinds(fd, keys, ri)
-	if err != nil {
-		return
-	}
-
-	success = true
 	return
 }
 
@@ -240,165 +247,140 @@ func makeKind(i int) string {
 	return kinds[i%len(kinds)]
 }
 
-/*
-import (
-	"bytes"
-	"io"
-	"os"
-)
-
-// Reads the index file written by MemoryIndex.writeIndex
-
+// Reads the index file written by WriteIndex.  The whole index is
+// held in memory.
 type FileIndex struct {
 	top     []byte
 	oids    []byte
 	offsets []byte
+	kindIDs []byte
+	kinds   []string
 }
 
-func (fi *FileIndex) GetTop(i int) uint32 {
-	tmp := i << 2
-	return readLE32(fi.top[tmp : tmp+4])
-}
-
-func (fi *FileIndex) GetOID(i int) []byte {
-	tmp := i * 20
-	return fi.oids[tmp : tmp+20]
-}
-
-func (fi *FileIndex) GetOffset(i int) uint32 {
-	tmp := i << 2
-	return readLE32(fi.offsets[tmp : tmp+4])
-}
-
-func (fi *FileIndex) Lookup(oid OID) (offset uint32, present bool) {
-	rawOid := []byte(oid)
-	low := 0
-	topByte := int(rawOid[0])
-	if topByte > 0 {
-		low = int(fi.GetTop(topByte - 1))
-	}
-	high := int(fi.GetTop(topByte)) - 1
-
-	// Binary search.
-	for high >= low {
-		mid := low + ((high - low) >> 1)
-		v := bytes.Compare(fi.GetOID(mid), rawOid)
-		switch {
-		case v > 0:
-			high = mid - 1
-		case v < 0:
-			low = mid + 1
-		default:
-			offset = fi.GetOffset(mid)
-			present = true
-			return
-		}
-	}
-	return
-}
-
-func (fi *FileIndex) Len() int {
-	return int(fi.GetTop(255))
-}
-
-func (fi *FileIndex) ForEach(f func(oid OID, offset uint32)) {
-	panic("Not implemented")
-}
-
-var bigEndian = false
-
-func toLittle(value uint32) uint32 {
-	if bigEndian {
-		return ((value >> 24) |
-			((value >> 16) & 0xFF00) |
-			((value & 0xFF00) << 16) |
-			((value & 0xFF) << 24))
-	}
-	return value
-}
-
-// TODO: Handling these better?
+// An error in the contents of an index file.
 type IndexError string
 
-func (e IndexError) String() string {
+func (e IndexError) Error() string {
 	return "Index error: " + string(e)
 }
 
-func readFileIndex(path string, poolSize uint32) (index *FileIndex, err os.Error) {
-	fd, err := os.Open(path, os.O_RDONLY, 0)
+// Read the index file at 'path'.  Also returns the size of the pool
+// file it was written for.
+func ReadFileIndex(path string) (index *FileIndex, size uint32, err error) {
+	raw, err := ioutil.ReadFile(path)
 	if err != nil {
 		return
 	}
-	defer fd.Close()
 
-	rawHeader := make([]byte, 16)
-	_, err = io.ReadFull(fd, rawHeader)
-	if err != nil {
+	take := func(length int) (piece []byte) {
+		if err != nil {
+			return
+		}
+		if length > len(raw) {
+			err = IndexError(fmt.Sprintf("%s is truncated", path))
+			return
+		}
+		piece, raw = raw[:length], raw[length:]
 		return
 	}
 
-	if string(rawHeader[0:8]) != "ldumpidx" {
-		err = IndexError("Invalid magic header")
+	header := take(16)
+	if err != nil {
 		return
 	}
-
-	if readLE32(rawHeader[8:12]) != 2 {
-		err = IndexError("Unsupported index version")
+	if string(header[0:8]) != indexMagic {
+		err = IndexError(fmt.Sprintf("%s has an invalid magic header", path))
 		return
 	}
-
-	if readLE32(rawHeader[12:16]) != poolSize {
-		err = IndexError("Index mismatch with pool file size")
+	if readLE32(header[8:12]) != indexVersion {
+		err = IndexError(fmt.Sprintf("%s has unsupported version %d", path, readLE32(header[8:12])))
 		return
 	}
+	size = readLE32(header[12:16])
 
 	var result FileIndex
-	result.top = make([]byte, 1024)
-	_, err = io.ReadFull(fd, result.top)
+	result.top = take(1024)
 	if err != nil {
 		return
 	}
+	// Lookup relies on the table being in order.
+	for i := 1; i < 256; i++ {
+		if result.getTop(i) < result.getTop(i-1) {
+			err = IndexError(fmt.Sprintf("%s has an invalid top table", path))
+			return
+		}
+	}
+	count := int(result.getTop(255))
+	result.oids = take(OIDLen * count)
+	result.offsets = take(4 * count)
 
-	size := int(result.GetTop(255))
-
-	result.oids = make([]byte, 20*size)
-	_, err = io.ReadFull(fd, result.oids)
+	kindCount := take(4)
 	if err != nil {
 		return
 	}
-
-	result.offsets = make([]byte, 4*size)
-	_, err = io.ReadFull(fd, result.offsets)
+	for i := uint32(0); i < readLE32(kindCount) && err == nil; i++ {
+		result.kinds = append(result.kinds, string(take(4)))
+	}
+	result.kindIDs = take(count)
 	if err != nil {
 		return
 	}
+	if len(raw) != 0 {
+		err = IndexError(fmt.Sprintf("%s has extra data", path))
+		return
+	}
+	for _, id := range result.kindIDs {
+		if int(id) >= len(result.kinds) {
+			err = IndexError(fmt.Sprintf("%s has an invalid kind", path))
+			return
+		}
+	}
 
 	index = &result
 	return
 }
 
-func indexFileMain() {
-	table, err := readFileIndex("test.idx", 0x12345678)
-	if err != nil {
-		panic(err)
+func (fi *FileIndex) getTop(i int) uint32 {
+	return readLE32(fi.top[4*i : 4*i+4])
+}
+
+func (fi *FileIndex) getOID(i int) []byte {
+	return fi.oids[OIDLen*i : OIDLen*i+OIDLen]
+}
+
+func (fi *FileIndex) Lookup(key *OID) (value IndexValue, present bool) {
+	low := 0
+	first := int(key[0])
+	if first > 0 {
+		low = int(fi.getTop(first - 1))
 	}
+	high := int(fi.getTop(first)) - 1
 
-	const limit = 1000000
-	for i := 0; i < limit; i++ {
-		oid := intHash(i)
-		index, present := table.Lookup(oid)
-		if !present {
-			panic("Missing")
-		}
-		if int(index) != i {
-			panic("Wrong")
+	for high >= low {
+		mid := low + ((high - low) >> 1)
+		switch v := bytes.Compare(fi.getOID(mid), key[:]); {
+		case v > 0:
+			high = mid - 1
+		case v < 0:
+			low = mid + 1
+		default:
+			value.Offset = readLE32(fi.offsets[4*mid : 4*mid+4])
+			value.Kind = fi.kinds[fi.kindIDs[mid]]
+			present = true
+			return
 		}
+	}
+	return
+}
 
-		oid[19] ^= 1
-		_, present = table.Lookup(oid)
-		if present {
-			panic("Present")
-		}
+func (fi *FileIndex) Len() int {
+	return int(fi.getTop(255))
+}
+
+func (fi *FileIndex) GetKeys() (keys []OID) {
+	keys = make([]OID, fi.Len())
+	for i := range keys {
+		copy(keys[i][:], fi.getOID(i))
 	}
+	return
 }
-*/
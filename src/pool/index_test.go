@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"testing"
 
 	"pool"
@@ -15,6 +16,50 @@ func TestIndexBase(t *testing.T) {
 	defer tmp.Clean()
 }
 
+// Damaged index files are refused, rather than read.
+func TestIndexDamaged(t *testing.T) {
+	tmp := tutil.NewTempDir(t)
+	defer tmp.Clean()
+
+	const count = 100
+	ri := make(pool.RamIndex)
+	for i := 0; i < count; i++ {
+		ri[*pool.IntOID(i)] = pool.IndexValue{Offset: uint32(i), Kind: "blob"}
+	}
+	path := tmp.Path() + "/index"
+	err := pool.WriteIndex(path, ri, count)
+	if err != nil {
+		t.Fatalf("Error writing index: '%s'", err)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, size, err := pool.ReadFileIndex(path)
+	if err != nil || size != count || index.Len() != count {
+		t.Fatalf("Index read back with %v entries, size %d: %v", index, size, err)
+	}
+
+	damage := func(name string, offset int, value uint32) {
+		bad := append([]byte(nil), raw...)
+		binary.LittleEndian.PutUint32(bad[offset:], value)
+		err := ioutil.WriteFile(path, bad, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = pool.ReadFileIndex(path)
+		if _, ok := err.(pool.IndexError); !ok {
+			t.Errorf("Index with %s gave %v, expecting an IndexError", name, err)
+		}
+	}
+
+	// The top table starts after the 16 byte header, and the kind
+	// table follows the OIDs and offsets.
+	damage("a top entry past the count", 16+4*10, count+50)
+	damage("a decreasing top entry", 16+4*200, 1)
+	damage("a huge kind count", 16+1024+(pool.OIDLen+4)*count, 0xFFFFFFFF)
+}
+
 type IndexInfo struct {
 	offset uint32
 	kind   pool.Kind
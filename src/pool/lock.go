@@ -0,0 +1,318 @@
+// Locking pools against use by other processes.
+
+package pool
+
+// Each pool has a directory, locks, holding two files that are locked
+// with flock, and a file for each process using the pool, describing
+// it, so that a conflict can say who holds the pool.
+//
+//	locks/pool               shared, or exclusive for LockExclusive
+//	locks/write              exclusive, for a writer in a transaction
+//	locks/holder-HOST-PID-N  key=value lines: pid, host, mode, command,
+//	                         since, writing while in a transaction, and
+//	                         waiting while waiting for one
+//
+// The flocks are released by the kernel when a process dies, so a
+// holder file without a live process behind it is only a leftover.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// How a pool is shared with other processes.
+type LockMode int
+
+const (
+	// The only user of the pool.  For commands that remove or
+	// rewrite data.
+	LockExclusive LockMode = iota
+
+	// Reading, alongside other readers and writers.  The pool is
+	// opened read-only.
+	LockShared
+
+	// Adding to the pool, such as by a dump, alongside readers and
+	// other writers.  Writers take turns a transaction at a time:
+	// from its first write until it flushes, a writer holds the
+	// write lock, which the others wait for.
+	LockWriter
+)
+
+var lockModeNames = []string{"exclusive", "shared", "writer"}
+
+func (mode LockMode) String() string {
+	if mode < 0 || int(mode) >= len(lockModeNames) {
+		return fmt.Sprintf("LockMode(%d)", int(mode))
+	}
+	return lockModeNames[mode]
+}
+
+// A lock held on a pool.
+type PoolLock struct {
+	base   string
+	dir    string
+	mode   LockMode
+	pool   *os.File
+	write  *os.File
+	holder string
+	props  map[string]string
+}
+
+// The pool is in use in a way that conflicts with the lock asked for.
+type LockError struct {
+	Base string
+
+	// Descriptions of the processes holding the pool, such as "pid
+	// 12 on host alpha (godump dump ...)".  May be empty when they
+	// can't be determined.
+	Holders []string
+}
+
+func (self *LockError) Error() string {
+	if len(self.Holders) == 0 {
+		return fmt.Sprintf("Pool %q is in use by another process", self.Base)
+	}
+	return fmt.Sprintf("Pool %q is in use by %s", self.Base, strings.Join(self.Holders, ", "))
+}
+
+var errReadOnly = errors.New("Pool is open read-only")
+
+// How long a writer waits for the write lock, before giving up with a
+// *LockError.
+var WriteLockTimeout = 10 * time.Minute
+
+// Lock the pool in the directory 'base'.  A conflict with the lock
+// held by another process gives a *LockError.  Writers also need
+// BeginWrite before changing the pool.
+func LockPool(base string, mode LockMode) (lock *PoolLock, err error) {
+	self := &PoolLock{base: base, dir: filepath.Join(base, "locks"), mode: mode}
+	defer func() {
+		if err != nil {
+			self.Unlock()
+		}
+	}()
+
+	err = os.MkdirAll(self.dir, 0755)
+	if err == nil {
+		self.pool, err = os.OpenFile(filepath.Join(self.dir, "pool"), os.O_RDWR|os.O_CREATE, 0644)
+	}
+	if err != nil && mode == LockShared {
+		// Readers of a pool on read-only storage, which can't
+		// be written by anyone, lock it if they can.
+		self.pool, err = os.Open(filepath.Join(self.dir, "pool"))
+		if err != nil {
+			self.pool = nil
+			lock, err = self, nil
+			return
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	how := syscall.LOCK_SH
+	if mode == LockExclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(self.pool.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		err = &LockError{Base: base, Holders: self.holders(func(props map[string]string) bool {
+			return mode == LockExclusive || props["mode"] == LockExclusive.String()
+		})}
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	// Holding the pool exclusively, any other holder files are
+	// leftovers.
+	if mode == LockExclusive {
+		self.removeHolders()
+	}
+
+	err = self.writeHolder(mode)
+	if err != nil && mode == LockShared {
+		// Without a holder file, a conflict can only say that
+		// the pool is in use.
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	lock = self
+	return
+}
+
+// How often a waiting writer tries the write lock again.
+const writeLockPoll = 100 * time.Millisecond
+
+// Start a transaction, taking the write lock, and waiting up to
+// WriteLockTimeout for another writer to flush.  Writers that are
+// already waiting go first, so that one flushing regularly lets the
+// others have turns.  An exclusive lock already keeps other writers
+// out.
+func (self *PoolLock) BeginWrite() (err error) {
+	if self.mode != LockWriter || self.write != nil {
+		return
+	}
+	write, err := os.OpenFile(filepath.Join(self.dir, "write"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			write.Close()
+		}
+	}()
+
+	others := func(key string) []string {
+		return self.holders(func(props map[string]string) bool {
+			return props[key] != ""
+		})
+	}
+	if len(others("waiting")) > 0 {
+		time.Sleep(2 * writeLockPoll)
+	}
+
+	deadline := time.Now().Add(WriteLockTimeout)
+	for waited := false; ; waited = true {
+		err = syscall.Flock(int(write.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			break
+		}
+		if time.Now().After(deadline) {
+			err = &LockError{Base: self.base, Holders: others("writing")}
+			self.setHolder("waiting", false)
+			return
+		}
+		if !waited {
+			log.Printf("Waiting for another writer to %q to finish: %s", self.base, strings.Join(others("writing"), ", "))
+			self.setHolder("waiting", true)
+		}
+		time.Sleep(writeLockPoll)
+	}
+	if err != nil {
+		return
+	}
+
+	self.write = write
+	delete(self.props, "waiting")
+	return self.setHolder("writing", true)
+}
+
+// Set or clear the given time in the holder file.
+func (self *PoolLock) setHolder(key string, set bool) error {
+	if self.holder == "" {
+		return nil
+	}
+	if set {
+		self.props[key] = time.Now().Format(time.RFC3339)
+	} else {
+		delete(self.props, key)
+	}
+	return writeProps(self.holder, self.props)
+}
+
+// End the transaction, letting other writers have their turn.
+func (self *PoolLock) EndWrite() (err error) {
+	if self.write == nil {
+		return
+	}
+	err = self.setHolder("writing", false)
+	closeErr := self.write.Close()
+	if err == nil {
+		err = closeErr
+	}
+	self.write = nil
+	return
+}
+
+// Release the lock.
+func (self *PoolLock) Unlock() (err error) {
+	if self.holder != "" {
+		err = os.Remove(self.holder)
+		self.holder = ""
+	}
+	for _, fd := range []*os.File{self.write, self.pool} {
+		if fd == nil {
+			continue
+		}
+		closeErr := fd.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	self.write, self.pool = nil, nil
+	return
+}
+
+// Counts the locks taken by this process, so that each has its own
+// holder file.
+var lockSequence int64
+
+func (self *PoolLock) writeHolder(mode LockMode) (err error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return
+	}
+	pid := os.Getpid()
+	seq := atomic.AddInt64(&lockSequence, 1)
+	name := filepath.Join(self.dir, fmt.Sprintf("holder-%s-%d-%d", host, pid, seq))
+	props := map[string]string{
+		"pid":     strconv.Itoa(pid),
+		"host":    host,
+		"mode":    mode.String(),
+		"command": strings.Join(os.Args, " "),
+		"since":   time.Now().Format(time.RFC3339),
+	}
+	err = writeProps(name, props)
+	if err == nil {
+		self.holder = name
+		self.props = props
+	}
+	return
+}
+
+// Describe the other processes holding the pool whose holder file
+// satisfies 'want'.  Holders on this host whose process has gone are
+// skipped.
+func (self *PoolLock) holders(want func(props map[string]string) bool) (result []string) {
+	names, _ := filepath.Glob(filepath.Join(self.dir, "holder-*"))
+	host, _ := os.Hostname()
+	for _, name := range names {
+		if name == self.holder || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		props, err := readProps(name)
+		if err != nil || !want(props) {
+			continue
+		}
+		pid, err := strconv.Atoi(props["pid"])
+		if err != nil {
+			continue
+		}
+		if props["host"] == host && syscall.Kill(pid, 0) == syscall.ESRCH {
+			continue
+		}
+		result = append(result, fmt.Sprintf("pid %d on host %s (%s)", pid, props["host"], props["command"]))
+	}
+	return
+}
+
+func (self *PoolLock) removeHolders() {
+	names, _ := filepath.Glob(filepath.Join(self.dir, "holder-*"))
+	for _, name := range names {
+		os.Remove(name)
+	}
+}
@@ -0,0 +1,185 @@
+// Test pool locking.
+
+package pool_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"pool"
+	"tutil"
+)
+
+func TestLockSql(t *testing.T) {
+	tmp := tutil.NewTempDir(t)
+	defer tmp.Clean()
+
+	base := tmp.Path() + "/pool"
+	err := pool.CreateSqlPool(base, nil)
+	if err != nil {
+		t.Fatalf("Unable to create pool: '%s'", err)
+	}
+	testLocking(t, base)
+}
+
+func TestLockFiles(t *testing.T) {
+	tmp := tutil.NewTempDir(t)
+	defer tmp.Clean()
+	t.Setenv("XDG_CACHE_HOME", tmp.Path()+"/cache")
+
+	base := tmp.Path() + "/pool"
+	err := pool.CreateFilePool(base, nil)
+	if err != nil {
+		t.Fatalf("Unable to create pool: '%s'", err)
+	}
+	testLocking(t, base)
+}
+
+func testLocking(t *testing.T, base string) {
+	open := func(mode pool.LockMode) pool.Pool {
+		pl, err := pool.OpenPoolMode(base, mode)
+		if err != nil {
+			t.Fatalf("Unable to open pool %s: '%s'", mode, err)
+		}
+		return pl
+	}
+	conflict := func(mode pool.LockMode) {
+		pl, err := pool.OpenPoolMode(base, mode)
+		if err == nil {
+			pl.Close()
+			t.Fatalf("Opening pool %s should conflict", mode)
+		}
+		lockErr, ok := err.(*pool.LockError)
+		if !ok {
+			t.Fatalf("Opening pool %s gave %T: '%s'", mode, err, err)
+		}
+		host, _ := os.Hostname()
+		want := fmt.Sprintf("pid %d on host %s", os.Getpid(), host)
+		if len(lockErr.Holders) == 0 || !strings.Contains(err.Error(), want) {
+			t.Errorf("Lock error %q doesn't name %q", err, want)
+		}
+	}
+
+	excl := open(pool.LockExclusive)
+	conflict(pool.LockExclusive)
+	conflict(pool.LockShared)
+	conflict(pool.LockWriter)
+	excl.Close()
+
+	// Readers share with each other and with a writer, which can't
+	// be joined by an exclusive user.
+	reader := open(pool.LockShared)
+	defer reader.Close()
+	other := open(pool.LockShared)
+	other.Close()
+	writer := open(pool.LockWriter)
+	conflict(pool.LockExclusive)
+
+	ch := pool.NewChunk("blob", []byte("written while shared"))
+	err := reader.Insert(ch)
+	if err == nil {
+		t.Errorf("Shared pool allowed an insert")
+	}
+	err = writer.Insert(ch)
+	if err != nil {
+		t.Fatalf("Error inserting: '%s'", err)
+	}
+	err = writer.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing: '%s'", err)
+	}
+
+	// Writers take turns a transaction at a time.  A second writer
+	// waits for the first to flush, and sees what it wrote.
+	second := open(pool.LockWriter)
+	defer second.Close()
+	err = writer.Insert(pool.NewChunk("blob", []byte("first writer")))
+	if err != nil {
+		t.Fatalf("Error inserting: '%s'", err)
+	}
+	later := pool.NewChunk("blob", []byte("second writer"))
+	inserted := make(chan error)
+	go func() {
+		inserted <- second.Insert(later)
+	}()
+	select {
+	case err = <-inserted:
+		t.Fatalf("Second writer didn't wait: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	err = writer.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing: '%s'", err)
+	}
+	err = <-inserted
+	if err != nil {
+		t.Fatalf("Error inserting: '%s'", err)
+	}
+	has, err := second.Contains(ch.OID())
+	if err != nil || !has {
+		t.Errorf("Second writer doesn't see flushed chunk: %v, '%v'", has, err)
+	}
+
+	// Waiting too long gives up, naming the writer.
+	defer func(timeout time.Duration) {
+		pool.WriteLockTimeout = timeout
+	}(pool.WriteLockTimeout)
+	pool.WriteLockTimeout = 200 * time.Millisecond
+	err = writer.Insert(pool.NewChunk("blob", []byte("waited for")))
+	if _, ok := err.(*pool.LockError); !ok || !strings.Contains(err.Error(), "pid") {
+		t.Errorf("Writer gave %v, expecting a lock error", err)
+	}
+	err = second.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing: '%s'", err)
+	}
+	writer.Close()
+
+	reader = open(pool.LockShared)
+	defer reader.Close()
+	has, err = reader.Contains(later.OID())
+	if err != nil || !has {
+		t.Errorf("Reader doesn't see second writer's chunk: %v, '%v'", has, err)
+	}
+}
+
+// Readers can use a pool whose locks can't be written, as on
+// read-only storage.
+func TestLockUnwritable(t *testing.T) {
+	tmp := tutil.NewTempDir(t)
+	defer tmp.Clean()
+	t.Setenv("XDG_CACHE_HOME", tmp.Path()+"/cache")
+
+	base := tmp.Path() + "/pool"
+	err := pool.CreateFilePool(base, nil)
+	if err != nil {
+		t.Fatalf("Unable to create pool: '%s'", err)
+	}
+	err = os.RemoveAll(base + "/locks")
+	if err == nil {
+		err = ioutil.WriteFile(base+"/locks", nil, 0444)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl, err := pool.OpenPoolMode(base, pool.LockShared)
+	if err != nil {
+		t.Fatalf("Unable to open pool for reading: '%s'", err)
+	}
+	_, err = pl.Backups()
+	if err != nil {
+		t.Errorf("Error reading backups: '%s'", err)
+	}
+	pl.Close()
+
+	pl, err = pool.OpenPoolMode(base, pool.LockWriter)
+	if err == nil {
+		pl.Close()
+		t.Errorf("Pool opened for writing without locks")
+	}
+}
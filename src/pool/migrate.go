@@ -0,0 +1,197 @@
+// Moving the contents of a pool to another backend.
+
+package pool
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Copies everything in one pool into a new pool.
+type Migrator struct {
+	src    Pool
+	dst    Pool
+	lister ListingPool
+
+	// Counts of the work done.
+	Chunks    int64
+	Bytes     int64
+	CacheRows int64
+	Verified  int64
+
+	// If set, called after each chunk.
+	Progress func()
+}
+
+// Chunks are flushed to the destination in groups of this many.
+const migrateFlushChunks = 4096
+
+func NewMigrator(src, dst Pool) (self *Migrator, err error) {
+	lister, ok := src.(ListingPool)
+	if !ok {
+		err = errors.New("Source pool can't list its chunks")
+		return
+	}
+
+	probe := []byte("godump migrate probe")
+	if PoolOID(src, "blob", probe).Compare(PoolOID(dst, "blob", probe)) != 0 {
+		err = errors.New("Pools compute chunk OIDs differently, (encrypted?), unable to migrate")
+		return
+	}
+
+	self = &Migrator{src: src, dst: dst, lister: lister}
+	return
+}
+
+// Copy every chunk, and the dump cache if both pools have one, and
+// then check that each chunk reads back correctly from the
+// destination.  Backup records are written last, so an interrupted
+// migration leaves no backups that refer to missing chunks.
+func (self *Migrator) Run() (err error) {
+	var backs []Chunk
+	err = self.lister.ForEachOID(func(oid *OID) (err error) {
+		ch, err := self.src.Search(oid)
+		if err != nil {
+			return
+		}
+		err = VerifyChunk(self.src, ch)
+		if err != nil {
+			return fmt.Errorf("Source chunk is damaged: %s", err)
+		}
+
+		if ch.Kind() == StringToKind("back") {
+			backs = append(backs, ch)
+		} else {
+			err = self.insert(ch)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	for _, ch := range backs {
+		err = self.insert(ch)
+		if err != nil {
+			return
+		}
+	}
+
+	err = self.copyCache()
+	if err != nil {
+		return
+	}
+	err = self.dst.Flush()
+	if err != nil {
+		return
+	}
+
+	return self.lister.ForEachOID(func(oid *OID) (err error) {
+		ch, err := self.dst.Search(oid)
+		if err != nil {
+			return fmt.Errorf("Reading %s from destination: %s", oid.String(), err)
+		}
+		err = VerifyChunk(self.dst, ch)
+		if err != nil {
+			return
+		}
+		self.Verified++
+		self.progress()
+		return
+	})
+}
+
+func (self *Migrator) insert(ch Chunk) (err error) {
+	err = self.dst.Insert(ch)
+	if err != nil {
+		return
+	}
+	self.Chunks++
+	self.Bytes += int64(ch.DataLen())
+	self.progress()
+
+	if self.Chunks%migrateFlushChunks == 0 {
+		err = self.dst.Flush()
+	}
+	return
+}
+
+func (self *Migrator) progress() {
+	if self.Progress != nil {
+		self.Progress()
+	}
+}
+
+// Copy the tables of the dump cache.  Older pools may not have them.
+func (self *Migrator) copyCache() (err error) {
+	srcTx := GetSql(self.src)
+	dstTx := GetSql(self.dst)
+	if srcTx == nil || dstTx == nil {
+		return
+	}
+
+	for _, table := range []string{"filesystems", "ctime_dirs", "ctime_cache"} {
+		var present bool
+		present, err = hasTable(srcTx, table)
+		if err != nil || !present {
+			return
+		}
+
+		var count int64
+		count, err = copyTable(srcTx, dstTx, table)
+		if err != nil {
+			return
+		}
+		self.CacheRows += count
+	}
+	return
+}
+
+func hasTable(tx *sql.Tx, table string) (present bool, err error) {
+	var count int
+	err = tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	present = count > 0
+	return
+}
+
+// Copy every row of 'table', which must have the same columns in
+// both databases.
+func copyTable(src, dst *sql.Tx, table string) (count int64, err error) {
+	rows, err := src.Query("SELECT * FROM " + table)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return
+	}
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ")
+	stmt, err := dst.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		table, strings.Join(cols, ", "), marks))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	values := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			return
+		}
+		_, err = stmt.Exec(values...)
+		if err != nil {
+			return
+		}
+		count++
+	}
+	err = rows.Err()
+	return
+}
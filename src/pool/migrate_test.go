@@ -0,0 +1,167 @@
+// Test migrating between pool backends.
+
+package pool_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"pool"
+	"tutil"
+)
+
+func TestMigrate(t *testing.T) {
+	pt := NewPoolTest(t)
+	defer pt.Clean()
+	t.Setenv("XDG_CACHE_HOME", pt.Tmp.Path()+"/cache")
+
+	for _, sz := range makeSizes() {
+		pt.Insert(sz)
+		if sz > 16 {
+			pt.InsertRandom(sz)
+		}
+	}
+	back := pool.NewChunk("back", []byte("backup"))
+	err := pt.Pool.Insert(back)
+	if err != nil {
+		t.Fatalf("Error inserting: '%s'", err)
+	}
+	pt.known = append(pt.known, back)
+	_, err = pool.GetSql(pt.Pool).Exec("INSERT INTO filesystems (fsid, uuid) VALUES (1, 'fs-uuid')")
+	if err != nil {
+		t.Fatalf("Error writing cache: '%s'", err)
+	}
+	pt.Flush()
+	id, err := pool.PoolUUID(pt.Pool)
+	if err != nil || id == "" {
+		t.Fatalf("Pool has no UUID (%v)", err)
+	}
+
+	// From SQL to files, and back again.
+	steps := []struct {
+		name   string
+		create func(string, *pool.CreateOptions) error
+	}{
+		{"files", pool.CreateFilePool},
+		{"sql", pool.CreateSqlPool},
+	}
+	for _, step := range steps {
+		base := pt.Tmp.Path() + "/" + step.name
+		err = step.create(base, &pool.CreateOptions{UUID: id})
+		if err != nil {
+			t.Fatalf("Unable to create pool: '%s'", err)
+		}
+		dst, err := pool.OpenPool(base)
+		if err != nil {
+			t.Fatalf("Unable to open pool: '%s'", err)
+		}
+
+		mig, err := pool.NewMigrator(pt.Pool, dst)
+		if err != nil {
+			t.Fatalf("Error starting migration: '%s'", err)
+		}
+		err = mig.Run()
+		if err != nil {
+			t.Fatalf("Error migrating to %s: '%s'", step.name, err)
+		}
+		if mig.Chunks != int64(len(pt.known)) || mig.Verified != mig.Chunks || mig.CacheRows != 1 {
+			t.Errorf("Migrated %d chunks, verified %d, and %d cache rows, expecting %d chunks",
+				mig.Chunks, mig.Verified, mig.CacheRows, len(pt.known))
+		}
+
+		pt.Pool.Close()
+		pt.Pool = dst
+		pt.Check()
+
+		newID, err := pool.PoolUUID(dst)
+		if err != nil || newID != id {
+			t.Errorf("Migrated pool has UUID %q, expecting %q", newID, id)
+		}
+		backups, err := dst.Backups()
+		if err != nil || len(backups) != 1 || backups[0].Compare(back.OID()) != 0 {
+			t.Errorf("Backups are %v (%v)", backups, err)
+		}
+		var fsUUID string
+		err = pool.GetSql(dst).QueryRow("SELECT uuid FROM filesystems WHERE fsid = 1").Scan(&fsUUID)
+		if err != nil || fsUUID != "fs-uuid" {
+			t.Errorf("Cache not migrated: %q (%v)", fsUUID, err)
+		}
+	}
+}
+
+func TestMigrateEncrypted(t *testing.T) {
+	tmp := tutil.NewTempDir(t)
+	defer tmp.Clean()
+
+	base := tmp.Path() + "/pool"
+	pass := []byte("secret")
+	err := pool.CreateSqlPool(base, &pool.CreateOptions{Passphrase: pass})
+	if err != nil {
+		t.Fatalf("Unable to create pool: '%s'", err)
+	}
+	src, err := pool.OpenEncryptedPool(base, pass)
+	if err != nil {
+		t.Fatalf("Unable to open pool: '%s'", err)
+	}
+	defer src.Close()
+
+	var known []pool.Chunk
+	for _, sz := range makeSizes() {
+		ch := pool.NewPoolChunk(src, "blob", []byte(pool.MakeRandomSentence(sz, sz)))
+		err = src.Insert(ch)
+		if err != nil {
+			t.Fatalf("Error inserting chunk: '%s'", err)
+		}
+		known = append(known, ch)
+	}
+	err = src.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing: '%s'", err)
+	}
+
+	keyProps, err := pool.PoolKeyProps(src)
+	if err != nil || keyProps["wrapped-key"] == "" || keyProps["kdf-salt"] == "" {
+		t.Fatalf("Key props are %v (%v)", keyProps, err)
+	}
+
+	// File pools can't hold the chunks, which is found before
+	// anything is made.
+	files := tmp.Path() + "/files"
+	err = pool.CreateFilePool(files, &pool.CreateOptions{KeyProps: keyProps})
+	if err == nil {
+		t.Errorf("Created an encrypted file pool")
+	}
+	if _, statErr := os.Stat(files); !os.IsNotExist(statErr) {
+		t.Errorf("Failed file pool was left behind: %v", statErr)
+	}
+
+	dstBase := tmp.Path() + "/sql"
+	err = pool.CreateSqlPool(dstBase, &pool.CreateOptions{KeyProps: keyProps})
+	if err != nil {
+		t.Fatalf("Unable to create pool: '%s'", err)
+	}
+	dst, err := pool.OpenEncryptedPool(dstBase, pass)
+	if err != nil {
+		t.Fatalf("Unable to open migrated pool with the same passphrase: '%s'", err)
+	}
+	defer dst.Close()
+
+	mig, err := pool.NewMigrator(src, dst)
+	if err != nil {
+		t.Fatalf("Error starting migration: '%s'", err)
+	}
+	err = mig.Run()
+	if err != nil {
+		t.Fatalf("Error migrating: '%s'", err)
+	}
+	if mig.Chunks != int64(len(known)) || mig.Verified != mig.Chunks {
+		t.Errorf("Migrated %d chunks, verified %d, expecting %d", mig.Chunks, mig.Verified, len(known))
+	}
+	for _, ch := range known {
+		ch2, err := dst.Search(ch.OID())
+		if err != nil || !bytes.Equal(ch.Data(), ch2.Data()) {
+			t.Errorf("Chunk did not read back from the migrated pool: %v", err)
+		}
+	}
+}
@@ -4,8 +4,10 @@ package pool
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 )
 
 type Pool interface {
@@ -22,14 +24,63 @@ type Pool interface {
 	Backups() (backups []*OID, err error)
 }
 
+// Called to get the passphrase when opening an encrypted pool.
+// Programs that open encrypted pools should set this, for instance,
+// to prompt the user.
+var Passphrase func(path string) (pass []byte, err error)
+
+// Open the pool at 'base', which is a local directory holding an SQL
+// or file pool, or "ssh://host/path" or an http or https URL for a
+// pool served by godump on another host.  Local pools are opened for
+// exclusive use.
 func OpenPool(base string) (pf Pool, err error) {
+	return OpenPoolMode(base, LockExclusive)
+}
+
+// Open the pool at 'base', sharing it with other processes as 'mode'
+// allows.  Remote pools are locked by the server instead.
+func OpenPoolMode(base string, mode LockMode) (pf Pool, err error) {
+	var remote *RemotePool
+	switch {
+	case strings.HasPrefix(base, "ssh://"):
+		remote, err = openSshPool(base)
+	case strings.HasPrefix(base, "http://"), strings.HasPrefix(base, "https://"):
+		remote, err = OpenHttpPool(base)
+	}
+	if remote != nil || err != nil {
+		if err == nil {
+			pf = remote
+		}
+		return
+	}
+
+	if isFilePool(base) {
+		return openFilePool(base, mode)
+	}
+
 	fi, err := os.Stat(base + "/data.db")
 	if err != nil || !fi.Mode().IsRegular() {
 		err = fmt.Errorf("Does not appear to be pool: '%s'", err)
 		return
 	}
 
-	return OpenSqlPool(base)
+	return openSqlPool(base, mode, Passphrase)
+}
+
+// Pools shared with other writers, which take turns a transaction at
+// a time.
+type WritingPool interface {
+	// Start a transaction, waiting for other writers to flush
+	// theirs.  Inserting starts one as well.
+	Begin() error
+}
+
+// Start a transaction on the pool, if it has them.
+func Begin(p Pool) error {
+	if wp, ok := p.(WritingPool); ok {
+		return wp.Begin()
+	}
+	return nil
 }
 
 // Some pools may have an underlying SQL database.  If this is the
@@ -48,3 +99,102 @@ func GetSql(p Pool) (handle *sql.Tx) {
 type SqlablePool interface {
 	GetSqlTx() *sql.Tx
 }
+
+// Some pools, such as encrypted ones, compute the OIDs of chunks
+// differently.  Any chunk written to such a pool has to be made with
+// its OID.  Pools that wrap another pool should implement this by
+// calling PoolOID on the pool they wrap.
+type HashingPool interface {
+	BlobOID(kind string, data []byte) *OID
+}
+
+// Compute the OID that the given pool uses for this data.
+func PoolOID(p Pool, kind string, data []byte) *OID {
+	hp, ok := p.(HashingPool)
+	if !ok {
+		return BlobOID(kind, data)
+	}
+
+	return hp.BlobOID(kind, data)
+}
+
+// Pools that choose how new chunks are compressed.
+type CompressingPool interface {
+	Codec() Codec
+}
+
+// The codec that chunks written to the given pool should use.
+func PoolCodec(p Pool) Codec {
+	cp, ok := p.(CompressingPool)
+	if !ok {
+		return DefaultCodec
+	}
+
+	return cp.Codec()
+}
+
+// Pools that can give the length of a chunk's data without reading
+// the chunk.
+type SizingPool interface {
+	DataLen(oid *OID) (size uint32, err error)
+}
+
+// Return the length of the data in the given chunk.
+func ChunkDataLen(p Pool, oid *OID) (size uint32, err error) {
+	sp, ok := p.(SizingPool)
+	if ok {
+		return sp.DataLen(oid)
+	}
+
+	ch, err := p.Search(oid)
+	if err != nil {
+		return
+	}
+	size = ch.DataLen()
+	return
+}
+
+// Pools that can list every chunk they hold.
+type ListingPool interface {
+	// Call 'f' with the OID of each chunk, in no particular order.
+	ForEachOID(f func(oid *OID) error) error
+}
+
+// The UUID of the pool, or "" if it doesn't have one.
+func PoolUUID(p Pool) (id string, err error) {
+	ip, ok := p.(identifiedPool)
+	if !ok {
+		return
+	}
+	id, _, err = ip.Identity()
+	return
+}
+
+// Pools that are able to remove chunks that are no longer needed.
+type SweepablePool interface {
+	// Remove every chunk whose OID is not in 'reachable'.  If
+	// 'dryRun' is set, only report what would be removed.
+	Sweep(reachable map[OID]bool, dryRun bool) (stats *SweepStats, err error)
+}
+
+// A summary of the chunks removed by a sweep.
+type SweepStats struct {
+	Chunks int64
+	Bytes  int64
+
+	// The number of cached file entries that referred to removed
+	// chunks.
+	CacheEntries int64
+}
+
+// Remove all unreachable chunks from the pool, if the pool supports
+// it.
+func Sweep(p Pool, reachable map[OID]bool, dryRun bool) (stats *SweepStats, err error) {
+	sw, ok := p.(SweepablePool)
+	if !ok {
+		err = errors.New("Pool doesn't support removing chunks")
+		return
+	}
+
+	return sw.Sweep(reachable, dryRun)
+}
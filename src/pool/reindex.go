@@ -0,0 +1,211 @@
+// Rebuilding the indexes of file pools.
+
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// What was found rebuilding the index of one data file.
+type ReindexResult struct {
+	Name   string
+	Chunks int
+
+	// The bytes covered by the new index.
+	Size int64
+
+	// Bytes past the last good chunk, which are left by a write
+	// torn by a crash.  They can only be removed if they are at the
+	// end of the last file, with no chunk header after the damage,
+	// in which case 'Truncatable' is set.  If 'Truncated' is set,
+	// they have been removed.
+	Torn        int64
+	Truncatable bool
+	Truncated   bool
+}
+
+// Rebuild the index of every data file in the file pool at 'path' by
+// scanning the chunks in them.  Each chunk is checked against its
+// OID.  Data after the last good chunk in a file is an error, unless
+// 'truncate' is set and the data looks like a torn write, in which
+// case the file is truncated to remove it.  The pool must not be in
+// use.
+func ReindexFilePool(path string, truncate bool) (results []*ReindexResult, err error) {
+	if !isFilePool(path) {
+		err = fmt.Errorf("%q is not a file pool", path)
+		return
+	}
+	lock, err := LockPool(path, LockExclusive)
+	if err != nil {
+		return
+	}
+	defer lock.Unlock()
+	pool := &FilePool{base: path}
+	nums, err := pool.dataFiles()
+	if err != nil {
+		return
+	}
+
+	for i, num := range nums {
+		var result *ReindexResult
+		result, err = reindexFile(pool.dataName(num), pool.indexName(num), i == len(nums)-1, truncate)
+		if result != nil {
+			results = append(results, result)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func reindexFile(dataName, indexName string, last, truncate bool) (result *ReindexResult, err error) {
+	fd, err := os.OpenFile(dataName, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() > maxFileLimit {
+		err = fmt.Errorf("%q is too large to index", dataName)
+		return
+	}
+
+	result = &ReindexResult{Name: dataName}
+	index := make(RamIndex)
+	var damage error
+	for result.Size < fi.Size() {
+		ch, length, chErr := scanChunk(fd, result.Size, fi.Size())
+		if chErr != nil {
+			damage = chErr
+			break
+		}
+
+		// The first copy of a chunk is the one the pool found.
+		if _, ok := index[*ch.OID()]; !ok {
+			index[*ch.OID()] = IndexValue{Offset: uint32(result.Size), Kind: ch.Kind().String()}
+			result.Chunks++
+		}
+		result.Size += length
+	}
+
+	result.Torn = fi.Size() - result.Size
+	if result.Torn > 0 {
+		// A crash can only tear the end of the last file.  Damage
+		// anywhere else is to data that may be needed.
+		var next int64
+		next, err = findHeader(fd, result.Size+1, fi.Size())
+		if err != nil {
+			return
+		}
+		result.Truncatable = last && next < 0
+
+		err = fmt.Errorf("%q has %d bytes of damaged data at offset %d (%s)",
+			filepath.Base(dataName), result.Torn, result.Size, damage)
+		switch {
+		case !last:
+			err = fmt.Errorf("%s, which isn't at the end of the pool", err)
+			return
+		case next >= 0:
+			err = fmt.Errorf("%s, followed by a chunk at offset %d", err, next)
+			return
+		case !truncate:
+			return
+		}
+
+		err = fd.Truncate(result.Size)
+		if err != nil {
+			return
+		}
+		err = fd.Sync()
+		if err != nil {
+			return
+		}
+		result.Truncated = true
+	}
+
+	err = WriteIndex(indexName, index, uint32(result.Size))
+	return
+}
+
+// Read and check the chunk at 'offset', returning it and its length,
+// including padding.  The header is checked first, so that a damaged
+// length can't run past 'end'.
+func scanChunk(fd *os.File, offset, end int64) (ch Chunk, length int64, err error) {
+	length, err = scanHeader(fd, offset, end)
+	if err != nil {
+		return
+	}
+
+	ch, _, err = ChunkRead(bufio.NewReader(io.NewSectionReader(fd, offset, length)))
+	if err != nil {
+		return
+	}
+	err = VerifyChunk(nil, ch)
+	return
+}
+
+// Check the chunk header at 'offset', returning the length of the
+// chunk, which must fit before 'end'.
+func scanHeader(fd *os.File, offset, end int64) (length int64, err error) {
+	var header chunkHeader
+	err = binary.Read(io.NewSectionReader(fd, offset, end-offset), binary.LittleEndian, &header)
+	if err != nil {
+		return
+	}
+	length = int64(binary.Size(&header))
+	switch {
+	case bytes.Equal(header.Magic[:], chunkMagic):
+	case bytes.Equal(header.Magic[:], chunkMagicCodec):
+		length += int64(binary.Size(&chunkHeaderCodec{}))
+	default:
+		err = fmt.Errorf("Invalid chunk header at offset %d", offset)
+		return
+	}
+	length += int64(header.PayloadLen) + int64(15&-int(header.PayloadLen))
+	if offset+length > end {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// Find the first chunk header at or after 'offset' whose chunk fits
+// before 'end', returning its offset, or -1 if there is none.
+func findHeader(fd *os.File, offset, end int64) (found int64, err error) {
+	// The start the two header magics have in common.
+	prefix := chunkMagic[:len("adump-pool-v1.")]
+
+	const block = 1024 * 1024
+	buf := make([]byte, block+len(prefix)-1)
+	for pos := offset; pos < end; pos += block {
+		n, readErr := fd.ReadAt(buf, pos)
+		if readErr != nil && readErr != io.EOF {
+			err = readErr
+			return
+		}
+		data := buf[:n]
+		for i := 0; i < len(data) && i < block; {
+			j := bytes.Index(data[i:], prefix)
+			if j < 0 || i+j >= block {
+				break
+			}
+			found = pos + int64(i+j)
+			if _, hdrErr := scanHeader(fd, found, end); hdrErr == nil {
+				return
+			}
+			i += j + 1
+		}
+	}
+	found = -1
+	return
+}
@@ -0,0 +1,178 @@
+// Test rebuilding file pool indexes.
+
+package pool_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pool"
+)
+
+func TestReindex(t *testing.T) {
+	pt, base := newFilePoolTest(t, 64*1024)
+	defer pt.Clean()
+
+	for _, sz := range makeSizes() {
+		pt.Insert(sz)
+	}
+	pt.Flush()
+	pt.Pool.Close()
+	pt.Pool = nil
+
+	indexes, _ := filepath.Glob(base + "/pool-data-*.idx")
+	files, _ := filepath.Glob(base + "/pool-data-*.data")
+	if len(indexes) < 2 {
+		t.Fatalf("Expecting several data files, found %d", len(indexes))
+	}
+	err := os.Remove(indexes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pool.OpenPool(base)
+	if err == nil {
+		t.Errorf("Pool opened without an index")
+	}
+
+	results, err := pool.ReindexFilePool(base, false)
+	if err != nil {
+		t.Fatalf("Error reindexing: '%s'", err)
+	}
+	chunks := 0
+	for _, res := range results {
+		chunks += res.Chunks
+	}
+	if len(results) != len(files) || chunks != len(pt.known) {
+		t.Errorf("Reindexed %d files with %d chunks, expecting %d and %d",
+			len(results), chunks, len(files), len(pt.known))
+	}
+	pt.reopen(base)
+	pt.Check()
+	pt.Pool.Close()
+	pt.Pool = nil
+
+	// Leave part of a chunk at the end of the last file.
+	var buf bytes.Buffer
+	err = pool.ChunkWrite(pool.MakeRandomChunk(5000), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := files[len(files)-1]
+	fi, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write(buf.Bytes()[:buf.Len()/2])
+	fd.Close()
+
+	_, err = pool.ReindexFilePool(base, false)
+	if err == nil {
+		t.Errorf("Reindexing a torn file didn't fail")
+	}
+	results, err = pool.ReindexFilePool(base, true)
+	if err != nil {
+		t.Fatalf("Error reindexing: '%s'", err)
+	}
+	res := results[len(results)-1]
+	if !res.Truncated || res.Torn != int64(buf.Len()/2) || res.Size != fi.Size() {
+		t.Errorf("Truncation gave %+v, expecting %d bytes at %d", res, buf.Len()/2, fi.Size())
+	}
+	fi, err = os.Stat(last)
+	if err != nil || fi.Size() != res.Size {
+		t.Errorf("File not truncated")
+	}
+	pt.reopen(base)
+	pt.Check()
+}
+
+// Damage that a crash can't cause is reported, and never truncated.
+func TestReindexDamaged(t *testing.T) {
+	pt, base := newFilePoolTest(t, 64*1024)
+	defer pt.Clean()
+
+	for _, sz := range makeSizes() {
+		pt.Insert(sz)
+	}
+	pt.Flush()
+	pt.Pool.Close()
+	pt.Pool = nil
+
+	files, _ := filepath.Glob(base + "/pool-data-*.data")
+	if len(files) < 2 {
+		t.Fatalf("Expecting several data files, found %d", len(files))
+	}
+	sizes := make([]int64, len(files))
+	for i, name := range files {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = fi.Size()
+	}
+	unchanged := func() {
+		for i, name := range files {
+			fi, err := os.Stat(name)
+			if err != nil || fi.Size() != sizes[i] {
+				t.Errorf("%s was changed", name)
+			}
+		}
+	}
+	patch := func(name string, offset int64, data []byte) {
+		fd, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err == nil {
+			_, err = fd.WriteAt(data, offset)
+			fd.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Flip a byte of the OID of the first chunk of the first file,
+	// which follows the magic, the lengths and the kind.
+	fd, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := make([]byte, 1)
+	_, err = fd.ReadAt(orig, 28)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch(files[0], 28, []byte{orig[0] ^ 0xFF})
+
+	_, err = pool.ReindexFilePool(base, true)
+	if err == nil || !strings.Contains(err.Error(), "at offset 0 (") {
+		t.Errorf("Reindexing a damaged first file gave %v", err)
+	}
+	unchanged()
+	patch(files[0], 28, orig)
+
+	// Garbage in the last file, followed by a good chunk.
+	last := files[len(files)-1]
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 16))
+	err = pool.ChunkWrite(pool.MakeRandomChunk(5000), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch(last, sizes[len(sizes)-1], buf.Bytes())
+	sizes[len(sizes)-1] += int64(buf.Len())
+
+	results, err := pool.ReindexFilePool(base, true)
+	if err == nil || !strings.Contains(err.Error(), "followed by a chunk") {
+		t.Errorf("Reindexing damage before a chunk gave %v", err)
+	}
+	if len(results) != len(files) || results[len(results)-1].Truncatable {
+		t.Errorf("Damage before a chunk is truncatable")
+	}
+	unchanged()
+}
@@ -0,0 +1,302 @@
+// Pools on another host, reached through "godump serve" or over HTTP.
+
+package pool
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The command run on the remote host for "ssh://" pools.
+var RemoteCommand = "godump"
+
+// Pools reached through another process or host.  Inserted chunks
+// are batched, and only the ones the remote pool doesn't already have
+// are sent.
+type RemotePool struct {
+	conn  remoteConn
+	codec Codec
+
+	// Chunks inserted, but not yet sent.
+	pending     []Chunk
+	pendingOIDs map[OID]Chunk
+	pendingSize int
+
+	// The local database holding the cache used by dumps, if the
+	// remote pool could be identified.
+	cache   *sql.DB
+	cacheTx *sql.Tx
+}
+
+// The operations of the remote protocol.  Missing chunks give
+// sql.ErrNoRows.
+type remoteConn interface {
+	hello() (props map[string]string, err error)
+	contains(oids []*OID) (present []bool, err error)
+	insert(chunks []Chunk) error
+	search(oid *OID) (Chunk, error)
+	dataLen(oid *OID) (uint32, error)
+	backups() ([]*OID, error)
+	flush() error
+	close() error
+}
+
+// Limits on the chunks held before sending.
+const (
+	remoteBatchChunks = 1024
+	remoteBatchBytes  = 4 * 1024 * 1024
+)
+
+// Open a pool through a "godump serve" process at the other end of
+// 'rd' and 'wr'.  'closer' is called when the pool is closed.
+func NewRemotePool(rd io.Reader, wr io.Writer, closer func() error) (pool *RemotePool, err error) {
+	return openRemote(&streamConn{
+		in:     bufio.NewReaderSize(rd, 256*1024),
+		out:    bufio.NewWriterSize(wr, 256*1024),
+		closer: closer,
+	})
+}
+
+func openRemote(conn remoteConn) (pool *RemotePool, err error) {
+	pool = &RemotePool{
+		conn:        conn,
+		pendingOIDs: make(map[OID]Chunk),
+	}
+
+	props, err := conn.hello()
+	if err != nil {
+		conn.close()
+		pool = nil
+		return
+	}
+	if props["hashed"] != "" {
+		err = errors.New("Remote pool is encrypted, which isn't supported over the remote protocol")
+	}
+	if err == nil {
+		pool.codec, err = ParseCodec(props["codec"])
+	}
+	if err == nil && props["uuid"] != "" {
+		err = pool.openCache(props["uuid"], props["sweep"])
+	}
+	if err != nil {
+		pool.Close()
+		pool = nil
+	}
+	return
+}
+
+// Run 'command', and open the pool it serves on its stdin and
+// stdout.  Its stderr is passed through.
+func DialRemotePool(command []string) (pool *RemotePool, err error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	wr, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	rd, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+
+	return NewRemotePool(rd, wr, func() error {
+		wr.Close()
+		return cmd.Wait()
+	})
+}
+
+// Open a pool named as "ssh://[user@]host/path".  The path is
+// absolute, unless it starts with "~".
+func openSshPool(name string) (pool *RemotePool, err error) {
+	rest := strings.TrimPrefix(name, "ssh://")
+	slash := strings.Index(rest, "/")
+	if slash <= 0 {
+		err = fmt.Errorf("Invalid remote pool %q, expecting ssh://host/path", name)
+		return
+	}
+	host, path := rest[:slash], rest[slash:]
+	if strings.HasPrefix(path, "/~") {
+		path = path[1:]
+	}
+
+	// ssh passes the command through the remote shell.
+	return DialRemotePool([]string{"ssh", "-e", "none", host,
+		RemoteCommand + " serve " + shellQuote(path)})
+}
+
+// Quote an argument for a POSIX shell.  A leading "~/" is left
+// unquoted so that it still expands.
+func shellQuote(text string) string {
+	prefix := ""
+	if strings.HasPrefix(text, "~/") {
+		prefix, text = "~/", text[2:]
+	}
+	return prefix + "'" + strings.Replace(text, "'", `'\''`, -1) + "'"
+}
+
+// Open the local cache database for the pool with the given UUID.
+func (pool *RemotePool) openCache(id, sweep string) (err error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return
+	}
+	dir = filepath.Join(dir, "godump")
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+
+	pool.cache, pool.cacheTx, err = openCacheDB(filepath.Join(dir, "remote-"+id+".db"), sweep)
+	return
+}
+
+// Send the pending chunks that the remote pool doesn't have.
+func (pool *RemotePool) sendPending() (err error) {
+	if len(pool.pending) == 0 {
+		return
+	}
+
+	oids := make([]*OID, len(pool.pending))
+	for i, ch := range pool.pending {
+		oids[i] = ch.OID()
+	}
+	present, err := pool.conn.contains(oids)
+	if err != nil {
+		return
+	}
+
+	var missing []Chunk
+	for i, ch := range pool.pending {
+		if !present[i] {
+			missing = append(missing, ch)
+		}
+	}
+	if len(missing) > 0 {
+		err = pool.conn.insert(missing)
+		if err != nil {
+			return
+		}
+	}
+
+	pool.pending = nil
+	pool.pendingOIDs = make(map[OID]Chunk)
+	pool.pendingSize = 0
+	return
+}
+
+func (pool *RemotePool) Insert(chunk Chunk) (err error) {
+	if _, ok := pool.pendingOIDs[*chunk.OID()]; ok {
+		return
+	}
+	pool.pending = append(pool.pending, chunk)
+	pool.pendingOIDs[*chunk.OID()] = chunk
+
+	// Sizes are estimated from the uncompressed data.
+	pool.pendingSize += int(chunk.DataLen())
+	if len(pool.pending) >= remoteBatchChunks || pool.pendingSize >= remoteBatchBytes {
+		err = pool.sendPending()
+	}
+	return
+}
+
+func (pool *RemotePool) Contains(oid *OID) (result bool, err error) {
+	if _, ok := pool.pendingOIDs[*oid]; ok {
+		result = true
+		return
+	}
+
+	present, err := pool.conn.contains([]*OID{oid})
+	if err != nil {
+		return
+	}
+	result = present[0]
+	return
+}
+
+// Missing chunks give sql.ErrNoRows, as with a local pool.
+func (pool *RemotePool) Search(oid *OID) (chunk Chunk, err error) {
+	if ch, ok := pool.pendingOIDs[*oid]; ok {
+		chunk = ch
+		return
+	}
+
+	chunk, err = pool.conn.search(oid)
+	if err == nil && chunk.OID().Compare(oid) != 0 {
+		err = fmt.Errorf("Remote pool returned chunk %s, expecting %s", chunk.OID().String(), oid.String())
+	}
+	return
+}
+
+func (pool *RemotePool) DataLen(oid *OID) (size uint32, err error) {
+	if ch, ok := pool.pendingOIDs[*oid]; ok {
+		size = ch.DataLen()
+		return
+	}
+
+	return pool.conn.dataLen(oid)
+}
+
+func (pool *RemotePool) Backups() (backups []*OID, err error) {
+	err = pool.sendPending()
+	if err != nil {
+		return
+	}
+	return pool.conn.backups()
+}
+
+// The remote pool is committed before the local cache, so the cache
+// never refers to chunks the pool doesn't have.
+func (pool *RemotePool) Flush() (err error) {
+	err = pool.sendPending()
+	if err != nil {
+		return
+	}
+	err = pool.conn.flush()
+	if err != nil {
+		return
+	}
+
+	if pool.cacheTx != nil {
+		err = pool.cacheTx.Commit()
+		if err != nil {
+			return
+		}
+		pool.cacheTx, err = pool.cache.Begin()
+	}
+	return
+}
+
+// Close the pool.  As with a local pool, anything not flushed is
+// discarded.
+func (pool *RemotePool) Close() (err error) {
+	err = pool.conn.close()
+
+	if pool.cacheTx != nil {
+		pool.cacheTx.Rollback()
+	}
+	if pool.cache != nil {
+		pool.cache.Close()
+	}
+	return
+}
+
+func (pool *RemotePool) Codec() Codec {
+	return pool.codec
+}
+
+// The transaction of the local cache database, or nil if there isn't
+// one.
+func (pool *RemotePool) GetSqlTx() *sql.Tx {
+	return pool.cacheTx
+}
@@ -0,0 +1,272 @@
+// The protocol spoken between a remote pool and "godump serve".
+
+package pool
+
+// Each request is a frame holding a one byte operation followed by
+// its arguments, and is answered by a frame holding a one byte status
+// followed by the results.  Frames start with their length, as a
+// little endian uint32.  Chunks are sent in the ChunkWrite format, so
+// compressed chunks are sent as they are stored.
+//
+//	Hello     version string          -> props
+//	Contains  count, OIDs             -> one byte per OID
+//	Insert    count, chunks           ->
+//	Search    OID                     -> chunk
+//	DataLen   OID                     -> uint32
+//	Backups                           -> count, OIDs
+//	Flush                             ->
+//	Close                             ->
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const remoteVersion = "godump-remote-1"
+
+const (
+	remoteHello    = 'H'
+	remoteContains = 'C'
+	remoteInsert   = 'I'
+	remoteSearch   = 'S'
+	remoteDataLen  = 'L'
+	remoteBackups  = 'B'
+	remoteFlush    = 'F'
+	remoteClose    = 'Q'
+)
+
+// Reply statuses.  A missing chunk is distinguished so that the
+// client can return the same error a local pool would.
+const (
+	remoteOK      = 0
+	remoteError   = 1
+	remoteMissing = 2
+)
+
+// Larger frames mean a broken or hostile peer.
+const remoteMaxFrame = 64 * 1024 * 1024
+
+// Write a frame, made of a one byte code, and the body.
+func writeFrame(wr *bufio.Writer, code byte, body []byte) (err error) {
+	err = binary.Write(wr, binary.LittleEndian, uint32(len(body)+1))
+	if err != nil {
+		return
+	}
+	err = wr.WriteByte(code)
+	if err != nil {
+		return
+	}
+	_, err = wr.Write(body)
+	if err != nil {
+		return
+	}
+	return wr.Flush()
+}
+
+// Read a frame, returning its code and body.
+func readFrame(rd *bufio.Reader) (code byte, body *bytes.Buffer, err error) {
+	var length uint32
+	err = binary.Read(rd, binary.LittleEndian, &length)
+	if err != nil {
+		return
+	}
+	if length < 1 || length > remoteMaxFrame {
+		err = fmt.Errorf("Invalid remote frame length %d", length)
+		return
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(rd, buf)
+	if err != nil {
+		return
+	}
+	code = buf[0]
+	body = bytes.NewBuffer(buf[1:])
+	return
+}
+
+func writeString(buf *bytes.Buffer, text string) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(text)))
+	buf.WriteString(text)
+}
+
+func readString(buf *bytes.Buffer) (text string, err error) {
+	var length uint32
+	err = binary.Read(buf, binary.LittleEndian, &length)
+	if err != nil {
+		return
+	}
+	if int(length) > buf.Len() {
+		err = errors.New("Short string in remote frame")
+		return
+	}
+	text = string(buf.Next(int(length)))
+	return
+}
+
+func writeOIDs(buf *bytes.Buffer, oids []*OID) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(oids)))
+	for _, oid := range oids {
+		buf.Write(oid[:])
+	}
+}
+
+func readOIDs(buf *bytes.Buffer) (oids []*OID, err error) {
+	var count uint32
+	err = binary.Read(buf, binary.LittleEndian, &count)
+	if err != nil {
+		return
+	}
+	if int(count) > buf.Len()/OIDLen {
+		err = errors.New("Short OID list in remote frame")
+		return
+	}
+	oids = make([]*OID, count)
+	for i := range oids {
+		oids[i], err = OIDFromBytes(buf)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Chunks are followed by the padding ChunkWrite adds.
+func readChunk(buf *bytes.Buffer) (ch Chunk, err error) {
+	ch, pad, err := ChunkRead(buf)
+	if err != nil {
+		return
+	}
+	buf.Next(pad)
+	return
+}
+
+// The protocol over a pair of streams, such as the pipes to an ssh
+// process.
+type streamConn struct {
+	in     *bufio.Reader
+	out    *bufio.Writer
+	closer func() error
+}
+
+// Send a request, and wait for its reply.
+func (conn *streamConn) call(code byte, body []byte) (reply *bytes.Buffer, err error) {
+	err = writeFrame(conn.out, code, body)
+	if err != nil {
+		return
+	}
+
+	status, reply, err := readFrame(conn.in)
+	if err != nil {
+		return
+	}
+	switch status {
+	case remoteOK:
+	case remoteMissing:
+		err = sql.ErrNoRows
+	case remoteError:
+		err = fmt.Errorf("Remote pool: %s", reply.String())
+	default:
+		err = fmt.Errorf("Invalid remote reply status %d", status)
+	}
+	return
+}
+
+func (conn *streamConn) hello() (props map[string]string, err error) {
+	var req bytes.Buffer
+	writeString(&req, remoteVersion)
+	reply, err := conn.call(remoteHello, req.Bytes())
+	if err != nil {
+		return
+	}
+
+	props = make(map[string]string)
+	var count uint32
+	err = binary.Read(reply, binary.LittleEndian, &count)
+	for i := uint32(0); err == nil && i < count; i++ {
+		var key, value string
+		key, err = readString(reply)
+		if err != nil {
+			break
+		}
+		value, err = readString(reply)
+		props[key] = value
+	}
+	return
+}
+
+func (conn *streamConn) contains(oids []*OID) (present []bool, err error) {
+	var req bytes.Buffer
+	writeOIDs(&req, oids)
+	reply, err := conn.call(remoteContains, req.Bytes())
+	if err != nil {
+		return
+	}
+	if reply.Len() != len(oids) {
+		err = errors.New("Short reply to remote contains")
+		return
+	}
+	present = make([]bool, len(oids))
+	for i, flag := range reply.Bytes() {
+		present[i] = flag != 0
+	}
+	return
+}
+
+func (conn *streamConn) insert(chunks []Chunk) (err error) {
+	var req bytes.Buffer
+	binary.Write(&req, binary.LittleEndian, uint32(len(chunks)))
+	for _, ch := range chunks {
+		err = ChunkWrite(ch, &req)
+		if err != nil {
+			return
+		}
+	}
+	_, err = conn.call(remoteInsert, req.Bytes())
+	return
+}
+
+func (conn *streamConn) search(oid *OID) (chunk Chunk, err error) {
+	reply, err := conn.call(remoteSearch, oid[:])
+	if err != nil {
+		return
+	}
+	return readChunk(reply)
+}
+
+func (conn *streamConn) dataLen(oid *OID) (size uint32, err error) {
+	reply, err := conn.call(remoteDataLen, oid[:])
+	if err != nil {
+		return
+	}
+	err = binary.Read(reply, binary.LittleEndian, &size)
+	return
+}
+
+func (conn *streamConn) backups() (backups []*OID, err error) {
+	reply, err := conn.call(remoteBackups, nil)
+	if err != nil {
+		return
+	}
+	return readOIDs(reply)
+}
+
+func (conn *streamConn) flush() (err error) {
+	_, err = conn.call(remoteFlush, nil)
+	return
+}
+
+// Tell the server we're done, before closing the streams.
+func (conn *streamConn) close() (err error) {
+	_, err = conn.call(remoteClose, nil)
+	closeErr := conn.closer()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
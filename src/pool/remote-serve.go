@@ -0,0 +1,186 @@
+// Serving a pool to a remote client.
+
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Pools that can identify themselves to remote clients, who keep a
+// local cache for each pool.  'sweep' changes whenever chunks are
+// removed, which invalidates those caches.
+type identifiedPool interface {
+	Identity() (id, sweep string, err error)
+}
+
+// Answer requests from a RemotePool read from 'rd', writing the
+// replies to 'wr', until the client closes the pool or the input
+// ends.  Inserted chunks are only committed when the client flushes.
+func Serve(pl Pool, rd io.Reader, wr io.Writer) (err error) {
+	in := bufio.NewReaderSize(rd, 256*1024)
+	out := bufio.NewWriterSize(wr, 256*1024)
+
+	for {
+		var code byte
+		var body *bytes.Buffer
+		code, body, err = readFrame(in)
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		var reply bytes.Buffer
+		tmpErr := serveRequest(pl, code, body, &reply)
+
+		switch {
+		case tmpErr == sql.ErrNoRows:
+			err = writeFrame(out, remoteMissing, nil)
+		case tmpErr != nil:
+			err = writeFrame(out, remoteError, []byte(tmpErr.Error()))
+		default:
+			err = writeFrame(out, remoteOK, reply.Bytes())
+		}
+		if err != nil || code == remoteClose {
+			return
+		}
+	}
+}
+
+// The properties a client needs to know about the pool.
+func remoteProps(pl Pool) (props map[string]string, err error) {
+	var id, sweep string
+	if ip, ok := pl.(identifiedPool); ok {
+		id, sweep, err = ip.Identity()
+		if err != nil {
+			return
+		}
+	}
+
+	// Clients have no way of computing the OIDs of keyed pools.
+	probe := []byte(remoteVersion)
+	hashed := PoolOID(pl, "blob", probe).Compare(BlobOID("blob", probe)) != 0
+
+	props = map[string]string{
+		"uuid":  id,
+		"sweep": sweep,
+		"codec": PoolCodec(pl).String(),
+	}
+	if hashed {
+		props["hashed"] = "true"
+	}
+	return
+}
+
+func serveRequest(pl Pool, code byte, body *bytes.Buffer, reply *bytes.Buffer) (err error) {
+	switch code {
+	case remoteHello:
+		var version string
+		version, err = readString(body)
+		if err != nil {
+			return
+		}
+		if version != remoteVersion {
+			err = fmt.Errorf("Unsupported remote protocol %q, expecting %q", version, remoteVersion)
+			return
+		}
+
+		var props map[string]string
+		props, err = remoteProps(pl)
+		if err != nil {
+			return
+		}
+		binary.Write(reply, binary.LittleEndian, uint32(len(props)))
+		for key, value := range props {
+			writeString(reply, key)
+			writeString(reply, value)
+		}
+
+	case remoteContains:
+		var oids []*OID
+		oids, err = readOIDs(body)
+		if err != nil {
+			return
+		}
+		for _, oid := range oids {
+			var present bool
+			present, err = pl.Contains(oid)
+			if err != nil {
+				return
+			}
+			if present {
+				reply.WriteByte(1)
+			} else {
+				reply.WriteByte(0)
+			}
+		}
+
+	case remoteInsert:
+		var count uint32
+		err = binary.Read(body, binary.LittleEndian, &count)
+		if err != nil {
+			return
+		}
+		for i := uint32(0); i < count; i++ {
+			var ch Chunk
+			ch, err = readChunk(body)
+			if err != nil {
+				return
+			}
+			err = pl.Insert(ch)
+			if err != nil {
+				return
+			}
+		}
+
+	case remoteSearch:
+		var oid *OID
+		oid, err = OIDFromBytes(body)
+		if err != nil {
+			return
+		}
+		var ch Chunk
+		ch, err = pl.Search(oid)
+		if err != nil {
+			return
+		}
+		err = ChunkWrite(ch, reply)
+
+	case remoteDataLen:
+		var oid *OID
+		oid, err = OIDFromBytes(body)
+		if err != nil {
+			return
+		}
+		var size uint32
+		size, err = ChunkDataLen(pl, oid)
+		if err != nil {
+			return
+		}
+		binary.Write(reply, binary.LittleEndian, size)
+
+	case remoteBackups:
+		var backups []*OID
+		backups, err = pl.Backups()
+		if err != nil {
+			return
+		}
+		writeOIDs(reply, backups)
+
+	case remoteFlush:
+		err = pl.Flush()
+
+	case remoteClose:
+
+	default:
+		err = fmt.Errorf("Unknown remote request %q", code)
+	}
+	return
+}
@@ -0,0 +1,211 @@
+// Test remote pools.
+
+package pool_test
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"testing"
+
+	"pool"
+	"tutil"
+)
+
+// The test binary serves a pool when run as a child process.
+func TestMain(m *testing.M) {
+	if base := os.Getenv("GODUMP_TEST_SERVE"); base != "" {
+		pl, err := pool.OpenPool(base)
+		if err == nil {
+			err = pool.Serve(pl, os.Stdin, os.Stdout)
+			pl.Close()
+		}
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Serve the pool in a goroutine, returning a client for it.
+func serveLocal(t *testing.T, pl pool.Pool) *pool.RemotePool {
+	reqRd, reqWr := io.Pipe()
+	replyRd, replyWr := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := pool.Serve(pl, reqRd, replyWr)
+		replyWr.Close()
+		done <- err
+	}()
+
+	remote, err := pool.NewRemotePool(replyRd, reqWr, func() error {
+		reqWr.Close()
+		return <-done
+	})
+	if err != nil {
+		t.Fatalf("Unable to open remote pool: '%s'", err)
+	}
+	return remote
+}
+
+// A pool that counts the chunks inserted into it.
+type countingPool struct {
+	pool.Pool
+	inserts int
+}
+
+func (self *countingPool) Insert(ch pool.Chunk) error {
+	self.inserts++
+	return self.Pool.Insert(ch)
+}
+
+func TestRemote(t *testing.T) {
+	pt := NewPoolTest(t)
+	defer pt.Clean()
+	t.Setenv("XDG_CACHE_HOME", pt.Tmp.Path()+"/cache")
+
+	local := pt.Pool
+	remote := serveLocal(t, local)
+
+	// Write and read everything through the remote pool, which
+	// must then be in the served pool as well.
+	pt.Pool = remote
+	for _, sz := range makeSizes() {
+		pt.Insert(sz)
+		if sz > 16 {
+			pt.InsertRandom(sz)
+		}
+	}
+	pt.Check()
+	pt.Flush()
+	pt.Check()
+	pt.Pool = local
+	pt.Check()
+
+	back := pool.NewChunk("back", []byte("backup"))
+	err := remote.Insert(back)
+	if err != nil {
+		t.Fatalf("Error inserting: '%s'", err)
+	}
+	backups, err := remote.Backups()
+	if err != nil || len(backups) != 1 || backups[0].Compare(back.OID()) != 0 {
+		t.Errorf("Remote backups are %v (%v)", backups, err)
+	}
+
+	_, err = remote.Search(pool.IntOID(12345))
+	if err != sql.ErrNoRows {
+		t.Errorf("Missing chunk gave %v, expecting sql.ErrNoRows", err)
+	}
+
+	size, err := pool.ChunkDataLen(remote, pt.known[3].OID())
+	if err != nil || size != pt.known[3].DataLen() {
+		t.Errorf("Remote data length is %d (%v), expecting %d", size, err, pt.known[3].DataLen())
+	}
+
+	if pool.GetSql(remote) == nil {
+		t.Fatalf("Remote pool has no cache database")
+	}
+	_, err = pool.GetSql(remote).Exec("INSERT INTO ctime_dirs (fsid, pino) VALUES (1, 2)")
+	if err != nil {
+		t.Fatalf("Error writing to cache: '%s'", err)
+	}
+	err = remote.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing: '%s'", err)
+	}
+	err = remote.Close()
+	if err != nil {
+		t.Errorf("Error closing remote pool: '%s'", err)
+	}
+
+	// Chunks the served pool already has aren't sent again.
+	counter := &countingPool{Pool: local}
+	remote = serveLocal(t, counter)
+	for _, ch := range pt.known {
+		err = remote.Insert(ch)
+		if err != nil {
+			t.Fatalf("Error inserting: '%s'", err)
+		}
+	}
+	err = remote.Flush()
+	if err != nil || counter.inserts != 0 {
+		t.Errorf("Reinserting sent %d chunks (%v)", counter.inserts, err)
+	}
+	remote.Close()
+
+	// The cache survives reopening, until chunks are removed
+	// from the pool.
+	for _, sweep := range []bool{false, true} {
+		if sweep {
+			_, err = pool.Sweep(local, map[pool.OID]bool{}, false)
+			if err != nil {
+				t.Fatalf("Error sweeping: '%s'", err)
+			}
+		}
+
+		remote = serveLocal(t, local)
+		var count int
+		err = pool.GetSql(remote).QueryRow("SELECT COUNT(*) FROM ctime_dirs").Scan(&count)
+		if err != nil {
+			t.Fatalf("Error reading cache: '%s'", err)
+		}
+		if sweep && count != 0 {
+			t.Errorf("Cache not cleared after sweep")
+		}
+		if !sweep && count != 1 {
+			t.Errorf("Cache has %d entries after reopening, expecting 1", count)
+		}
+		remote.Close()
+	}
+}
+
+// Serve a pool from a child process, as over ssh.
+func TestRemoteProcess(t *testing.T) {
+	tmp := tutil.NewTempDir(t)
+	defer tmp.Clean()
+	t.Setenv("XDG_CACHE_HOME", tmp.Path()+"/cache")
+
+	base := tmp.Path() + "/pool"
+	err := pool.CreateSqlPool(base, nil)
+	if err != nil {
+		t.Fatalf("Unable to create pool: '%s'", err)
+	}
+
+	t.Setenv("GODUMP_TEST_SERVE", base)
+	remote, err := pool.DialRemotePool([]string{os.Args[0]})
+	if err != nil {
+		t.Fatalf("Unable to start server: '%s'", err)
+	}
+
+	var known []pool.Chunk
+	for _, sz := range makeSizes() {
+		ch := pool.MakeRandomChunk(sz)
+		err = remote.Insert(ch)
+		if err != nil {
+			t.Fatalf("Error inserting: '%s'", err)
+		}
+		known = append(known, ch)
+	}
+	err = remote.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing: '%s'", err)
+	}
+	err = remote.Close()
+	if err != nil {
+		t.Fatalf("Error closing: '%s'", err)
+	}
+
+	pl, err := pool.OpenPool(base)
+	if err != nil {
+		t.Fatalf("Unable to open pool: '%s'", err)
+	}
+	defer pl.Close()
+	for _, ch := range known {
+		has, err := pl.Contains(ch.OID())
+		if err != nil || !has {
+			t.Errorf("Chunk %s not written by server (%v)", ch.OID().String(), err)
+		}
+	}
+}
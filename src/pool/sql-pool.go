@@ -4,9 +4,13 @@ package pool
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"strings"
 
 	"code.google.com/p/go-uuid/uuid"
 
@@ -19,9 +23,37 @@ import (
 	// _ "code.google.com/p/go-sqlite/go1/sqlite3"
 )
 
+// Options for creating a new pool.
+type CreateOptions struct {
+	// If set, the pool is encrypted, with a key protected by this
+	// passphrase.
+	Passphrase []byte
+
+	// If set, the pool is encrypted with the key of another pool,
+	// from PoolKeyProps.
+	KeyProps map[string]string
+
+	// The codec used to compress chunks written to the pool.
+	Codec Codec
+
+	// For file pools, the size data files are limited to.  Zero
+	// gives DefaultFileLimit.
+	FileLimit int64
+
+	// If set, the UUID of the new pool, such as when it replaces
+	// another.  Otherwise a new one is made.
+	UUID string
+}
+
 // Construct a fresh new pool in under the given name.  The name must
-// be a name that can be made as a fresh directory.
-func CreateSqlPool(path string) (err error) {
+// be a name that can be made as a fresh directory.  'opts' may be nil
+// for a plain pool.
+func CreateSqlPool(path string, opts *CreateOptions) (err error) {
+	if opts != nil && opts.Passphrase != nil && opts.KeyProps != nil {
+		err = errors.New("Pool can't have both a new key and an existing one")
+		return
+	}
+
 	err = os.Mkdir(path, 0755)
 	if err != nil {
 		return
@@ -42,78 +74,292 @@ func CreateSqlPool(path string) (err error) {
 		return
 	}
 
+	id := uuid.New()
+	if opts != nil && opts.UUID != "" {
+		id = opts.UUID
+	}
 	_, err = db.Exec("insert into props (key, value) values (?, ?)",
-		"uuid",
-		uuid.New())
+		"uuid", id)
 	if err != nil {
 		return
 	}
 
+	if opts != nil && opts.Codec != DefaultCodec {
+		_, err = db.Exec("insert into props (key, value) values (?, ?)",
+			"codec", opts.Codec.String())
+		if err != nil {
+			return
+		}
+	}
+
+	if opts != nil && opts.Passphrase != nil {
+		err = createKey(db, opts.Passphrase)
+		if err != nil {
+			return
+		}
+	}
+	if opts != nil && opts.KeyProps != nil {
+		err = writeKeyProps(db, opts.KeyProps)
+		if err != nil {
+			return
+		}
+	}
+
 	return
 }
 
 type SqlPool struct {
 	base string
 	db   *sql.DB
-	tx   *sql.Tx
+	lock *PoolLock
+
+	// The transaction for writing, which is nil when the pool is
+	// opened read-only.  Queries go through 'q', which is the
+	// transaction while writing, or the database itself, so that
+	// an idle writer doesn't keep others from committing.
+	tx      *sql.Tx
+	q       sqlQuerier
+	mode    LockMode
+	writing bool
+
+	// Features missing from older versions of the schema.
+	inabilities map[string]bool
+
+	// For encrypted pools, the key, otherwise nil.
+	key *poolKey
+
+	// The codec for new chunks.
+	codec Codec
+}
+
+// The methods shared by transactions and databases.
+type sqlQuerier interface {
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
-// Open an existing storage pool.
+// How long a statement waits for another process to finish writing
+// the database, in milliseconds.
+const sqlBusyTimeout = 60 * 1000
+
+// Open an existing storage pool, for exclusive use.  If the pool is
+// encrypted, the passphrase is requested through 'Passphrase'.
 func OpenSqlPool(path string) (pf Pool, err error) {
-	var pool SqlPool
-	pool.base = path
+	return openSqlPool(path, LockExclusive, Passphrase)
+}
+
+// Open an existing storage pool, for exclusive use, which may be
+// encrypted with the given passphrase.
+func OpenEncryptedPool(path string, passphrase []byte) (pf Pool, err error) {
+	return openSqlPool(path, LockExclusive, func(string) ([]byte, error) {
+		return passphrase, nil
+	})
+}
+
+// With LockShared, the pool is read without a transaction, so that it
+// doesn't keep writers from committing.  With LockWriter, the
+// transaction is only used from the first write.
+func openSqlPool(path string, mode LockMode, passphrase func(string) ([]byte, error)) (pf Pool, err error) {
+	pool := &SqlPool{base: path, mode: mode}
+	defer func() {
+		if err != nil {
+			pool.Close()
+		}
+	}()
 
-	pool.db, err = sql.Open("sqlite3", path+"/data.db")
+	pool.lock, err = LockPool(path, mode)
 	if err != nil {
 		return
 	}
 
-	_, err = checkSchema(pool.db, &poolSchema)
+	pool.db, err = sql.Open("sqlite3", fmt.Sprintf("%s/data.db?_busy_timeout=%d", path, sqlBusyTimeout))
 	if err != nil {
-		pool.db.Close()
 		return
 	}
 
-	pool.tx, err = pool.db.Begin()
+	pool.inabilities, err = checkSchema(pool.db, &poolSchema)
+	if err != nil {
+		return
+	}
+
+	pool.key, err = loadKey(pool.db, path, passphrase)
+	if err != nil {
+		return
+	}
+
+	pool.codec, err = loadCodec(pool.db, pool.inabilities)
 	if err != nil {
-		pool.db.Close()
 		return
 	}
 
-	pf = &pool
+	pool.q = pool.db
+	if mode != LockShared {
+		pool.tx, err = pool.db.Begin()
+		if err != nil {
+			return
+		}
+	}
+	if mode == LockExclusive {
+		err = pool.Begin()
+		if err != nil {
+			return
+		}
+	}
+
+	pf = pool
+	return
+}
+
+// Bring the schema of the pool at 'path' up to date.  The database is
+// copied to 'backup' first, which is "" if the pool was already
+// current.  Returns the version the pool had.  The pool must not be
+// in use.
+func UpgradeSqlPool(path string) (from, backup string, err error) {
+	fi, err := os.Stat(path + "/data.db")
+	if err != nil || !fi.Mode().IsRegular() {
+		err = fmt.Errorf("Does not appear to be an SQL pool: '%s'", err)
+		return
+	}
+
+	lock, err := LockPool(path, LockExclusive)
+	if err != nil {
+		return
+	}
+	defer lock.Unlock()
+
+	db, err := sql.Open("sqlite3", path+"/data.db")
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	from, err = schemaVersion(db)
+	if err != nil || from == poolSchema.version {
+		return
+	}
+	_, err = poolSchema.upgradePath(from)
+	if err != nil {
+		return
+	}
+
+	backup = fmt.Sprintf("%s/data.db.%s.bak", path, strings.Replace(from, ":", "-", -1))
+	err = copyFile(path+"/data.db", backup)
+	if err != nil {
+		return
+	}
+
+	_, err = upgradeSchema(db, &poolSchema)
+	return
+}
+
+// Copy a file, making sure the copy is written out.
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
 	return
 }
 
 func (pool *SqlPool) Close() (err error) {
-	err = pool.db.Close()
+	if pool.db != nil {
+		err = pool.db.Close()
+		pool.db = nil
+	}
+	if pool.lock != nil {
+		lockErr := pool.lock.Unlock()
+		if err == nil {
+			err = lockErr
+		}
+		pool.lock = nil
+	}
 	return
 }
 
 func (pool *SqlPool) Flush() (err error) {
+	if pool.tx == nil {
+		return
+	}
 	err = pool.tx.Commit()
 	if err != nil {
 		return err
 	}
 	pool.tx, err = pool.db.Begin()
+	if err != nil {
+		return
+	}
+	pool.q, pool.writing = pool.db, false
+	err = pool.lock.EndWrite()
+	if err == nil && pool.mode == LockExclusive {
+		err = pool.Begin()
+	}
+	return
+}
+
+// Start writing, unless already, waiting for the write lock.
+func (pool *SqlPool) Begin() (err error) {
+	if pool.tx == nil {
+		return errReadOnly
+	}
+	if pool.writing {
+		return
+	}
+	err = pool.lock.BeginWrite()
+	if err != nil {
+		return
+	}
+	pool.q, pool.writing = pool.tx, true
 	return
 }
 
 func (pool *SqlPool) Insert(chunk Chunk) (err error) {
+	err = pool.Begin()
+	if err != nil {
+		return
+	}
 	has, err := pool.Contains(chunk.OID())
 	if err != nil || has {
 		return
 	}
 
+	// Older pools can only hold zlib data.
+	codec := chunk.Codec()
+	if pool.inabilities["codec"] {
+		codec = CodecZlib
+	}
+
 	var zsize uint32
-	zdata, present := chunk.ZData()
+	var codecName interface{}
+	zdata, present := ZDataWith(chunk, codec)
 	if present && len(zdata) < int(chunk.DataLen()) {
 		zsize = uint32(len(zdata))
+		codecName = codec.String()
 	} else {
 		zsize = chunk.DataLen()
 		zdata = chunk.Data()
 	}
 
-	if zsize > 100000 {
+	// The zsize is always that of the unencrypted payload.
+	if pool.key != nil {
+		zdata = pool.key.seal(chunk.OID(), chunk.Kind(), zdata)
+	}
+
+	if len(zdata) > 100000 {
 		dir, file := pool.makeName(chunk.OID())
 		tmpErr := ioutil.WriteFile(file, zdata, 0644)
 		if tmpErr != nil {
@@ -129,28 +375,42 @@ func (pool *SqlPool) Insert(chunk Chunk) (err error) {
 		zdata = nil
 	}
 
-	_, err = pool.tx.Exec("INSERT OR FAIL INTO blobs (oid, kind, size, zsize, data) VALUES (?, ?, ?, ?, ?)",
+	if pool.inabilities["codec"] {
+		_, err = pool.tx.Exec("INSERT OR FAIL INTO blobs (oid, kind, size, zsize, data) VALUES (?, ?, ?, ?, ?)",
+			chunk.OID()[:], chunk.Kind().String(),
+			chunk.DataLen(),
+			zsize,
+			zdata)
+		return
+	}
+
+	_, err = pool.tx.Exec("INSERT OR FAIL INTO blobs (oid, kind, size, zsize, data, codec) VALUES (?, ?, ?, ?, ?, ?)",
 		chunk.OID()[:], chunk.Kind().String(),
 		chunk.DataLen(),
 		zsize,
-		zdata)
+		zdata,
+		codecName)
 	return
 }
 
 func (pool *SqlPool) Search(oid *OID) (chunk Chunk, err error) {
-	row := pool.tx.QueryRow("SELECT kind, size, zsize, data from BLOBS where oid = ?",
-		oid[:])
+	query := "SELECT kind, size, zsize, data, codec from BLOBS where oid = ?"
+	if pool.inabilities["codec"] {
+		query = "SELECT kind, size, zsize, data, NULL from BLOBS where oid = ?"
+	}
+	row := pool.q.QueryRow(query, oid[:])
 	var kind string
 	var size int
 	var zsize int
 	var data []byte
-	err = row.Scan(&kind, &size, &zsize, &data)
+	var codecName sql.NullString
+	err = row.Scan(&kind, &size, &zsize, &data, &codecName)
 	if err != nil {
 		return
 	}
 
 	if size == 0 {
-		chunk = newDataChunk(StringToKind(kind), oid, []byte{})
+		chunk = newDataChunk(StringToKind(kind), oid, []byte{}, pool.codec)
 		return
 	}
 
@@ -160,22 +420,41 @@ func (pool *SqlPool) Search(oid *OID) (chunk Chunk, err error) {
 		if err != nil {
 			return
 		}
-		if zsize != len(data) {
-			panic("Incorrect size read for chunk")
+	}
+
+	if pool.key != nil {
+		data, err = pool.key.open(oid, StringToKind(kind), data)
+		if err != nil {
+			err = fmt.Errorf("Unable to decrypt chunk %s: %s", oid.String(), err)
+			return
 		}
 	}
 
+	if zsize != len(data) {
+		err = fmt.Errorf("Incorrect size read for chunk %s: %d, expecting %d",
+			oid.String(), len(data), zsize)
+		return
+	}
+
 	if size == zsize {
-		chunk = newDataChunk(StringToKind(kind), oid, data)
-	} else {
-		chunk = newCompressedChunk(StringToKind(kind), oid, uint32(size), data)
+		chunk = newDataChunk(StringToKind(kind), oid, data, pool.codec)
+		return
 	}
-	return
+
+	// Chunks written before codecs were recorded are zlib.
+	codec := CodecZlib
+	if codecName.Valid {
+		codec, err = ParseCodec(codecName.String)
+		if err != nil {
+			return
+		}
+	}
+	return newCompressedChunk(StringToKind(kind), oid, uint32(size), data, codec)
 }
 
 func (pool *SqlPool) Backups() (backups []*OID, err error) {
 	result := make([]*OID, 0)
-	rows, err := pool.tx.Query("SELECT oid FROM blobs WHERE kind = 'back'")
+	rows, err := pool.q.Query("SELECT oid FROM blobs WHERE kind = 'back'")
 	if err != nil {
 		return
 	}
@@ -194,6 +473,53 @@ func (pool *SqlPool) Backups() (backups []*OID, err error) {
 	return
 }
 
+// Chunks are read in pages, ordered by OID, so that 'f' can use the
+// pool.
+func (pool *SqlPool) ForEachOID(f func(oid *OID) error) (err error) {
+	var last []byte
+	for {
+		var page []*OID
+		page, err = pool.oidPage(last, 4096)
+		if err != nil || len(page) == 0 {
+			return
+		}
+		for _, oid := range page {
+			err = f(oid)
+			if err != nil {
+				return
+			}
+		}
+		last = page[len(page)-1][:]
+	}
+}
+
+// Read up to 'limit' OIDs following 'after', or from the start if it
+// is nil.
+func (pool *SqlPool) oidPage(after []byte, limit int) (oids []*OID, err error) {
+	var rows *sql.Rows
+	if after == nil {
+		rows, err = pool.q.Query("SELECT oid FROM blobs ORDER BY oid LIMIT ?", limit)
+	} else {
+		rows, err = pool.q.Query("SELECT oid FROM blobs WHERE oid > ? ORDER BY oid LIMIT ?", after, limit)
+	}
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var raw []byte
+		err = rows.Scan(&raw)
+		if err != nil {
+			return
+		}
+		var oid OID
+		copy(oid[:], raw)
+		oids = append(oids, &oid)
+	}
+	err = rows.Err()
+	return
+}
+
 func (pool *SqlPool) makeName(oid *OID) (dir, file string) {
 	dir = fmt.Sprintf("%s/blobs/%02x", pool.base, oid[0])
 	file = fmt.Sprintf("%s/%x", dir, oid[1:])
@@ -201,7 +527,7 @@ func (pool *SqlPool) makeName(oid *OID) (dir, file string) {
 }
 
 func (pool *SqlPool) Contains(oid *OID) (result bool, err error) {
-	row := pool.tx.QueryRow("SELECT COUNT(*) FROM blobs WHERE oid = ?",
+	row := pool.q.QueryRow("SELECT COUNT(*) FROM blobs WHERE oid = ?",
 		oid[:])
 
 	var count int
@@ -214,46 +540,276 @@ func (pool *SqlPool) Contains(oid *OID) (result bool, err error) {
 	return
 }
 
-// Retrieve the tx handle, valid until the next flush.
+// The size column holds the length of the uncompressed data.
+func (pool *SqlPool) DataLen(oid *OID) (size uint32, err error) {
+	row := pool.q.QueryRow("SELECT size FROM blobs WHERE oid = ?", oid[:])
+	err = row.Scan(&size)
+	return
+}
+
+// Encrypted pools use a keyed hash for the OIDs.
+func (pool *SqlPool) BlobOID(kind string, data []byte) *OID {
+	if pool.key == nil {
+		return BlobOID(kind, data)
+	}
+	return pool.key.blobOID(kind, data)
+}
+
+// The codec for new chunks written to this pool.
+func (pool *SqlPool) Codec() Codec {
+	return pool.codec
+}
+
+// Remove the chunks that aren't reachable, along with any cached
+// file entries that refer to them.  The rows are removed, and
+// committed, before the spill files, so that an interruption leaves
+// stray files rather than rows whose data is missing.
+func (pool *SqlPool) Sweep(reachable map[OID]bool, dryRun bool) (stats *SweepStats, err error) {
+	var result SweepStats
+	if !dryRun {
+		err = pool.Begin()
+		if err != nil {
+			return
+		}
+	}
+
+	victims, spilled, err := pool.unreachable(reachable, &result)
+	if err != nil {
+		return
+	}
+
+	hasCache := !pool.inabilities["ctime_cache"]
+
+	if dryRun {
+		if hasCache {
+			err = pool.countCached(victims, &result)
+			if err != nil {
+				return
+			}
+		}
+		stats = &result
+		return
+	}
+
+	delBlob, err := pool.tx.Prepare("DELETE FROM blobs WHERE oid = ?")
+	if err != nil {
+		return
+	}
+	defer delBlob.Close()
+
+	var delCache *sql.Stmt
+	if hasCache {
+		delCache, err = pool.tx.Prepare("DELETE FROM ctime_cache WHERE oid = ?")
+		if err != nil {
+			return
+		}
+		defer delCache.Close()
+	}
+
+	for i := range victims {
+		_, err = delBlob.Exec(victims[i][:])
+		if err != nil {
+			return
+		}
+
+		if delCache == nil {
+			continue
+		}
+
+		var res sql.Result
+		res, err = delCache.Exec(victims[i][:])
+		if err != nil {
+			return
+		}
+		var count int64
+		count, err = res.RowsAffected()
+		if err != nil {
+			return
+		}
+		result.CacheEntries += count
+	}
+
+	if hasCache {
+		// Remove any directories left without entries.
+		_, err = pool.tx.Exec(`
+			DELETE FROM ctime_dirs
+			WHERE pkey NOT IN (
+				SELECT pkey FROM ctime_cache)`)
+		if err != nil {
+			return
+		}
+	}
+
+	// Let remote clients know that their caches may refer to
+	// removed chunks.
+	if len(victims) > 0 {
+		_, err = pool.tx.Exec("INSERT OR REPLACE INTO props (key, value) VALUES ('sweep', ?)",
+			uuid.New())
+		if err != nil {
+			return
+		}
+	}
+
+	err = pool.Flush()
+	if err != nil {
+		return
+	}
+
+	for i := range spilled {
+		_, file := pool.makeName(&spilled[i])
+		err = os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+
+	stats = &result
+	return
+}
+
+// Find all of the chunks in the pool that aren't reachable, and
+// which of those have their data in spill files.
+func (pool *SqlPool) unreachable(reachable map[OID]bool, stats *SweepStats) (victims, spilled []OID, err error) {
+	rows, err := pool.q.Query("SELECT oid, zsize, data IS NULL AND size > 0 FROM blobs")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var raw []byte
+		var zsize int64
+		var isFile bool
+		err = rows.Scan(&raw, &zsize, &isFile)
+		if err != nil {
+			return
+		}
+
+		var oid OID
+		copy(oid[:], raw)
+		if reachable[oid] {
+			continue
+		}
+
+		victims = append(victims, oid)
+		if isFile {
+			spilled = append(spilled, oid)
+		}
+		stats.Chunks++
+		stats.Bytes += zsize
+	}
+	err = rows.Err()
+	return
+}
+
+// Count the cached file entries that refer to any of the given
+// chunks.
+func (pool *SqlPool) countCached(victims []OID, stats *SweepStats) (err error) {
+	stmt, err := pool.q.Prepare("SELECT COUNT(*) FROM ctime_cache WHERE oid = ?")
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	for i := range victims {
+		var count int64
+		err = stmt.QueryRow(victims[i][:]).Scan(&count)
+		if err != nil {
+			return
+		}
+		stats.CacheEntries += count
+	}
+	return
+}
+
+// The pool's UUID, and a value that changes whenever chunks are
+// removed.  Either may be empty in older pools.
+func (pool *SqlPool) Identity() (id, sweep string, err error) {
+	for key, value := range map[string]*string{"uuid": &id, "sweep": &sweep} {
+		err = pool.q.QueryRow("SELECT value FROM props WHERE key = ?", key).Scan(value)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Retrieve the tx handle, valid until the next flush.  Pools opened
+// read-only have none.  Using it is writing, so Begin should be called
+// first, to see any error waiting for the write lock.
 func (pool *SqlPool) GetSqlTx() *sql.Tx {
+	if pool.tx == nil {
+		return nil
+	}
+	err := pool.Begin()
+	if err != nil {
+		log.Printf("Unable to write to pool: %s", err)
+		return nil
+	}
 	return pool.tx
 }
 
 var poolSchema = schema{
-	version: "1:2014-03-18",
+	version: "1:2026-10-17",
 	compats: []schemaCompat{
+		{
+			version:     "1:2014-03-18",
+			inabilities: []string{"codec"},
+		},
 		{
 			version:     "1:2014-03-13",
-			inabilities: []string{"filesystems", "ctime_cache"},
+			inabilities: []string{"filesystems", "ctime_cache", "codec"},
 		},
 	},
-	schema: []string{
+	migrations: []schemaMigration{
+		{
+			from:  "1:2014-03-13",
+			to:    "1:2014-03-18",
+			stmts: cacheTables,
+		},
+		{
+			from:  "1:2014-03-18",
+			to:    "1:2026-10-17",
+			stmts: []string{`ALTER TABLE blobs ADD COLUMN codec text`},
+		},
+	},
+	schema: append([]string{
 		`CREATE TABLE blobs (
 			id integer primary key,
 			oid blob unique not null,
 			kind text,
 			size integer,
 			zsize integer,
-			data blob)`,
+			data blob,
+			codec text)`,
 		`CREATE INDEX blobs_oid ON blobs(oid)`,
 		`CREATE INDEX blobs_backs ON blobs(kind) where kind = 'back'`,
 		`CREATE TABLE props (
 			key text primary key,
 			value text)`,
-		`CREATE TABLE filesystems (
-			fsid INTEGER PRIMARY KEY,
-			uuid TEXT UNIQUE)`,
-		`CREATE TABLE ctime_dirs (
-			pkey INTEGER PRIMARY KEY,
-			fsid INTEGER REFERENCES filesystems (fsid) NOT NULL,
-			pino INTEGER NOT NULL,
-			UNIQUE (fsid, pino))`,
-		`CREATE TABLE ctime_cache (
-			pkey INTEGER REFERENCES ctime_dirs (pkey) NOT NULL,
-			ino INTEGER NOT NULL,
-			expire INTEGER NOT NULL,
-			ctime INTEGER NOT NULL,
-			oid blob NOT NULL)`,
-		`CREATE INDEX ctime_cache_pkey ON ctime_cache(pkey)`,
-	},
+	}, cacheTables...),
+}
+
+// The tables holding the cache of file ctimes used by dumps.  Remote
+// and file pools keep these in a database of their own.
+var cacheTables = []string{
+	`CREATE TABLE filesystems (
+		fsid INTEGER PRIMARY KEY,
+		uuid TEXT UNIQUE)`,
+	`CREATE TABLE ctime_dirs (
+		pkey INTEGER PRIMARY KEY,
+		fsid INTEGER REFERENCES filesystems (fsid) NOT NULL,
+		pino INTEGER NOT NULL,
+		UNIQUE (fsid, pino))`,
+	`CREATE TABLE ctime_cache (
+		pkey INTEGER REFERENCES ctime_dirs (pkey) NOT NULL,
+		ino INTEGER NOT NULL,
+		expire INTEGER NOT NULL,
+		ctime INTEGER NOT NULL,
+		oid blob NOT NULL)`,
+	`CREATE INDEX ctime_cache_pkey ON ctime_cache(pkey)`,
 }
@@ -5,6 +5,7 @@ package pool
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 )
 
 // A desired database schema.
@@ -12,6 +13,17 @@ type schema struct {
 	version string
 	schema  []string
 	compats []schemaCompat
+
+	// The steps that bring older databases up to this version.
+	migrations []schemaMigration
+}
+
+// A step that upgrades a database from one schema version to the
+// next.
+type schemaMigration struct {
+	from  string
+	to    string
+	stmts []string
 }
 
 // For compatibility with older schemas, each can have an associated
@@ -80,7 +92,75 @@ func checkSchema(db *sql.DB, schema *schema) (inabilities map[string]bool, err e
 		}
 	}
 
+	if _, pathErr := schema.upgradePath(version); pathErr == nil {
+		err = fmt.Errorf("Schema version %s is out of date, \"godump upgrade\" will update it to %s",
+			version, schema.version)
+		return
+	}
+
 	err = errors.New("Schema version mismatch, expect: " +
 		schema.version + " got: " + version)
 	return
 }
+
+func schemaVersion(db *sql.DB) (version string, err error) {
+	err = db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	return
+}
+
+// The migrations that take a database from 'version' to the current
+// one, in order.
+func (schema *schema) upgradePath(version string) (steps []schemaMigration, err error) {
+	for version != schema.version {
+		found := false
+		for _, step := range schema.migrations {
+			if step.from == version {
+				steps = append(steps, step)
+				version = step.to
+				found = true
+				break
+			}
+		}
+		if !found || len(steps) > len(schema.migrations) {
+			err = fmt.Errorf("No upgrade from schema version %s to %s", version, schema.version)
+			return
+		}
+	}
+	return
+}
+
+// Bring the database up to the current version of the schema, one
+// step at a time, within a single transaction.  Returns the version
+// the database had.
+func upgradeSchema(db *sql.DB, schema *schema) (from string, err error) {
+	from, err = schemaVersion(db)
+	if err != nil {
+		return
+	}
+	steps, err := schema.upgradePath(from)
+	if err != nil || len(steps) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	for _, step := range steps {
+		for _, stmt := range step.stmts {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				tx.Rollback()
+				err = fmt.Errorf("Upgrading schema from %s to %s: %s", step.from, step.to, err)
+				return
+			}
+		}
+		_, err = tx.Exec("UPDATE schema_version SET version = ?", step.to)
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	err = tx.Commit()
+	return
+}
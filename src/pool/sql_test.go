@@ -5,6 +5,7 @@ package pool_test
 import (
 	"bytes"
 	"os"
+	"path/filepath"
 	"testing"
 
 	// "pdump"
@@ -20,7 +21,7 @@ func TestCreate(t *testing.T) {
 	defer os.RemoveAll(tmp)
 
 	base := tmp + "/pool"
-	err = pool.CreateSqlPool(base)
+	err = pool.CreateSqlPool(base, nil)
 	if err != nil {
 		t.Errorf("Unable to create pool: '%s'", err)
 	}
@@ -127,3 +128,214 @@ func TestBasic(t *testing.T) {
 	pt.Flush()
 	pt.Check()
 }
+
+func TestSweep(t *testing.T) {
+	pt := NewPoolTest(t)
+	defer pt.Clean()
+
+	// The large random chunks don't compress, and end up in spill
+	// files.
+	for _, sz := range makeSizes() {
+		pt.Insert(sz)
+		if sz > 16 {
+			pt.InsertRandom(sz)
+		}
+	}
+	pt.Flush()
+
+	// Keep alternating pairs of chunks, so that both the kept and
+	// removed chunks include some in spill files.
+	reachable := make(map[pool.OID]bool)
+	keep := make([]pool.Chunk, 0)
+	drop := make([]pool.Chunk, 0)
+	for i, ch := range pt.known {
+		if (i/2)%2 == 0 {
+			reachable[*ch.OID()] = true
+			keep = append(keep, ch)
+		} else {
+			drop = append(drop, ch)
+		}
+	}
+
+	stats, err := pool.Sweep(pt.Pool, reachable, true)
+	if err != nil {
+		t.Fatalf("Error in dry run sweep: '%s'", err)
+	}
+	if stats.Chunks != int64(len(drop)) {
+		t.Errorf("Dry run would remove %d chunks, expect %d", stats.Chunks, len(drop))
+	}
+	pt.Check()
+
+	stats, err = pool.Sweep(pt.Pool, reachable, false)
+	if err != nil {
+		t.Fatalf("Error sweeping: '%s'", err)
+	}
+	if stats.Chunks != int64(len(drop)) {
+		t.Errorf("Removed %d chunks, expect %d", stats.Chunks, len(drop))
+	}
+
+	for _, ch := range drop {
+		has, err := pt.Pool.Contains(ch.OID())
+		if err != nil {
+			t.Errorf("Error checking if pool contains blob.")
+		}
+		if has {
+			t.Errorf("Pool should no longer contain blob.")
+		}
+	}
+
+	pt.known = keep
+	pt.Check()
+
+	blobs, err := filepath.Glob(pt.Tmp.Path() + "/pool/blobs/*/*")
+	if err != nil {
+		t.Fatalf("Error listing spill files: '%s'", err)
+	}
+	for _, name := range blobs {
+		oid, err := pool.ParseOID(filepath.Base(filepath.Dir(name)) + filepath.Base(name))
+		if err != nil {
+			t.Errorf("Invalid spill file name: %q", name)
+			continue
+		}
+		if !reachable[*oid] {
+			t.Errorf("Spill file not removed: %q", name)
+		}
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	tmp := tutil.NewTempDir(t)
+	defer tmp.Clean()
+
+	base := tmp.Path() + "/pool"
+	pass := []byte("secret")
+	err := pool.CreateSqlPool(base, &pool.CreateOptions{Passphrase: pass})
+	if err != nil {
+		t.Fatalf("Unable to create pool: '%s'", err)
+	}
+
+	_, err = pool.OpenEncryptedPool(base, []byte("wrong"))
+	if err == nil {
+		t.Fatalf("Opened pool with the wrong passphrase")
+	}
+
+	pl, err := pool.OpenEncryptedPool(base, pass)
+	if err != nil {
+		t.Fatalf("Unable to open pool: '%s'", err)
+	}
+
+	known := make([]pool.Chunk, 0)
+	for _, sz := range makeSizes() {
+		data := []byte(pool.MakeRandomSentence(sz, sz))
+		ch := pool.NewPoolChunk(pl, "blob", data)
+		if sz > 0 && ch.OID().Compare(pool.BlobOID("blob", data)) == 0 {
+			t.Errorf("Encrypted pool uses plain OIDs")
+		}
+		err = pl.Insert(ch)
+		if err != nil {
+			t.Errorf("Error inserting chunk: '%s'", err)
+		}
+		known = append(known, ch)
+	}
+	err = pl.Flush()
+	if err != nil {
+		t.Errorf("Error flushing: '%s'", err)
+	}
+	pl.Close()
+
+	pl, err = pool.OpenEncryptedPool(base, pass)
+	if err != nil {
+		t.Fatalf("Unable to reopen pool: '%s'", err)
+	}
+	defer pl.Close()
+
+	for _, ch := range known {
+		ch2, err := pl.Search(ch.OID())
+		if err != nil {
+			t.Errorf("Error reading chunk: '%s'", err)
+			continue
+		}
+		if !bytes.Equal(ch.Data(), ch2.Data()) {
+			t.Errorf("Chunk did not reread correctly")
+		}
+		err = pool.VerifyChunk(pl, ch2)
+		if err != nil {
+			t.Errorf("Chunk does not verify: '%s'", err)
+		}
+	}
+}
+
+func TestCodec(t *testing.T) {
+	tmp := tutil.NewTempDir(t)
+	defer tmp.Clean()
+
+	base := tmp.Path() + "/pool"
+	err := pool.CreateSqlPool(base, &pool.CreateOptions{Codec: pool.CodecZstd})
+	if err != nil {
+		t.Fatalf("Unable to create pool: '%s'", err)
+	}
+
+	pl, err := pool.OpenPool(base)
+	if err != nil {
+		t.Fatalf("Unable to open pool: '%s'", err)
+	}
+
+	// Chunks made for the pool use its codec, but others keep
+	// the codec they have.
+	known := make([]pool.Chunk, 0)
+	for i, sz := range makeSizes() {
+		data := []byte(pool.MakeRandomSentence(i, sz))
+		var ch pool.Chunk
+		if i%2 == 0 {
+			ch = pool.NewPoolChunk(pl, "blob", data)
+		} else {
+			ch = pool.NewChunk("blob", data)
+		}
+		err = pl.Insert(ch)
+		if err != nil {
+			t.Errorf("Error inserting chunk: '%s'", err)
+		}
+		known = append(known, ch)
+	}
+	err = pl.Flush()
+	if err != nil {
+		t.Errorf("Error flushing: '%s'", err)
+	}
+	pl.Close()
+
+	pl, err = pool.OpenPool(base)
+	if err != nil {
+		t.Fatalf("Unable to reopen pool: '%s'", err)
+	}
+	defer pl.Close()
+
+	for _, ch := range known {
+		ch2, err := pl.Search(ch.OID())
+		if err != nil {
+			t.Errorf("Error reading chunk: '%s'", err)
+			continue
+		}
+		if _, present := ch2.ZData(); present && ch2.Codec() != ch.Codec() {
+			t.Errorf("Chunk read with codec %s, expecting %s", ch2.Codec(), ch.Codec())
+		}
+
+		// The codec must also survive being written out.
+		var buf bytes.Buffer
+		err = pool.ChunkWrite(ch2, &buf)
+		if err != nil {
+			t.Errorf("Error writing chunk: '%s'", err)
+		}
+		ch3, _, err := pool.ChunkRead(&buf)
+		if err != nil {
+			t.Errorf("Error rereading chunk: '%s'", err)
+			continue
+		}
+		if !bytes.Equal(ch.Data(), ch3.Data()) {
+			t.Errorf("Chunk did not reread correctly")
+		}
+		err = pool.VerifyChunk(pl, ch3)
+		if err != nil {
+			t.Errorf("Chunk does not verify: '%s'", err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Test upgrading the schema of SQL pools.
+
+package pool_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"pool"
+	"tutil"
+)
+
+// The schema pools were first created with.
+var oldSchema = []string{
+	`CREATE TABLE blobs (
+		id integer primary key,
+		oid blob unique not null,
+		kind text,
+		size integer,
+		zsize integer,
+		data blob)`,
+	`CREATE INDEX blobs_oid ON blobs(oid)`,
+	`CREATE INDEX blobs_backs ON blobs(kind) where kind = 'back'`,
+	`CREATE TABLE props (
+		key text primary key,
+		value text)`,
+	`CREATE TABLE schema_version (version text)`,
+	`INSERT INTO schema_version VALUES ('1:2014-03-13')`,
+	`INSERT INTO props VALUES ('uuid', 'old-pool')`,
+}
+
+func TestUpgrade(t *testing.T) {
+	tmp := tutil.NewTempDir(t)
+	defer tmp.Clean()
+
+	base := tmp.Path() + "/pool"
+	err := os.MkdirAll(base+"/blobs", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", base+"/data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range oldSchema {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatalf("Error making old pool: '%s'", err)
+		}
+	}
+	db.Close()
+
+	// Old pools can still be used as they are.
+	pl, err := pool.OpenPool(base)
+	if err != nil {
+		t.Fatalf("Unable to open old pool: '%s'", err)
+	}
+	old := pool.MakeRandomChunk(1000)
+	err = pl.Insert(old)
+	if err == nil {
+		err = pl.Flush()
+	}
+	if err != nil {
+		t.Fatalf("Error writing to old pool: '%s'", err)
+	}
+	pl.Close()
+
+	from, backup, err := pool.UpgradeSqlPool(base)
+	if err != nil {
+		t.Fatalf("Error upgrading: '%s'", err)
+	}
+	if from != "1:2014-03-13" {
+		t.Errorf("Upgraded from %q", from)
+	}
+	if _, err := os.Stat(backup); err != nil {
+		t.Errorf("No backup made: '%s'", err)
+	}
+
+	// The upgraded pool has the cache tables, and can store zstd
+	// chunks.
+	pl, err = pool.OpenPool(base)
+	if err != nil {
+		t.Fatalf("Unable to open upgraded pool: '%s'", err)
+	}
+	_, err = pool.GetSql(pl).Exec("INSERT INTO filesystems (uuid) VALUES ('fs')")
+	if err != nil {
+		t.Errorf("Upgraded pool has no cache: '%s'", err)
+	}
+	data := []byte(pool.MakeRandomSentence(3, 5000))
+	ch := pool.NewPoolChunk(&zstdPool{pl}, "blob", data)
+	err = pl.Insert(ch)
+	if err == nil {
+		err = pl.Flush()
+	}
+	if err != nil {
+		t.Fatalf("Error writing to upgraded pool: '%s'", err)
+	}
+	pl.Close()
+
+	pl, err = pool.OpenPool(base)
+	if err != nil {
+		t.Fatalf("Unable to reopen pool: '%s'", err)
+	}
+	for _, want := range []pool.Chunk{old, ch} {
+		got, err := pl.Search(want.OID())
+		if err != nil {
+			t.Errorf("Error reading chunk: '%s'", err)
+			continue
+		}
+		if _, present := got.ZData(); present && got.Codec() != want.Codec() {
+			t.Errorf("Chunk read with codec %s, expecting %s", got.Codec(), want.Codec())
+		}
+	}
+	pl.Close()
+
+	from, backup, err = pool.UpgradeSqlPool(base)
+	if err != nil || backup != "" {
+		t.Errorf("Upgrading a current pool gave %q, %q, %v", from, backup, err)
+	}
+}
+
+// Makes chunks with zstd, whatever the pool uses.
+type zstdPool struct {
+	pool.Pool
+}
+
+func (zstdPool) Codec() pool.Codec {
+	return pool.CodecZstd
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+)
+
+// Splitting file data into the blobs written to the pool.
+
+// A Chunker divides a stream of file data into pieces, each of which
+// is stored as a single blob.
+type Chunker interface {
+	// Return the next piece of the data.  The slice is only valid
+	// until the following call.  Returns io.EOF after the last
+	// piece.
+	Next() (data []byte, err error)
+}
+
+// The chunker used when a backup doesn't ask for one.
+const DefaultChunker = "fixed"
+
+var chunkers = map[string]func(rd io.Reader, name string) Chunker{
+	"fixed":   newFixedChunker,
+	"buzhash": newBuzChunker,
+}
+
+// Construct a chunker of the named kind reading from 'rd'.  The
+// 'name' is only used for diagnostics.
+func NewChunker(kind string, rd io.Reader, name string) (ch Chunker, err error) {
+	err = CheckChunker(kind)
+	if err != nil {
+		return
+	}
+	ch = chunkers[kind](rd, name)
+	return
+}
+
+// Make sure that the named chunker exists.
+func CheckChunker(kind string) (err error) {
+	if _, ok := chunkers[kind]; !ok {
+		err = fmt.Errorf("Unknown chunker: %q", kind)
+	}
+	return
+}
+
+// The fixed chunker splits the data into 256K pieces, or whatever
+// each read returns.
+const fixedBlockSize = 256 * 1024
+
+type fixedChunker struct {
+	rd         io.Reader
+	name       string
+	buffer     []byte
+	shortCount int
+}
+
+func newFixedChunker(rd io.Reader, name string) Chunker {
+	return &fixedChunker{
+		rd:     rd,
+		name:   name,
+		buffer: make([]byte, fixedBlockSize),
+	}
+}
+
+func (self *fixedChunker) Next() (data []byte, err error) {
+	n, err := self.rd.Read(self.buffer)
+	if err != nil {
+		return
+	}
+
+	if n < len(self.buffer) {
+		self.shortCount++
+		if self.shortCount > 1 {
+			log.Printf("WARN: multiple short reads from %s", self.name)
+		}
+	}
+
+	data = self.buffer[0:n]
+	return
+}
+
+// The buzhash chunker places chunk boundaries where a rolling hash of
+// the last few bytes matches a pattern.  Since the boundaries depend
+// only on nearby content, inserting or removing data only changes
+// the chunks around the edit, and the rest of the file still
+// deduplicates against earlier backups.
+type buzChunker struct {
+	rd   io.Reader
+	eof  bool
+	min  int
+	mask uint32
+
+	// Data read, but not yet returned, is at buffer[pos:].
+	buffer []byte
+	pos    int
+}
+
+// Past the minimum, a boundary is expected every 256K, so chunks
+// average a little over 300K.
+const (
+	buzWindow  = 64
+	buzMinSize = 64 * 1024
+	buzMaxSize = 1024 * 1024
+	buzMask    = 256*1024 - 1
+)
+
+func newBuzChunker(rd io.Reader, name string) Chunker {
+	return &buzChunker{
+		rd:     rd,
+		min:    buzMinSize,
+		mask:   buzMask,
+		buffer: make([]byte, 0, buzMaxSize),
+	}
+}
+
+func (self *buzChunker) Next() (data []byte, err error) {
+	err = self.fill()
+	if err != nil {
+		return
+	}
+
+	rest := self.buffer[self.pos:]
+	if len(rest) == 0 {
+		err = io.EOF
+		return
+	}
+
+	size := self.cut(rest)
+	data = rest[:size]
+	self.pos += size
+	return
+}
+
+// Move any unreturned data to the front of the buffer, and read until
+// the buffer is full, or the data runs out.
+func (self *buzChunker) fill() (err error) {
+	count := copy(self.buffer[:cap(self.buffer)], self.buffer[self.pos:])
+	self.buffer = self.buffer[:count]
+	self.pos = 0
+
+	for !self.eof && len(self.buffer) < cap(self.buffer) {
+		var n int
+		n, err = self.rd.Read(self.buffer[len(self.buffer):cap(self.buffer)])
+		self.buffer = self.buffer[:len(self.buffer)+n]
+		if err == io.EOF {
+			self.eof = true
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Find the length of the first chunk in 'data'.  'data' is always as
+// large as the maximum chunk size, unless the end of the file has
+// been reached.
+func (self *buzChunker) cut(data []byte) int {
+	if len(data) <= self.min {
+		return len(data)
+	}
+
+	var hash uint32
+	for i := self.min - buzWindow; i < self.min; i++ {
+		hash = bits.RotateLeft32(hash, 1) ^ buzTable[data[i]]
+	}
+
+	for i := self.min; i < len(data); i++ {
+		if hash&self.mask == 0 {
+			return i
+		}
+		hash = bits.RotateLeft32(hash, 1) ^
+			bits.RotateLeft32(buzTable[data[i-buzWindow]], buzWindow) ^
+			buzTable[data[i]]
+	}
+	return len(data)
+}
+
+// The byte values for the hash.  These must never change, or chunks
+// from new backups will no longer line up with those already in the
+// pool.
+var buzTable [256]uint32
+
+func init() {
+	// Fill the table from a simple xorshift generator with a
+	// fixed seed.
+	state := uint32(0x2545f491)
+	for i := range buzTable {
+		state ^= state << 13
+		state ^= state >> 17
+		state ^= state << 5
+		buzTable[i] = state
+	}
+}
@@ -0,0 +1,94 @@
+package store_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"pool"
+	"store"
+)
+
+// Generate a block of pseudo-random data.
+func makeRandom(size int) []byte {
+	buf := make([]byte, size)
+	state := uint32(size)
+
+	for i := range buf {
+		state = ((state * 1103515245) + 12345) & 0x7fffffff
+		buf[i] = byte(state >> 16)
+	}
+	return buf
+}
+
+// Split the data into pieces with the given chunker, returning the
+// OIDs of the pieces.
+func chunkAll(t *testing.T, kind string, data []byte) (oids []*pool.OID) {
+	ch, err := store.NewChunker(kind, bytes.NewReader(data), "test")
+	if err != nil {
+		t.Fatalf("Unable to make chunker: %q", err)
+	}
+
+	var whole bytes.Buffer
+	for {
+		piece, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error chunking: %q", err)
+		}
+		if len(piece) == 0 || len(piece) > 1024*1024 {
+			t.Errorf("Invalid chunk size: %d", len(piece))
+		}
+		whole.Write(piece)
+		oids = append(oids, pool.BlobOID("blob", piece))
+	}
+
+	if !bytes.Equal(whole.Bytes(), data) {
+		t.Errorf("Chunks don't reassemble to the original data")
+	}
+	return
+}
+
+func TestFixedChunker(t *testing.T) {
+	data := makeRandom(1000000)
+	oids := chunkAll(t, "fixed", data)
+	if len(oids) != 4 {
+		t.Errorf("Expecting 4 chunks, got %d", len(oids))
+	}
+}
+
+// Inserting data at the start of a file should only change the first
+// chunk.
+func TestBuzChunker(t *testing.T) {
+	data := makeRandom(8 * 1024 * 1024)
+	oids := chunkAll(t, "buzhash", data)
+	if len(oids) < 8 {
+		t.Errorf("Too few chunks: %d", len(oids))
+	}
+
+	shifted := append([]byte("inserted"), data...)
+	oids2 := chunkAll(t, "buzhash", shifted)
+
+	seen := make(map[pool.OID]bool)
+	for _, oid := range oids {
+		seen[*oid] = true
+	}
+	shared := 0
+	for _, oid := range oids2 {
+		if seen[*oid] {
+			shared++
+		}
+	}
+	if shared < len(oids)-1 {
+		t.Errorf("Only %d of %d chunks shared after insert", shared, len(oids))
+	}
+}
+
+func TestUnknownChunker(t *testing.T) {
+	err := store.CheckChunker("bogus")
+	if err == nil {
+		t.Errorf("Unknown chunker accepted")
+	}
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"pool"
+)
+
+// Copying backups between pools.  Chunks already in the destination
+// aren't descended into, so repeated copies only send what is new.
+//
+// This relies on a chunk in a pool meaning that everything it refers
+// to is there as well.  So, like a dump, the copy inserts each chunk
+// only after the chunks it refers to, and the backup record last.
+// Pools may make inserted chunks durable before the flush (a file pool
+// when it starts a new data file), and an interrupted copy then leaves
+// only complete subtrees behind, which the next copy can skip.
+type Copier struct {
+	src, dst pool.Pool
+
+	// Progress, since the copier was made.
+	Backups int64
+	Chunks  int64
+	Bytes   int64
+	Skipped int64
+
+	// If set, called after each chunk.
+	Progress func()
+
+	// The backup record of the backup being copied.
+	back pool.Chunk
+
+	PathTrackerImpl
+	EmptyVisitor
+}
+
+// Make a copier between two pools.  Both pools must compute OIDs the
+// same way, which means that encrypted pools can only be copied to a
+// pool with the same key.
+func NewCopier(src, dst pool.Pool) (self *Copier, err error) {
+	probe := []byte("godump copy probe")
+	if pool.PoolOID(src, "blob", probe).Compare(pool.PoolOID(dst, "blob", probe)) != 0 {
+		err = errors.New("Pools compute chunk OIDs differently, (encrypted with different keys?), unable to copy")
+		return
+	}
+
+	self = &Copier{src: src, dst: dst}
+	self.InitPath()
+	return
+}
+
+// Copy the backup with the given backup record.
+func (self *Copier) Copy(id *pool.OID) (err error) {
+	ch, err := self.src.Search(id)
+	if err != nil {
+		return
+	}
+	if ch.Kind() != pool.StringToKind("back") {
+		err = fmt.Errorf("Chunk %s is a %q, not a backup", id.String(), ch.Kind().String())
+		return
+	}
+
+	self.back = nil
+	err = Walk(self.src, id, self)
+	if err != nil {
+		return
+	}
+	if self.back == nil {
+		// Already present.
+		return
+	}
+
+	err = self.dst.Insert(self.back)
+	if err != nil {
+		return
+	}
+	err = self.dst.Flush()
+	if err != nil {
+		return
+	}
+	self.Backups++
+	return
+}
+
+func (self *Copier) EarlyVisit(oid *pool.OID) (err error) {
+	present, err := self.dst.Contains(oid)
+	if err != nil {
+		return
+	}
+	if present {
+		self.Skipped++
+		return Prune
+	}
+	return
+}
+
+func (self *Copier) Chunk(chunk pool.Chunk) (err error) {
+	// The backup record is held back until everything else is
+	// in place.
+	if chunk.Kind() == pool.StringToKind("back") {
+		self.back = chunk
+	}
+	return
+}
+
+// Insert each chunk after the ones it refers to.
+func (self *Copier) LateVisit(chunk pool.Chunk) (err error) {
+	if chunk.Kind() == pool.StringToKind("back") {
+		return
+	}
+
+	// The chunk is inserted as it was read, keeping the codec
+	// and the compressed data.
+	err = self.dst.Insert(chunk)
+	if err != nil {
+		return
+	}
+
+	self.Chunks++
+	self.Bytes += int64(chunk.DataLen())
+	if self.Progress != nil {
+		self.Progress()
+	}
+	return
+}
@@ -0,0 +1,209 @@
+package store_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"pool"
+	"store"
+	"tutil"
+)
+
+// Write a backup record for the tree at 'root'.
+func writeBack(t *testing.T, pl pool.Pool, root *pool.OID, date string) *pool.OID {
+	back := store.NewPropertyMap("back")
+	back.Props["hash"] = root.String()
+	back.Props["_date"] = date
+	return writeNode(t, pl, "back", back)
+}
+
+func TestCopier(t *testing.T) {
+	src := tutil.NewPoolTest(t)
+	defer src.Clean()
+	dst := tutil.NewPoolTest(t)
+	defer dst.Clean()
+
+	data, err := store.WriteData(src.Pool, bytes.NewReader(makeRandom(1024*1024)), "file", "fixed", 1)
+	if err != nil {
+		t.Fatalf("Error writing file: %q", err)
+	}
+	file := store.NewPropertyMap("REG")
+	file.Props["data"] = data.String()
+	fileOID := writeNode(t, src.Pool, "node", file)
+
+	sub := writeDirNode(t, src.Pool, []store.DirEntry{{Name: "file", OID: fileOID}})
+	root1 := writeDirNode(t, src.Pool, []store.DirEntry{{Name: "sub", OID: sub}})
+	back1 := writeBack(t, src.Pool, root1, "1000")
+	root2 := writeDirNode(t, src.Pool, []store.DirEntry{{Name: "sub", OID: sub}, {Name: "again", OID: fileOID}})
+	back2 := writeBack(t, src.Pool, root2, "2000")
+	err = src.Pool.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing: %q", err)
+	}
+
+	copier, err := store.NewCopier(src.Pool, dst.Pool)
+	if err != nil {
+		t.Fatalf("Unable to make copier: %q", err)
+	}
+	err = copier.Copy(back1)
+	if err != nil {
+		t.Fatalf("Error copying: %q", err)
+	}
+	first := copier.Chunks
+
+	// The second backup only adds its root directory.
+	err = copier.Copy(back2)
+	if err != nil {
+		t.Fatalf("Error copying: %q", err)
+	}
+	if copier.Chunks-first != 2 {
+		t.Errorf("Second copy wrote %d chunks, expecting 2", copier.Chunks-first)
+	}
+
+	// Copying again does nothing.
+	before := copier.Chunks
+	err = copier.Copy(back2)
+	if err != nil || copier.Chunks != before {
+		t.Errorf("Repeated copy wrote %d chunks (%v)", copier.Chunks-before, err)
+	}
+
+	if copier.Backups != 2 {
+		t.Errorf("Copied %d backups, expecting 2", copier.Backups)
+	}
+
+	backups, err := dst.Pool.Backups()
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("Destination has %d backups (%v), expecting 2", len(backups), err)
+	}
+
+	// Every chunk of the copies must read back the same.
+	for _, back := range []*pool.OID{back1, back2} {
+		var check copyCheck
+		check.src = src.Pool
+		check.InitPath()
+		err = store.Walk(dst.Pool, back, &check)
+		if err != nil {
+			t.Errorf("Error walking copy: %q", err)
+		}
+		for _, problem := range check.problems {
+			t.Error(problem)
+		}
+	}
+
+	// Only backup records can be copied.
+	err = copier.Copy(root1)
+	if err == nil {
+		t.Errorf("Copying a directory should have failed")
+	}
+}
+
+// A pool that fails, as if the process died, after 'left' inserts.
+type failingPool struct {
+	pool.Pool
+	left int
+}
+
+func (self *failingPool) Insert(chunk pool.Chunk) error {
+	if self.left == 0 {
+		return errors.New("Simulated crash")
+	}
+	self.left--
+	return self.Pool.Insert(chunk)
+}
+
+func TestCopierInterrupted(t *testing.T) {
+	src := tutil.NewPoolTest(t)
+	defer src.Clean()
+	tmp := tutil.NewTempDir(t)
+	defer tmp.Clean()
+	t.Setenv("XDG_CACHE_HOME", tmp.Path()+"/cache")
+
+	data, err := store.WriteData(src.Pool, bytes.NewReader(makeRandom(1024*1024)), "file", "fixed", 1)
+	if err != nil {
+		t.Fatalf("Error writing file: %q", err)
+	}
+	file := store.NewPropertyMap("REG")
+	file.Props["data"] = data.String()
+	fileOID := writeNode(t, src.Pool, "node", file)
+	sub := writeDirNode(t, src.Pool, []store.DirEntry{{Name: "file", OID: fileOID}})
+	root := writeDirNode(t, src.Pool, []store.DirEntry{{Name: "sub", OID: sub}})
+	back := writeBack(t, src.Pool, root, "1000")
+	err = src.Pool.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing: %q", err)
+	}
+
+	// Each block fills a data file, so the pool makes the chunks
+	// before it durable without a flush.
+	base := tmp.Path() + "/dst"
+	err = pool.CreateFilePool(base, &pool.CreateOptions{FileLimit: 64 * 1024})
+	if err != nil {
+		t.Fatalf("Unable to create pool: %q", err)
+	}
+	dst, err := pool.OpenFilePool(base)
+	if err != nil {
+		t.Fatalf("Unable to open pool: %q", err)
+	}
+	copier, err := store.NewCopier(src.Pool, &failingPool{Pool: dst, left: 8})
+	if err != nil {
+		t.Fatalf("Unable to make copier: %q", err)
+	}
+	err = copier.Copy(back)
+	if err == nil {
+		t.Fatalf("Interrupted copy should fail")
+	}
+	err = dst.Close()
+	if err != nil {
+		t.Fatalf("Error closing pool: %q", err)
+	}
+
+	// Copying again must complete the backup, rather than skip
+	// the parts that were kept.
+	dst, err = pool.OpenFilePool(base)
+	if err != nil {
+		t.Fatalf("Unable to reopen pool: %q", err)
+	}
+	defer dst.Close()
+	copier, err = store.NewCopier(src.Pool, dst)
+	if err != nil {
+		t.Fatalf("Unable to make copier: %q", err)
+	}
+	err = copier.Copy(back)
+	if err != nil {
+		t.Fatalf("Error copying: %q", err)
+	}
+	if copier.Skipped == 0 {
+		t.Errorf("Nothing of the interrupted copy was kept")
+	}
+
+	var check copyCheck
+	check.src = src.Pool
+	check.InitPath()
+	err = store.Walk(dst, back, &check)
+	if err != nil {
+		t.Errorf("Error walking copy: %q", err)
+	}
+	for _, problem := range check.problems {
+		t.Error(problem)
+	}
+}
+
+type copyCheck struct {
+	src      pool.Pool
+	problems []string
+
+	store.PathTrackerImpl
+	store.EmptyVisitor
+}
+
+func (self *copyCheck) Chunk(chunk pool.Chunk) (err error) {
+	orig, err := self.src.Search(chunk.OID())
+	if err != nil {
+		return
+	}
+	if orig.Kind() != chunk.Kind() || string(orig.Data()) != string(chunk.Data()) {
+		self.problems = append(self.problems, "Chunk "+chunk.OID().String()+" differs")
+	}
+	return
+}
@@ -30,6 +30,7 @@ func Walk(p pool.Pool, root *pool.OID, visit Visitor) (err error) {
 		pool.StringToKind("node"): self.nodeHandler,
 		pool.StringToKind("dir "): self.dirHandler,
 		pool.StringToKind("null"): self.nullHandler,
+		pool.StringToKind("xatr"): self.nullHandler,
 
 		pool.StringToKind("dir0"): self.indHandler,
 		pool.StringToKind("dir1"): self.indHandler,
@@ -71,10 +72,17 @@ func (self *walker) walk(oid *pool.OID) (err error) {
 	if !ok {
 		log.Printf("Unsupported kind %q", ch.Kind().String())
 		// err = fmt.Errorf("Unsupported kind %q", ch.Kind().String())
-		return
+	} else {
+		err = hand(ch)
+		if err != nil {
+			return
+		}
 	}
 
-	return hand(ch)
+	if late, ok := self.visit.(LateVisitor); ok {
+		err = late.LateVisit(ch)
+	}
+	return
 }
 
 type handler func(chunk pool.Chunk) (err error)
@@ -135,6 +143,11 @@ func (self *walker) nodeHandler(chunk pool.Chunk) (err error) {
 			return
 		}
 
+		err = self.walkXattrs(pmap)
+		if err != nil {
+			return
+		}
+
 		var children *pool.OID
 		children, err = pool.ParseOID(pmap.Props["children"])
 		if err != nil {
@@ -159,6 +172,11 @@ func (self *walker) nodeHandler(chunk pool.Chunk) (err error) {
 			return
 		}
 
+		err = self.walkXattrs(pmap)
+		if err != nil {
+			return
+		}
+
 		var data *pool.OID
 		data, err = pool.ParseOID(pmap.Props["data"])
 		if err != nil {
@@ -180,11 +198,32 @@ func (self *walker) nodeHandler(chunk pool.Chunk) (err error) {
 		if err != nil {
 			return
 		}
+
+		err = self.walkXattrs(pmap)
+		if err != nil {
+			return
+		}
 	}
 
 	return
 }
 
+// Visit the chunks holding large extended attributes, so that they
+// are seen by things like prune and verify.
+func (self *walker) walkXattrs(pmap *PropertyMap) (err error) {
+	oids, err := pmap.xattrChunks()
+	if err != nil {
+		return
+	}
+	for _, oid := range oids {
+		err = self.walk(oid)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
 // The dirnode for the direct children.
 func (self *walker) dirHandler(chunk pool.Chunk) (err error) {
 	buf := bytes.NewBuffer(chunk.Data())
@@ -238,7 +277,8 @@ func (self *walker) blobHandler(chunk pool.Chunk) (err error) {
 }
 
 // Null means either empty file, or empty directory.  In either case,
-// there is nothing to do.
+// there is nothing to do.  Xattr chunks are also read through the
+// properties that refer to them, and need nothing here.
 func (self *walker) nullHandler(chunk pool.Chunk) (err error) {
 	return
 }
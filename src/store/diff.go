@@ -0,0 +1,192 @@
+package store
+
+import (
+	"sort"
+
+	"pool"
+)
+
+// Comparing two backup trees.  Identical subtrees share the same
+// node OIDs, so only the directories that differ are read.
+
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota
+	Removed
+	Modified
+	MetadataChanged
+)
+
+var changeNames = map[ChangeKind]string{
+	Added:           "added",
+	Removed:         "removed",
+	Modified:        "modified",
+	MetadataChanged: "metadata",
+}
+
+func (self ChangeKind) String() string {
+	return changeNames[self]
+}
+
+// A single difference between two trees.  'Old' is nil for added
+// entries, and 'New' for removed ones.  'Props' names the properties
+// that differ, other than the contents.
+type Change struct {
+	Kind  ChangeKind
+	Path  string
+	Old   *PropertyMap
+	New   *PropertyMap
+	Props []string
+}
+
+// The properties that refer to contents, rather than metadata.
+var contentProps = map[string]bool{
+	"data":     true,
+	"children": true,
+	"target":   true,
+}
+
+// Compare the trees under the nodes 'a' and 'b', calling 'report'
+// for each difference, in path order.  An added or removed directory
+// is reported once, without its contents.
+func Diff(pl pool.Pool, a, b *pool.OID, report func(change *Change) error) (err error) {
+	return diffNodes(pl, "", a, b, report)
+}
+
+func diffNodes(pl pool.Pool, name string, a, b *pool.OID, report func(change *Change) error) (err error) {
+	if a.Compare(b) == 0 {
+		return
+	}
+
+	old, err := ReadNode(pl, a)
+	if err != nil {
+		return
+	}
+	new, err := ReadNode(pl, b)
+	if err != nil {
+		return
+	}
+
+	change := &Change{Path: name, Old: old, New: new, Props: metadataDiff(old, new)}
+	switch {
+	case old.Kind != new.Kind:
+		change.Kind = Modified
+	case old.Kind == "DIR":
+		if len(change.Props) > 0 {
+			change.Kind = MetadataChanged
+			err = report(change)
+			if err != nil {
+				return
+			}
+		}
+		return diffDirs(pl, name, old, new, report)
+	case old.Props["data"] != new.Props["data"] || old.Props["target"] != new.Props["target"]:
+		change.Kind = Modified
+	case len(change.Props) > 0:
+		change.Kind = MetadataChanged
+	default:
+		return
+	}
+	return report(change)
+}
+
+func diffDirs(pl pool.Pool, name string, old, new *PropertyMap, report func(change *Change) error) (err error) {
+	if old.Props["children"] == new.Props["children"] {
+		return
+	}
+
+	oldEntries, err := readChildren(pl, old)
+	if err != nil {
+		return
+	}
+	newEntries, err := readChildren(pl, new)
+	if err != nil {
+		return
+	}
+
+	i, j := 0, 0
+	for i < len(oldEntries) || j < len(newEntries) {
+		switch {
+		case j == len(newEntries) || (i < len(oldEntries) && oldEntries[i].Name < newEntries[j].Name):
+			err = reportOne(pl, Removed, joinPath(name, oldEntries[i].Name), oldEntries[i].OID, report)
+			i++
+		case i == len(oldEntries) || newEntries[j].Name < oldEntries[i].Name:
+			err = reportOne(pl, Added, joinPath(name, newEntries[j].Name), newEntries[j].OID, report)
+			j++
+		default:
+			err = diffNodes(pl, joinPath(name, oldEntries[i].Name), oldEntries[i].OID, newEntries[j].OID, report)
+			i++
+			j++
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Report an entry present in only one of the trees.
+func reportOne(pl pool.Pool, kind ChangeKind, name string, oid *pool.OID, report func(change *Change) error) (err error) {
+	props, err := ReadNode(pl, oid)
+	if err != nil {
+		return
+	}
+	change := &Change{Kind: kind, Path: name}
+	if kind == Added {
+		change.New = props
+	} else {
+		change.Old = props
+	}
+	return report(change)
+}
+
+// The entries of a directory node, sorted by name.
+func readChildren(pl pool.Pool, props *PropertyMap) (entries []DirEntry, err error) {
+	children, err := pool.ParseOID(props.Props["children"])
+	if err != nil {
+		return
+	}
+	entries, err = ReadDir(pl, children)
+	if err != nil {
+		return
+	}
+	sort.Sort(dirEntriesByName(entries))
+	return
+}
+
+// The names of the metadata properties that differ between two
+// nodes.
+func metadataDiff(old, new *PropertyMap) (names []string) {
+	for key, value := range old.Props {
+		if contentProps[key] {
+			continue
+		}
+		if other, ok := new.Props[key]; !ok || other != value {
+			names = append(names, key)
+		}
+	}
+	for key := range new.Props {
+		if contentProps[key] {
+			continue
+		}
+		if _, ok := old.Props[key]; !ok {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+type dirEntriesByName []DirEntry
+
+func (p dirEntriesByName) Len() int           { return len(p) }
+func (p dirEntriesByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p dirEntriesByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
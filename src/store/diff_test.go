@@ -0,0 +1,77 @@
+package store_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"pool"
+	"store"
+	"tutil"
+)
+
+func TestDiff(t *testing.T) {
+	pt := tutil.NewPoolTest(t)
+	defer pt.Clean()
+
+	file := func(data, mode string) *pool.OID {
+		props := store.NewPropertyMap("REG")
+		props.Props["data"] = pool.NewPoolChunk(pt.Pool, "blob", []byte(data)).OID().String()
+		props.Props["mode"] = mode
+		return writeNode(t, pt.Pool, "node", props)
+	}
+
+	// A subtree shared by both trees is never read, so it doesn't
+	// even need to be in the pool.
+	shared := pool.IntOID(1)
+
+	sub1 := writeDirNode(t, pt.Pool, []store.DirEntry{{Name: "a", OID: file("a", "420")}})
+	sub2 := writeDirNode(t, pt.Pool, []store.DirEntry{
+		{Name: "a", OID: file("a", "420")},
+		{Name: "new", OID: file("n", "420")},
+	})
+	root1 := writeDirNode(t, pt.Pool, []store.DirEntry{
+		{Name: "chmod", OID: file("c", "420")},
+		{Name: "edit", OID: file("e", "420")},
+		{Name: "gone", OID: file("g", "420")},
+		{Name: "same", OID: shared},
+		{Name: "sub", OID: sub1},
+	})
+	root2 := writeDirNode(t, pt.Pool, []store.DirEntry{
+		{Name: "added", OID: file("x", "420")},
+		{Name: "chmod", OID: file("c", "384")},
+		{Name: "edit", OID: file("E", "420")},
+		{Name: "same", OID: shared},
+		{Name: "sub", OID: sub2},
+	})
+
+	var changes []string
+	err := store.Diff(pt.Pool, root1, root2, func(change *store.Change) error {
+		changes = append(changes, fmt.Sprintf("%s %s %s", change.Kind, change.Path,
+			strings.Join(change.Props, ",")))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Diff failed: %q", err)
+	}
+
+	expect := []string{
+		"added added ",
+		"metadata chmod mode",
+		"modified edit ",
+		"removed gone ",
+		"added sub/new ",
+	}
+	if strings.Join(changes, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("Diff gave:\n%s\nexpecting:\n%s", strings.Join(changes, "\n"), strings.Join(expect, "\n"))
+	}
+
+	changes = nil
+	err = store.Diff(pt.Pool, root1, root1, func(change *store.Change) error {
+		changes = append(changes, change.Path)
+		return nil
+	})
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Diff of a tree with itself gave %q (%v)", changes, err)
+	}
+}
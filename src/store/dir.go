@@ -67,7 +67,7 @@ func (self *DirWriter) ship() (err error) {
 		return
 	}
 
-	ch := pool.NewChunk("dir ", self.current)
+	ch := pool.NewPoolChunk(self.pool, "dir ", self.current)
 	err = self.pool.Insert(ch)
 	if err != nil {
 		return
@@ -2,7 +2,6 @@ package store
 
 import (
 	"io"
-	"log"
 	"os"
 	"syscall"
 
@@ -11,7 +10,12 @@ import (
 
 // Storing filedata into the store.
 
-func WriteFile(pl pool.Pool, name string) (id *pool.OID, err error) {
+// Write the contents of the named file to the pool, splitting it into
+// blobs with the given kind of chunker.  The blobs are hashed, and
+// those the pool doesn't already have are compressed, on up to
+// 'workers' goroutines each, but are inserted into the pool in file
+// order, so the result doesn't depend on the number of workers.
+func WriteFile(pl pool.Pool, name string, chunker string, workers int) (id *pool.OID, err error) {
 	file, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NOATIME, 0)
 	if err != nil {
 		// Try again, without O_NOATIME, since that is only
@@ -25,35 +29,87 @@ func WriteFile(pl pool.Pool, name string) (id *pool.OID, err error) {
 	}
 	defer file.Close()
 
+	return WriteData(pl, file, name, chunker, workers)
+}
+
+// Write the data read from 'rd' to the pool, in the same way as
+// WriteFile.  'name' is only used in messages.
+func WriteData(pl pool.Pool, rd io.Reader, name string, chunker string, workers int) (id *pool.OID, err error) {
+	pieces, err := NewChunker(chunker, fullReader{rd}, name)
+	if err != nil {
+		return
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
 	ind := NewIndirectWriter(pl, "ind", 256*1024)
-	buffer := make([]byte, 256*1024)
-	shortCount := 0
+	blobs, quit := makeBlobs(pl, pieces, workers)
+	defer close(quit)
+
+	// The pool is only used from this goroutine.  Blobs are
+	// checked against the pool as they arrive, and then wait in
+	// 'queue' for those before them to be written.  'queued' holds
+	// the blobs in the queue being compressed, so that a repeated
+	// blob is only compressed once.
+	window := 2 * workers
+	compress := make(chan *pendingBlob, window)
+	defer close(compress)
+	for i := 0; i < workers; i++ {
+		go compressBlobs(compress)
+	}
+
+	var queue []*pendingBlob
+	queued := make(map[pool.OID]bool)
+	more := true
 	for {
-		var n int
-		n, err = file.Read(buffer)
-		if err == io.EOF {
-			err = nil
-			break
-		}
-		if err != nil {
-			// TODO: Warn
-			return
-		}
+		if more && len(queue) < window {
+			blob, ok := <-blobs
+			if !ok {
+				more = false
+				continue
+			}
+			var ch pool.Chunk
+			ch, err = blob.wait()
+			if err != nil {
+				// TODO: Warn
+				return
+			}
 
-		if n < len(buffer) {
-			shortCount++
-			if shortCount > 1 {
-				log.Printf("WARN: multiple short reads from %s", name)
+			missing := !queued[*ch.OID()]
+			if missing {
+				var has bool
+				has, err = pl.Contains(ch.OID())
+				if err != nil {
+					return
+				}
+				missing = !has
 			}
+			if missing {
+				queued[*ch.OID()] = true
+				blob.compressed = make(chan struct{})
+				compress <- blob
+			}
+			queue = append(queue, blob)
+			continue
+		}
+		if len(queue) == 0 {
+			break
 		}
 
-		ch := pool.NewChunk("blob", buffer[0:n])
-		err = pl.Insert(ch)
-		if err != nil {
-			return
+		blob := queue[0]
+		queue = queue[1:]
+		if blob.compressed != nil {
+			<-blob.compressed
+			err = pl.Insert(blob.chunk)
+			if err != nil {
+				return
+			}
+			delete(queued, *blob.chunk.OID())
 		}
 
-		err = ind.Add(ch.OID())
+		err = ind.Add(blob.chunk.OID())
 		if err != nil {
 			return
 		}
@@ -61,3 +117,104 @@ func WriteFile(pl pool.Pool, name string) (id *pool.OID, err error) {
 
 	return ind.Finalize()
 }
+
+// A piece of the file, on its way to becoming a chunk.  A piece with
+// an error marks the end of the data.  'hashed' is closed once the
+// chunk is made, and 'compressed', for chunks the pool needs, once its
+// data is compressed.
+type pendingBlob struct {
+	data       []byte
+	err        error
+	chunk      pool.Chunk
+	hashed     chan struct{}
+	compressed chan struct{}
+}
+
+func (self *pendingBlob) wait() (ch pool.Chunk, err error) {
+	if self.err != nil {
+		err = self.err
+		return
+	}
+	<-self.hashed
+	ch = self.chunk
+	return
+}
+
+// Compress the chunks of the blobs sent to 'work', rather than when
+// the pool asks for it.
+func compressBlobs(work <-chan *pendingBlob) {
+	for blob := range work {
+		blob.chunk.ZData()
+		close(blob.compressed)
+	}
+}
+
+// Read the pieces of the file, and hand them to the workers to be
+// made into chunks.  The pieces come out of the returned channel in
+// the order they were read, and only a bounded number are in flight
+// at once.  Closing 'quit' stops the reader early.
+func makeBlobs(pl pool.Pool, pieces Chunker, workers int) (blobs <-chan *pendingBlob, quit chan struct{}) {
+	ordered := make(chan *pendingBlob, 2*workers)
+	work := make(chan *pendingBlob)
+	quit = make(chan struct{})
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for blob := range work {
+				blob.chunk = pool.NewPoolChunk(pl, "blob", blob.data)
+				close(blob.hashed)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(ordered)
+		defer close(work)
+
+		for {
+			data, err := pieces.Next()
+			if err == io.EOF {
+				return
+			}
+
+			blob := &pendingBlob{err: err, hashed: make(chan struct{})}
+			if err == nil {
+				// The chunker reuses its buffer.
+				blob.data = append([]byte(nil), data...)
+			}
+
+			select {
+			case ordered <- blob:
+			case <-quit:
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			select {
+			case work <- blob:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	blobs = ordered
+	return
+}
+
+// Streams such as pipes and decompressors return short reads, which
+// would give the fixed chunker short blobs.  A fullReader only
+// returns less than asked for at the end of the data.
+type fullReader struct {
+	rd io.Reader
+}
+
+func (self fullReader) Read(p []byte) (n int, err error) {
+	n, err = io.ReadFull(self.rd, p)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,128 @@
+package store_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"pool"
+	"store"
+	"tutil"
+)
+
+type fileTest struct {
+	*tutil.PoolTest
+	store.EmptyVisitor
+	store.PathTrackerImpl
+
+	data bytes.Buffer
+}
+
+// Writing a file with several workers must give the same tree as
+// writing it serially.
+func TestWriteFile(t *testing.T) {
+	var self fileTest
+	self.PoolTest = tutil.NewPoolTest(t)
+	defer self.Clean()
+	self.InitPath()
+
+	name := self.Tmp.Path() + "/file"
+	data := makeRandom(5*1024*1024 + 1234)
+	err := ioutil.WriteFile(name, data, 0644)
+	if err != nil {
+		t.Fatalf("Unable to write file: %q", err)
+	}
+
+	for _, chunker := range []string{"fixed", "buzhash"} {
+		serial, err := store.WriteFile(self.Pool, name, chunker, 1)
+		if err != nil {
+			t.Fatalf("Error writing file: %q", err)
+		}
+
+		parallel, err := store.WriteFile(self.Pool, name, chunker, 8)
+		if err != nil {
+			t.Fatalf("Error writing file: %q", err)
+		}
+
+		if serial.Compare(parallel) != 0 {
+			t.Errorf("%s: parallel write gave %s, expecting %s",
+				chunker, parallel.String(), serial.String())
+		}
+
+		// A stream giving short reads must still be cut in
+		// the same places.
+		stream, err := store.WriteData(self.Pool, iotest.HalfReader(bytes.NewReader(data)), "stream", chunker, 4)
+		if err != nil {
+			t.Fatalf("Error writing stream: %q", err)
+		}
+		if serial.Compare(stream) != 0 {
+			t.Errorf("%s: stream write gave %s, expecting %s",
+				chunker, stream.String(), serial.String())
+		}
+
+		self.data.Reset()
+		err = store.Walk(self.Pool, parallel, &self)
+		if err != nil {
+			t.Errorf("Error walking file: %q", err)
+		}
+		if !bytes.Equal(self.data.Bytes(), data) {
+			t.Errorf("%s: file data did not read back", chunker)
+		}
+	}
+}
+
+func (self *fileTest) Blob(chunk pool.Chunk) (err error) {
+	self.data.Write(chunk.Data())
+	return
+}
+
+// Records the blobs inserted into a pool.
+type blobCounter struct {
+	pool.Pool
+	inserts map[pool.OID]int
+}
+
+func (self *blobCounter) Insert(chunk pool.Chunk) error {
+	if chunk.Kind() == pool.StringToKind("blob") {
+		self.inserts[*chunk.OID()]++
+	}
+	return self.Pool.Insert(chunk)
+}
+
+// Blobs the pool has, including repeats within the file, are not
+// inserted again.
+func TestWriteFileKnown(t *testing.T) {
+	pt := tutil.NewPoolTest(t)
+	defer pt.Clean()
+
+	block := makeRandom(256 * 1024)
+	var data []byte
+	for i := 0; i < 6; i++ {
+		data = append(data, block...)
+	}
+	data = append(data, makeRandom(100000)...)
+
+	counter := &blobCounter{Pool: pt.Pool, inserts: make(map[pool.OID]int)}
+	first, err := store.WriteData(counter, bytes.NewReader(data), "first", "fixed", 4)
+	if err != nil {
+		t.Fatalf("Error writing data: %q", err)
+	}
+	for oid, count := range counter.inserts {
+		if count != 1 {
+			t.Errorf("Blob %s inserted %d times", oid.String(), count)
+		}
+	}
+
+	counter.inserts = make(map[pool.OID]int)
+	second, err := store.WriteData(counter, bytes.NewReader(data), "second", "fixed", 4)
+	if err != nil {
+		t.Fatalf("Error writing data: %q", err)
+	}
+	if len(counter.inserts) != 0 {
+		t.Errorf("%d known blobs inserted again", len(counter.inserts))
+	}
+	if first.Compare(second) != 0 {
+		t.Errorf("Second write gave %s, expecting %s", second.String(), first.String())
+	}
+}
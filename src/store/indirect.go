@@ -41,7 +41,7 @@ func (self *IndirectWriter) Add(oid *pool.OID) (err error) {
 
 func (self *IndirectWriter) Finalize() (oid *pool.OID, err error) {
 	if len(self.tree) == 0 {
-		ch := pool.NewChunk("null", []byte{})
+		ch := pool.NewPoolChunk(self.pool, "null", []byte{})
 		err = self.pool.Insert(ch)
 		if err != nil {
 			return
@@ -95,7 +95,7 @@ func (self *IndirectWriter) room(level int, purge bool) (err error) {
 	}
 
 	if len(self.tree[level]) >= llimit {
-		ch := pool.NewChunk(self.kindName(level), self.tree[level])
+		ch := pool.NewPoolChunk(self.pool, self.kindName(level), self.tree[level])
 		// log.Printf("Writing indirect: level=%d (%s)", level, ch.OID().String())
 		// pdump.Dump(self.tree[level])
 		err = self.pool.Insert(ch)
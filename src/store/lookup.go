@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"pool"
+)
+
+// Reading individual nodes and directories, without walking the
+// whole tree.
+
+// Returned, wrapped with the path, when a path isn't in a backup.
+var ErrNotFound = errors.New("Not found in backup")
+
+// An entry in a directory.
+type DirEntry struct {
+	Name string
+	OID  *pool.OID
+}
+
+// Read and decode the node with the given OID.
+func ReadNode(pl pool.Pool, oid *pool.OID) (props *PropertyMap, err error) {
+	ch, err := pl.Search(oid)
+	if err != nil {
+		return
+	}
+	if ch.Kind() != pool.StringToKind("node") {
+		err = fmt.Errorf("Chunk %s is a %q, not a node", oid.String(), ch.Kind().String())
+		return
+	}
+	return decodeProp(ch.Data())
+}
+
+// Read the entries of a directory, given the OID in its "children"
+// property.  Only the directory chunks are read, not the children
+// themselves.
+func ReadDir(pl pool.Pool, children *pool.OID) (entries []DirEntry, err error) {
+	ch, err := pl.Search(children)
+	if err != nil {
+		return
+	}
+
+	switch ch.Kind().String() {
+	case "null":
+	case "dir ":
+		buf := bytes.NewBuffer(ch.Data())
+		for buf.Len() > 0 {
+			var entry DirEntry
+			entry.Name, err = readString16(buf)
+			if err != nil {
+				return
+			}
+			entry.OID, err = pool.OIDFromBytes(buf)
+			if err != nil {
+				return
+			}
+			entries = append(entries, entry)
+		}
+	case "dir0", "dir1", "dir2":
+		buf := bytes.NewBuffer(ch.Data())
+		for buf.Len() > 0 {
+			var oid *pool.OID
+			oid, err = pool.OIDFromBytes(buf)
+			if err != nil {
+				return
+			}
+			var more []DirEntry
+			more, err = ReadDir(pl, oid)
+			if err != nil {
+				return
+			}
+			entries = append(entries, more...)
+		}
+	default:
+		err = fmt.Errorf("Chunk %s is a %q, not a directory", children.String(), ch.Kind().String())
+	}
+	return
+}
+
+// Find the root node of a backup.  'id' may be the backup record, as
+// shown by the listing, or the root node itself.
+func BackupRoot(pl pool.Pool, id *pool.OID) (root *pool.OID, err error) {
+	ch, err := pl.Search(id)
+	if err != nil {
+		return
+	}
+
+	switch ch.Kind().String() {
+	case "node":
+		root = id
+	case "back":
+		var pmap *PropertyMap
+		pmap, err = decodeProp(ch.Data())
+		if err != nil {
+			return
+		}
+		hash, ok := pmap.Props["hash"]
+		if !ok {
+			err = fmt.Errorf("'hash' property not present in 'back' node")
+			return
+		}
+		root, err = pool.ParseOID(hash)
+	default:
+		err = fmt.Errorf("Chunk %s is a %q, not a backup", id.String(), ch.Kind().String())
+	}
+	return
+}
+
+// Find the node at 'name' below the node 'root', reading only the
+// directories along the way.  An empty name, or "/", is the root
+// itself.
+func Lookup(pl pool.Pool, root *pool.OID, name string) (oid *pool.OID, props *PropertyMap, err error) {
+	return NewResolver(pl).Lookup(root, name)
+}
+
+// A Resolver looks up paths, remembering the nodes and directories it
+// has read.  Backups share everything that didn't change, so looking
+// up the same path in many backups only reads the parts that differ.
+type Resolver struct {
+	pool  pool.Pool
+	nodes map[pool.OID]*PropertyMap
+	dirs  map[string][]DirEntry
+}
+
+func NewResolver(pl pool.Pool) *Resolver {
+	return &Resolver{
+		pool:  pl,
+		nodes: make(map[pool.OID]*PropertyMap),
+		dirs:  make(map[string][]DirEntry),
+	}
+}
+
+// Read the node with the given OID.
+func (self *Resolver) Node(oid *pool.OID) (props *PropertyMap, err error) {
+	props, ok := self.nodes[*oid]
+	if ok {
+		return
+	}
+	props, err = ReadNode(self.pool, oid)
+	if err != nil {
+		return
+	}
+	self.nodes[*oid] = props
+	return
+}
+
+// Read the entries of a directory node.
+func (self *Resolver) Dir(props *PropertyMap) (entries []DirEntry, err error) {
+	text := props.Props["children"]
+	entries, ok := self.dirs[text]
+	if ok {
+		return
+	}
+	children, err := pool.ParseOID(text)
+	if err != nil {
+		return
+	}
+	entries, err = ReadDir(self.pool, children)
+	if err != nil {
+		return
+	}
+	self.dirs[text] = entries
+	return
+}
+
+// Find the node at 'name' below the node 'root', as with Lookup.
+func (self *Resolver) Lookup(root *pool.OID, name string) (oid *pool.OID, props *PropertyMap, err error) {
+	oid = root
+	props, err = self.Node(oid)
+	if err != nil {
+		return
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		if props.Kind != "DIR" {
+			err = fmt.Errorf("%w: %s (not a directory)", ErrNotFound, name)
+			return
+		}
+
+		var entries []DirEntry
+		entries, err = self.Dir(props)
+		if err != nil {
+			return
+		}
+
+		oid = nil
+		for _, entry := range entries {
+			if entry.Name == part {
+				oid = entry.OID
+				break
+			}
+		}
+		if oid == nil {
+			err = fmt.Errorf("%w: %s", ErrNotFound, name)
+			return
+		}
+
+		props, err = self.Node(oid)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,172 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"pool"
+	"store"
+	"tutil"
+)
+
+// ReadDir must return the same entries, in order, that were written,
+// including directories large enough to need indirect blocks.
+func TestReadDir(t *testing.T) {
+	pt := tutil.NewPoolTest(t)
+	defer pt.Clean()
+
+	for _, count := range []int{0, 1, 500} {
+		dirw := store.NewDirWriter(pt.Pool, 1024)
+		for i := 0; i < count; i++ {
+			err := dirw.Add(fmt.Sprintf("name%d", i), pool.IntOID(i))
+			if err != nil {
+				t.Fatalf("Error adding entry: %q", err)
+			}
+		}
+		oid, err := dirw.Finalize()
+		if err != nil {
+			t.Fatalf("Error finalizing: %q", err)
+		}
+
+		entries, err := store.ReadDir(pt.Pool, oid)
+		if err != nil {
+			t.Fatalf("Error reading dir: %q", err)
+		}
+		if len(entries) != count {
+			t.Fatalf("Read %d entries, expecting %d", len(entries), count)
+		}
+		for i, entry := range entries {
+			if entry.Name != fmt.Sprintf("name%d", i) || entry.OID.Compare(pool.IntOID(i)) != 0 {
+				t.Errorf("Entry %d read as %q %s", i, entry.Name, entry.OID.String())
+			}
+		}
+	}
+}
+
+// Write a node, returning its OID.
+func writeNode(t *testing.T, pl pool.Pool, kind string, props *store.PropertyMap) *pool.OID {
+	ch := pool.NewPoolChunk(pl, kind, props.Encode())
+	err := pl.Insert(ch)
+	if err != nil {
+		t.Fatalf("Error writing node: %q", err)
+	}
+	return ch.OID()
+}
+
+// Write a directory node holding the given entries.
+func writeDirNode(t *testing.T, pl pool.Pool, entries []store.DirEntry) *pool.OID {
+	dirw := store.NewDirWriter(pl, 1024)
+	for _, entry := range entries {
+		err := dirw.Add(entry.Name, entry.OID)
+		if err != nil {
+			t.Fatalf("Error adding entry: %q", err)
+		}
+	}
+	children, err := dirw.Finalize()
+	if err != nil {
+		t.Fatalf("Error finalizing: %q", err)
+	}
+
+	props := store.NewPropertyMap("DIR")
+	props.Props["children"] = children.String()
+	return writeNode(t, pl, "node", props)
+}
+
+func TestLookup(t *testing.T) {
+	pt := tutil.NewPoolTest(t)
+	defer pt.Clean()
+
+	file := store.NewPropertyMap("REG")
+	file.Props["size"] = "0"
+	fileOID := writeNode(t, pt.Pool, "node", file)
+
+	sub := writeDirNode(t, pt.Pool, []store.DirEntry{{Name: "file", OID: fileOID}})
+	root := writeDirNode(t, pt.Pool, []store.DirEntry{
+		{Name: "afile", OID: fileOID},
+		{Name: "sub", OID: sub},
+	})
+
+	back := store.NewPropertyMap("back")
+	back.Props["hash"] = root.String()
+	backOID := writeNode(t, pt.Pool, "back", back)
+
+	top, err := store.BackupRoot(pt.Pool, backOID)
+	if err != nil || top.Compare(root) != 0 {
+		t.Fatalf("Backup root is %v (%v), expecting %s", top, err, root.String())
+	}
+	top, err = store.BackupRoot(pt.Pool, root)
+	if err != nil || top.Compare(root) != 0 {
+		t.Fatalf("Root of root is %v (%v), expecting %s", top, err, root.String())
+	}
+
+	for name, expect := range map[string]*pool.OID{
+		"":           root,
+		"/":          root,
+		"sub":        sub,
+		"/sub/":      sub,
+		"sub/file":   fileOID,
+		"./afile":    fileOID,
+		"missing":    nil,
+		"sub/other":  nil,
+		"afile/file": nil,
+	} {
+		oid, props, err := store.Lookup(pt.Pool, root, name)
+		if expect == nil {
+			if err == nil {
+				t.Errorf("Lookup of %q should have failed", name)
+			} else if !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("Lookup of %q gave %q, expecting not found", name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Lookup of %q failed: %q", name, err)
+			continue
+		}
+		if oid.Compare(expect) != 0 || props == nil {
+			t.Errorf("Lookup of %q found %s, expecting %s", name, oid.String(), expect.String())
+		}
+	}
+}
+
+// A Resolver must only read each directory once, however many times
+// it is looked through.
+func TestResolver(t *testing.T) {
+	pt := tutil.NewPoolTest(t)
+	defer pt.Clean()
+
+	file := store.NewPropertyMap("REG")
+	fileOID := writeNode(t, pt.Pool, "node", file)
+	sub := writeDirNode(t, pt.Pool, []store.DirEntry{{Name: "file", OID: fileOID}})
+	roots := []*pool.OID{
+		writeDirNode(t, pt.Pool, []store.DirEntry{{Name: "sub", OID: sub}}),
+		writeDirNode(t, pt.Pool, []store.DirEntry{{Name: "other", OID: fileOID}, {Name: "sub", OID: sub}}),
+	}
+
+	counter := &countingPool{Pool: pt.Pool}
+	res := store.NewResolver(counter)
+	for _, root := range roots {
+		oid, _, err := res.Lookup(root, "sub/file")
+		if err != nil || oid.Compare(fileOID) != 0 {
+			t.Fatalf("Lookup gave %v (%v)", oid, err)
+		}
+	}
+
+	// Two roots and their directories, plus one each of the
+	// shared directory, its entries, and the file.
+	if counter.searches != 7 {
+		t.Errorf("Resolver made %d searches, expecting 7", counter.searches)
+	}
+}
+
+// A pool that counts the chunks read from it.
+type countingPool struct {
+	pool.Pool
+	searches int
+}
+
+func (self *countingPool) Search(oid *pool.OID) (pool.Chunk, error) {
+	self.searches++
+	return self.Pool.Search(oid)
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Selecting parts of a backup by path.
+
+// A PathMatcher selects paths within a backup.  Each pattern is a
+// path relative to the root of the backup, whose components may use
+// the glob syntax of path.Match.  A pattern selects the paths that it
+// matches, and everything below them.
+type PathMatcher struct {
+	patterns [][]string
+	names    []string
+	used     []bool
+}
+
+// Build a matcher for the given patterns.  With no patterns,
+// everything is selected.  A leading '/' on a pattern is ignored.
+func NewPathMatcher(patterns []string) (self *PathMatcher, err error) {
+	self = &PathMatcher{}
+
+	for _, name := range patterns {
+		clean := path.Clean("/" + name)
+		var parts []string
+		if clean != "/" {
+			parts = strings.Split(clean[1:], "/")
+		}
+
+		for _, part := range parts {
+			_, err = path.Match(part, "")
+			if err != nil {
+				err = fmt.Errorf("Invalid pattern %q: %s", name, err)
+				return
+			}
+		}
+
+		self.patterns = append(self.patterns, parts)
+		self.names = append(self.names, name)
+		self.used = append(self.used, false)
+	}
+	return
+}
+
+// Check a path, relative to the root of the backup, as returned by
+// PathTracker.Path(""). 'selected' is set if the path is selected,
+// 'ancestor' if something below it might be.
+func (self *PathMatcher) Match(name string) (selected, ancestor bool) {
+	if len(self.patterns) == 0 {
+		selected = true
+		return
+	}
+
+	var parts []string
+	if name != "" {
+		parts = strings.Split(name, "/")
+	}
+
+	for i, pattern := range self.patterns {
+		count := len(parts)
+		if count > len(pattern) {
+			count = len(pattern)
+		}
+		if !matchParts(pattern[:count], parts[:count]) {
+			continue
+		}
+
+		if len(parts) >= len(pattern) {
+			self.used[i] = true
+			selected = true
+		} else {
+			ancestor = true
+		}
+	}
+	return
+}
+
+func matchParts(pattern, parts []string) bool {
+	for i := range pattern {
+		ok, _ := path.Match(pattern[i], parts[i])
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the patterns that haven't matched anything yet.
+func (self *PathMatcher) Unmatched() (names []string) {
+	for i, name := range self.names {
+		if !self.used[i] {
+			names = append(names, name)
+		}
+	}
+	return
+}
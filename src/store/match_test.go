@@ -0,0 +1,55 @@
+package store_test
+
+import (
+	"testing"
+
+	"store"
+)
+
+func TestPathMatcher(t *testing.T) {
+	match, err := store.NewPathMatcher([]string{"/home/user/doc.txt", "etc/*.conf"})
+	if err != nil {
+		t.Fatalf("Unable to make matcher: %q", err)
+	}
+
+	checks := []struct {
+		name     string
+		selected bool
+		ancestor bool
+	}{
+		{"", false, true},
+		{"home", false, true},
+		{"home/user", false, true},
+		{"home/user/doc.txt", true, false},
+		{"home/other", false, false},
+		{"etc", false, true},
+		{"etc/fstab", false, false},
+		{"etc/host.conf", true, false},
+		{"etc/host.conf/below", true, false},
+		{"usr", false, false},
+	}
+	for _, c := range checks {
+		selected, ancestor := match.Match(c.name)
+		if selected != c.selected || ancestor != c.ancestor {
+			t.Errorf("Match(%q) = %v, %v, expecting %v, %v", c.name,
+				selected, ancestor, c.selected, c.ancestor)
+		}
+	}
+
+	if len(match.Unmatched()) != 0 {
+		t.Errorf("Patterns left unmatched: %v", match.Unmatched())
+	}
+
+	match, err = store.NewPathMatcher(nil)
+	if err != nil {
+		t.Fatalf("Unable to make matcher: %q", err)
+	}
+	if selected, _ := match.Match("any/thing"); !selected {
+		t.Errorf("Empty matcher doesn't select everything")
+	}
+
+	_, err = store.NewPathMatcher([]string{"bad/["})
+	if err == nil {
+		t.Errorf("Invalid pattern accepted")
+	}
+}
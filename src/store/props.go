@@ -143,3 +143,14 @@ func (self *PropertyMap) GetInt(name string) (value int, err error) {
 	value = int(tmp)
 	return
 }
+
+// Extract a property that may need 64 bits, such as a device or
+// inode number.
+func (self *PropertyMap) GetUint64(name string) (value uint64, err error) {
+	text, ok := self.Props[name]
+	if !ok {
+		err = fmt.Errorf("Missing property: %q", name)
+		return
+	}
+	return strconv.ParseUint(text, 10, 64)
+}
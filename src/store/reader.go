@@ -0,0 +1,360 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"pool"
+)
+
+// Reading file data at arbitrary offsets.
+
+// A FileReader reads the data of a backed up file, starting from the
+// "data" OID of its node.  The blob holding a given offset is found
+// by descending the indirect blocks.  In files written by the fixed
+// chunker, every blob but the last is the same size, and every
+// indirect block but the last at each level is full, so the path
+// can be computed directly.  For other files, the sizes of the
+// subtrees are added up, using sizes recorded by the pool where
+// possible, and remembered.
+type FileReader struct {
+	pool pool.Pool
+	root pool.Chunk
+
+	// For files of fixed size blobs, the blob size, and the number
+	// of children in a full indirect block.  Zero otherwise.
+	block  int64
+	fanout int64
+
+	// The total size, or -1 until it is known.
+	size int64
+
+	// Lengths of the subtrees that have been added up.
+	lengths map[pool.OID]int64
+
+	// The position for Read and Seek.
+	pos int64
+
+	// The blob most recently read.
+	lastOID  *pool.OID
+	lastData []byte
+}
+
+// Construct a reader for the file data with the given OID.  'size'
+// is the size recorded in the file's node, or -1 if it isn't known.
+// The fixed layout is only used when it gives the recorded size, so
+// a short blob in the middle of a file isn't mistaken for one.
+func NewFileReader(pl pool.Pool, data *pool.OID, size int64) (self *FileReader, err error) {
+	self = &FileReader{
+		pool:    pl,
+		size:    -1,
+		lengths: make(map[pool.OID]int64),
+	}
+
+	self.root, err = pl.Search(data)
+	if err != nil {
+		return
+	}
+
+	if size >= 0 {
+		err = self.checkFixed(size)
+	}
+	return
+}
+
+// Decide if the file is made of fixed size blobs.  This only looks
+// down the leftmost and rightmost paths through the tree, and the
+// blobs are checked again as they are read.
+func (self *FileReader) checkFixed(size int64) (err error) {
+	top, ok := indLevel(self.root.Kind())
+	if !ok {
+		return
+	}
+
+	// The leftmost indirect block at level 0 is full, unless it
+	// is the only one.
+	ch := self.root
+	for level := top; level > 0; level-- {
+		ch, err = self.pool.Search(childOIDs(ch)[0])
+		if err != nil {
+			return
+		}
+	}
+	first := childOIDs(ch)[0]
+	fanout := int64(len(childOIDs(ch)))
+
+	// Count the blobs along the rightmost path.
+	ch = self.root
+	var count int64
+	for level := top; ; level-- {
+		children := childOIDs(ch)
+		count += int64(len(children)-1) * power(fanout, level)
+		last := children[len(children)-1]
+		if level == 0 {
+			count++
+
+			var firstLen, lastLen uint32
+			firstLen, err = pool.ChunkDataLen(self.pool, first)
+			if err != nil {
+				return
+			}
+			lastLen, err = pool.ChunkDataLen(self.pool, last)
+			if err != nil {
+				return
+			}
+			total := (count-1)*fixedBlockSize + int64(lastLen)
+			if firstLen == fixedBlockSize && lastLen <= fixedBlockSize && total == size {
+				self.block = fixedBlockSize
+				self.fanout = fanout
+				self.size = total
+			}
+			return
+		}
+
+		ch, err = self.pool.Search(last)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Return the total size of the file data.
+func (self *FileReader) Size() (size int64, err error) {
+	if self.size < 0 {
+		switch kind := self.root.Kind().String(); kind {
+		case "null":
+			self.size = 0
+		case "blob":
+			self.size = int64(self.root.DataLen())
+		default:
+			level, ok := indLevel(self.root.Kind())
+			if !ok {
+				err = fmt.Errorf("Unexpected %q chunk in file data", kind)
+				return
+			}
+			self.size, err = self.length(self.root.OID(), level)
+			if err != nil {
+				return
+			}
+		}
+	}
+	size = self.size
+	return
+}
+
+// The length of the data under the given OID, which is an indirect
+// block of the given level, or a blob if 'level' is -1.
+func (self *FileReader) length(oid *pool.OID, level int) (length int64, err error) {
+	length, ok := self.lengths[*oid]
+	if ok {
+		return
+	}
+
+	if level < 0 {
+		var size uint32
+		size, err = pool.ChunkDataLen(self.pool, oid)
+		length = int64(size)
+	} else {
+		var ch pool.Chunk
+		ch, err = self.pool.Search(oid)
+		if err != nil {
+			return
+		}
+		for _, child := range childOIDs(ch) {
+			var sub int64
+			sub, err = self.length(child, level-1)
+			if err != nil {
+				return
+			}
+			length += sub
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	self.lengths[*oid] = length
+	return
+}
+
+// Find the blob holding 'offset', and the offset the blob starts at.
+// Returns io.EOF if the offset is past the end of the data.
+func (self *FileReader) locate(offset int64) (oid *pool.OID, start int64, err error) {
+	ch := self.root
+	for {
+		kind := ch.Kind()
+		if kind == pool.StringToKind("blob") {
+			if offset-start >= int64(ch.DataLen()) {
+				err = io.EOF
+			}
+			oid = ch.OID()
+			return
+		}
+		if kind == pool.StringToKind("null") {
+			err = io.EOF
+			return
+		}
+		level, ok := indLevel(kind)
+		if !ok {
+			err = fmt.Errorf("Unexpected %q chunk in file data", kind.String())
+			return
+		}
+
+		children := childOIDs(ch)
+		var child *pool.OID
+		if self.block > 0 {
+			span := self.block * power(self.fanout, level)
+			index := (offset - start) / span
+			if index >= int64(len(children)) {
+				err = io.EOF
+				return
+			}
+			child = children[index]
+			start += index * span
+		} else {
+			for _, tmp := range children {
+				var length int64
+				length, err = self.length(tmp, level-1)
+				if err != nil {
+					return
+				}
+				if offset < start+length {
+					child = tmp
+					break
+				}
+				start += length
+			}
+			if child == nil {
+				err = io.EOF
+				return
+			}
+		}
+
+		if level == 0 {
+			oid = child
+			return
+		}
+		ch, err = self.pool.Search(child)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (self *FileReader) readBlob(oid *pool.OID) (data []byte, err error) {
+	if self.lastOID != nil && self.lastOID.Compare(oid) == 0 {
+		data = self.lastData
+		return
+	}
+
+	ch, err := self.pool.Search(oid)
+	if err != nil {
+		return
+	}
+	data = ch.Data()
+	self.lastOID = oid
+	self.lastData = data
+	return
+}
+
+func (self *FileReader) ReadAt(p []byte, offset int64) (n int, err error) {
+	if offset < 0 {
+		err = errors.New("Negative offset")
+		return
+	}
+
+	for n < len(p) {
+		pos := offset + int64(n)
+		if self.block > 0 && pos >= self.size {
+			err = io.EOF
+			return
+		}
+
+		var oid *pool.OID
+		var start int64
+		oid, start, err = self.locate(pos)
+		if err != nil {
+			return
+		}
+
+		var data []byte
+		data, err = self.readBlob(oid)
+		if err != nil {
+			return
+		}
+
+		// If a blob doesn't fit the fixed layout, fall back to
+		// adding up the sizes.
+		if self.block > 0 && int64(len(data)) != self.block && start+int64(len(data)) != self.size {
+			self.block = 0
+			self.size = -1
+			continue
+		}
+
+		n += copy(p[n:], data[pos-start:])
+	}
+	return
+}
+
+func (self *FileReader) Read(p []byte) (n int, err error) {
+	n, err = self.ReadAt(p, self.pos)
+	self.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+func (self *FileReader) Seek(offset int64, whence int) (pos int64, err error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += self.pos
+	case io.SeekEnd:
+		var size int64
+		size, err = self.Size()
+		if err != nil {
+			return
+		}
+		offset += size
+	default:
+		err = errors.New("Invalid whence")
+		return
+	}
+	if offset < 0 {
+		err = errors.New("Negative position")
+		return
+	}
+	self.pos = offset
+	pos = offset
+	return
+}
+
+// Return the level of a file indirect block.
+func indLevel(kind pool.Kind) (level int, ok bool) {
+	text := kind.String()
+	if len(text) != 4 || text[:3] != "ind" || text[3] < '0' || text[3] > '3' {
+		return
+	}
+	return int(text[3] - '0'), true
+}
+
+// Decode the OIDs in an indirect block.
+func childOIDs(ch pool.Chunk) (oids []*pool.OID) {
+	data := ch.Data()
+	for pos := 0; pos+pool.OIDLen <= len(data); pos += pool.OIDLen {
+		var oid pool.OID
+		copy(oid[:], data[pos:pos+pool.OIDLen])
+		oids = append(oids, &oid)
+	}
+	return
+}
+
+func power(base int64, exp int) (result int64) {
+	result = 1
+	for i := 0; i < exp; i++ {
+		result *= base
+	}
+	return
+}
@@ -0,0 +1,114 @@
+package store_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"pool"
+	"store"
+	"tutil"
+)
+
+// Check random reads, a sequential read, and seeking in the given
+// file data.
+func checkReader(t *testing.T, pl pool.Pool, oid *pool.OID, data []byte) {
+	rd, err := store.NewFileReader(pl, oid, int64(len(data)))
+	if err != nil {
+		t.Fatalf("Unable to make reader: %q", err)
+	}
+
+	size, err := rd.Seek(0, io.SeekEnd)
+	if err != nil || size != int64(len(data)) {
+		t.Errorf("Size is %d (%v), expecting %d", size, err, len(data))
+	}
+
+	rng := rand.New(rand.NewSource(int64(len(data))))
+	for i := 0; i < 50; i++ {
+		offset := rng.Int63n(int64(len(data)) + 1)
+		buf := make([]byte, rng.Intn(600*1024))
+		n, err := rd.ReadAt(buf, offset)
+		want := data[offset:]
+		if len(want) > len(buf) {
+			want = want[:len(buf)]
+		}
+		if n < len(buf) && err != io.EOF {
+			t.Errorf("Short read without EOF: %v", err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("Data mismatch reading %d bytes at %d", len(buf), offset)
+		}
+	}
+
+	_, err = rd.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Errorf("Unable to seek: %q", err)
+	}
+	all, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Errorf("Error reading: %q", err)
+	}
+	if !bytes.Equal(all, data) {
+		t.Errorf("Sequential read mismatch")
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	pt := tutil.NewPoolTest(t)
+	defer pt.Clean()
+
+	name := pt.Tmp.Path() + "/file"
+	data := makeRandom(3*1024*1024 + 4321)
+	err := ioutil.WriteFile(name, data, 0644)
+	if err != nil {
+		t.Fatalf("Unable to write file: %q", err)
+	}
+
+	for _, chunker := range []string{"fixed", "buzhash"} {
+		oid, err := store.WriteFile(pt.Pool, name, chunker, 2)
+		if err != nil {
+			t.Fatalf("Error writing file: %q", err)
+		}
+		checkReader(t, pt.Pool, oid, data)
+	}
+}
+
+// Build files with small indirect blocks, so that several levels are
+// needed, with fixed and varying blob sizes.  The "short" layout
+// looks fixed until the short blob in the middle is read.
+func TestFileReaderLevels(t *testing.T) {
+	pt := tutil.NewPoolTest(t)
+	defer pt.Clean()
+
+	for _, layout := range []string{"fixed", "varying", "short"} {
+		var data []byte
+		ind := store.NewIndirectWriter(pt.Pool, "ind", 3*pool.OIDLen)
+		for i := 0; i < 20; i++ {
+			size := 256 * 1024
+			if layout == "varying" {
+				size = 1000 + i*7919
+			}
+			if layout == "short" && i == 7 {
+				size = 1000
+			}
+			piece := makeRandom(size + i)[i:]
+			ch := pool.NewPoolChunk(pt.Pool, "blob", piece)
+			err := pt.Pool.Insert(ch)
+			if err != nil {
+				t.Fatalf("Error inserting: %q", err)
+			}
+			err = ind.Add(ch.OID())
+			if err != nil {
+				t.Fatalf("Error adding: %q", err)
+			}
+			data = append(data, piece...)
+		}
+		oid, err := ind.Finalize()
+		if err != nil {
+			t.Fatalf("Error finalizing: %q", err)
+		}
+		checkReader(t, pt.Pool, oid, data)
+	}
+}
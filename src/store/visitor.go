@@ -45,6 +45,14 @@ type Visitor interface {
 	Blob(chunk pool.Chunk) error
 }
 
+// A visitor that also implements LateVisitor has LateVisit called on
+// each chunk once everything it refers to has been visited, such as to
+// write children before their parents.  Not called if the walk of the
+// chunk was pruned at EarlyVisit or Chunk.
+type LateVisitor interface {
+	LateVisit(chunk pool.Chunk) error
+}
+
 // The empty visitor can be included to provide empty default
 // implementations.
 type EmptyVisitor struct{}
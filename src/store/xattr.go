@@ -0,0 +1,89 @@
+package store
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"pool"
+)
+
+// Extended attributes are kept in a node's properties.  Small values
+// are stored inline, under "xattr:name".  Larger ones are written as
+// their own "xatr" chunk, with the OID stored under "xattr-oid:name".
+const (
+	xattrPrefix    = "xattr:"
+	xattrOIDPrefix = "xattr-oid:"
+	xattrInline    = 1024
+)
+
+// Record the given extended attributes in the properties.
+func (self *PropertyMap) SetXattrs(pl pool.Pool, attrs map[string][]byte) (err error) {
+	for name, value := range attrs {
+		// Property names are limited to 255 bytes.
+		if len(xattrOIDPrefix)+len(name) > 255 {
+			log.Printf("WARN: xattr name too long, skipping: %q", name)
+			continue
+		}
+
+		if len(value) <= xattrInline {
+			self.Props[xattrPrefix+name] = string(value)
+			continue
+		}
+
+		ch := pool.NewPoolChunk(pl, "xatr", value)
+		err = pl.Insert(ch)
+		if err != nil {
+			return
+		}
+		self.Props[xattrOIDPrefix+name] = ch.OID().String()
+	}
+	return
+}
+
+// Return the extended attributes recorded in the properties, reading
+// any large values from the pool.
+func (self *PropertyMap) Xattrs(pl pool.Pool) (attrs map[string][]byte, err error) {
+	attrs = make(map[string][]byte)
+	for key, value := range self.Props {
+		switch {
+		case strings.HasPrefix(key, xattrPrefix):
+			attrs[key[len(xattrPrefix):]] = []byte(value)
+
+		case strings.HasPrefix(key, xattrOIDPrefix):
+			var oid *pool.OID
+			oid, err = pool.ParseOID(value)
+			if err != nil {
+				return
+			}
+			var ch pool.Chunk
+			ch, err = pl.Search(oid)
+			if err != nil {
+				return
+			}
+			attrs[key[len(xattrOIDPrefix):]] = ch.Data()
+		}
+	}
+	return
+}
+
+// The OIDs of the chunks holding large attributes, in a stable order.
+func (self *PropertyMap) xattrChunks() (oids []*pool.OID, err error) {
+	keys := make([]string, 0)
+	for key := range self.Props {
+		if strings.HasPrefix(key, xattrOIDPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var oid *pool.OID
+		oid, err = pool.ParseOID(self.Props[key])
+		if err != nil {
+			return
+		}
+		oids = append(oids, oid)
+	}
+	return
+}
@@ -0,0 +1,42 @@
+package store_test
+
+import (
+	"bytes"
+	"testing"
+
+	"store"
+	"tutil"
+)
+
+func TestXattrProps(t *testing.T) {
+	pt := tutil.NewPoolTest(t)
+	defer pt.Clean()
+
+	attrs := map[string][]byte{
+		"user.small":          []byte("abc"),
+		"user.large":          bytes.Repeat([]byte("x"), 5000),
+		"security.capability": {1, 0, 0, 2},
+	}
+
+	props := store.NewPropertyMap("REG")
+	err := props.SetXattrs(pt.Pool, attrs)
+	if err != nil {
+		t.Fatalf("Unable to set xattrs: %q", err)
+	}
+	if _, ok := props.Props["xattr:user.large"]; ok {
+		t.Errorf("Large xattr stored inline")
+	}
+
+	back, err := props.Xattrs(pt.Pool)
+	if err != nil {
+		t.Fatalf("Unable to read xattrs: %q", err)
+	}
+	if len(back) != len(attrs) {
+		t.Errorf("Read %d xattrs, expecting %d", len(back), len(attrs))
+	}
+	for name, value := range attrs {
+		if !bytes.Equal(back[name], value) {
+			t.Errorf("Xattr %q read back as %q", name, back[name])
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package tutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Dumping uses blkid to find the filesystem being backed up.  Stand in
+// for it with a script naming the block device holding 'dir', or skip
+// the test if there isn't one, such as on tmpfs.
+func FakeBlkid(t *testing.T, dir string) {
+	var st syscall.Stat_t
+	err := syscall.Stat(dir, &st)
+	if err != nil {
+		t.Fatalf("Unable to stat %q: %s", dir, err)
+	}
+
+	names, _ := filepath.Glob("/dev/*")
+	device := ""
+	for _, name := range names {
+		var dev syscall.Stat_t
+		if syscall.Stat(name, &dev) == nil && dev.Mode&syscall.S_IFMT == syscall.S_IFBLK && dev.Rdev == st.Dev {
+			device = name
+			break
+		}
+	}
+	if device == "" {
+		t.Skipf("No block device found for %q", dir)
+	}
+
+	bin := filepath.Join(dir, "bin")
+	err = os.Mkdir(bin, 0755)
+	if err == nil {
+		script := fmt.Sprintf("#!/bin/sh\necho '%s: UUID=\"tutil-test\" TYPE=\"ext4\" '\n", device)
+		err = ioutil.WriteFile(filepath.Join(bin, "blkid"), []byte(script), 0755)
+	}
+	if err != nil {
+		t.Fatalf("Unable to write blkid script: %s", err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+}
@@ -19,7 +19,7 @@ func NewPoolTest(t *testing.T) (pt *PoolTest) {
 	self.Tmp = NewTempDir(t)
 
 	base := self.Tmp.Path() + "/pool"
-	err := pool.CreateSqlPool(base)
+	err := pool.CreateSqlPool(base, nil)
 	if err != nil {
 		t.Errorf("Unable to create pool: '%s'", err)
 	}